@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ========== AUTH MODELS ==========
+
+type Admin struct {
+	ID        int       `json:"id"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+const (
+	sessionCookieName = "studydz_session"
+	sessionTTL        = 7 * 24 * time.Hour
+	minPasswordLength = 8
+)
+
+// dummyPasswordHash is compared against when the username is unknown so that
+// failed logins take the same time whether or not the account exists.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("studydz-dummy-password"), bcrypt.DefaultCost)
+
+// ========== ADMIN ACCOUNTS ==========
+
+func createAdmin(username, password string) (int, error) {
+	username = strings.TrimSpace(username)
+	if username == "" {
+		return 0, errors.New("username is required")
+	}
+	if len(password) < minPasswordLength {
+		return 0, fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := db.Exec("INSERT INTO admins (username, password_hash) VALUES (?, ?)", username, string(hash))
+	if err != nil {
+		return 0, err
+	}
+	id, _ := result.LastInsertId()
+	return int(id), nil
+}
+
+// bootstrapAdmin creates the first admin account from ADMIN_USERNAME and
+// ADMIN_PASSWORD when the admins table is still empty.
+func bootstrapAdmin() error {
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM admins").Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return ensureSuperAdmin()
+	}
+
+	username := os.Getenv("ADMIN_USERNAME")
+	password := os.Getenv("ADMIN_PASSWORD")
+	if username == "" || password == "" {
+		log.Println("⚠️  No admin account exists: set ADMIN_USERNAME/ADMIN_PASSWORD or run `create-admin <username>`")
+		return nil
+	}
+
+	id, err := createAdmin(username, password)
+	if err != nil {
+		return err
+	}
+	if _, err := grantRole(id, RoleSuperAdmin, nil, nil, nil); err != nil {
+		return err
+	}
+	log.Printf("✅ Admin account %q created", username)
+	return nil
+}
+
+// ensureSuperAdmin promotes the oldest account when no super admin exists, so
+// databases created before roles were introduced keep a manageable admin.
+func ensureSuperAdmin() error {
+	_, err := db.Exec(`INSERT INTO admin_grants (admin_id, role)
+                       SELECT MIN(id), ? FROM admins
+                       HAVING COUNT(*) > 0
+                          AND NOT EXISTS (SELECT 1 FROM admin_grants WHERE role = ?)`,
+		RoleSuperAdmin, RoleSuperAdmin)
+	return err
+}
+
+func createAdminCommand(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: create-admin <username> (the account is granted super_admin)")
+	}
+
+	password := os.Getenv("ADMIN_PASSWORD")
+	if password == "" {
+		fmt.Print("Password: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return err
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+
+	id, err := createAdmin(args[0], password)
+	if err != nil {
+		return err
+	}
+	if _, err := grantRole(id, RoleSuperAdmin, nil, nil, nil); err != nil {
+		return err
+	}
+	log.Printf("✅ Admin account %q created (id %d)", args[0], id)
+	return nil
+}
+
+// ========== SESSIONS ==========
+
+func newSessionToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func sessionTokenFromRequest(c *gin.Context) string {
+	if auth := c.GetHeader("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	token, _ := c.Cookie(sessionCookieName)
+	return token
+}
+
+func setSessionCookie(c *gin.Context, token string, maxAge int) {
+	secure := c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https"
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(sessionCookieName, token, maxAge, "/", "", secure, true)
+}
+
+func currentAdmin(c *gin.Context) Admin {
+	admin, _ := c.Get("admin")
+	a, _ := admin.(Admin)
+	return a
+}
+
+// AuthRequired rejects requests that do not carry a valid session, either as
+// the session cookie or as an "Authorization: Bearer" token.
+func AuthRequired() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := sessionTokenFromRequest(c)
+		if token == "" {
+			c.AbortWithStatusJSON(401, gin.H{"error": "Authentication required"})
+			return
+		}
+
+		var admin Admin
+		err := db.QueryRow(`SELECT a.id, a.username, a.created_at
+                            FROM admin_sessions s
+                            JOIN admins a ON s.admin_id = a.id
+                            WHERE s.token_hash = ? AND s.expires_at > ?`,
+			hashToken(token), timeNow().Unix()).Scan(&admin.ID, &admin.Username, &admin.CreatedAt)
+		if err != nil {
+			if err != sql.ErrNoRows {
+				c.AbortWithStatusJSON(500, gin.H{"error": err.Error()})
+				return
+			}
+			c.AbortWithStatusJSON(401, gin.H{"error": "Session expired or invalid"})
+			return
+		}
+
+		c.Set("admin", admin)
+		c.Set("session_token", token)
+		c.Next()
+	}
+}
+
+// ========== AUTH HANDLERS ==========
+
+func Login(c *gin.Context) {
+	var credentials struct {
+		Username     string `json:"username"`
+		Password     string `json:"password"`
+		OTP          string `json:"otp"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	if err := c.BindJSON(&credentials); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	var admin Admin
+	var passwordHash string
+	err := db.QueryRow("SELECT id, username, password_hash, created_at FROM admins WHERE username = ?",
+		strings.TrimSpace(credentials.Username)).Scan(&admin.ID, &admin.Username, &passwordHash, &admin.CreatedAt)
+	if err != nil && err != sql.ErrNoRows {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if err == sql.ErrNoRows {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(credentials.Password))
+		c.JSON(401, gin.H{"error": "Invalid username or password"})
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(credentials.Password)) != nil {
+		c.JSON(401, gin.H{"error": "Invalid username or password"})
+		return
+	}
+
+	st, err := loadTOTP(admin.ID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if st.Enabled {
+		var check func() bool
+		switch {
+		case credentials.OTP != "":
+			check = func() bool { return checkTOTP(admin.ID, st, credentials.OTP) }
+		case credentials.RecoveryCode != "":
+			check = func() bool { return useRecoveryCode(admin.ID, credentials.RecoveryCode) }
+		default:
+			c.JSON(401, gin.H{"error": "Two-factor code required", "otp_required": true})
+			return
+		}
+		ok, answered := attemptTOTP(c, admin.ID, st, check)
+		if answered {
+			return
+		}
+		if !ok {
+			c.JSON(401, gin.H{"error": "Invalid two-factor or recovery code", "otp_required": true})
+			return
+		}
+	}
+
+	token, err := newSessionToken()
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	expiresAt := timeNow().Add(sessionTTL)
+
+	db.Exec("DELETE FROM admin_sessions WHERE expires_at <= ?", timeNow().Unix())
+	_, err = db.Exec("INSERT INTO admin_sessions (token_hash, admin_id, expires_at) VALUES (?, ?, ?)",
+		hashToken(token), admin.ID, expiresAt.Unix())
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	setSessionCookie(c, token, int(sessionTTL.Seconds()))
+	c.JSON(200, gin.H{"token": token, "expires_at": expiresAt, "admin": admin})
+}
+
+func Logout(c *gin.Context) {
+	db.Exec("DELETE FROM admin_sessions WHERE token_hash = ?", hashToken(c.GetString("session_token")))
+	setSessionCookie(c, "", -1)
+	c.JSON(200, gin.H{"message": "Logged out successfully"})
+}
+
+func GetCurrentAdmin(c *gin.Context) {
+	grants, err := currentGrants(c)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, AdminUser{Admin: currentAdmin(c), Grants: grants})
+}
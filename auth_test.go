@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// login posts credentials to the login route.
+func login(t *testing.T, username, password string) (int, string) {
+	t.Helper()
+	var resp struct {
+		Token string `json:"token"`
+		Error string `json:"error"`
+	}
+	code := call(t, "POST", "/api/admin/login", "", map[string]string{"username": username, "password": password}, &resp)
+	if code != 200 {
+		return code, resp.Error
+	}
+	return code, resp.Token
+}
+
+func TestLogin(t *testing.T) {
+	openTestDB(t)
+	addTestAdmin(t, "alice", RoleSuperAdmin, nil, nil, nil)
+
+	w := serve(testRequest("POST", "/api/admin/login", "", map[string]string{"username": " alice ", "password": "password-alice"}))
+	var resp struct {
+		Token string `json:"token"`
+		Admin Admin  `json:"admin"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != 200 || resp.Token == "" || resp.Admin.Username != "alice" {
+		t.Fatalf("login: %d %s", w.Code, w.Body)
+	}
+	if code := call(t, "GET", "/api/admin/me", resp.Token, nil, nil); code != 200 {
+		t.Errorf("session token: %d, want 200", code)
+	}
+	var cookie *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == sessionCookieName {
+			cookie = c
+		}
+	}
+	if cookie == nil || cookie.Value != resp.Token || !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode {
+		t.Errorf("session cookie = %+v", cookie)
+	}
+	// Only the token's hash is stored.
+	if n := count(t, "SELECT COUNT(*) FROM admin_sessions WHERE token_hash = ?", hashToken(resp.Token)); n != 1 {
+		t.Errorf("%d sessions stored under the token's hash, want 1", n)
+	}
+
+	// A wrong password and an unknown user get the same answer.
+	wrongCode, wrongError := login(t, "alice", "password-bob")
+	unknownCode, unknownError := login(t, "bob", "password-bob")
+	if wrongCode != 401 || unknownCode != 401 || wrongError != unknownError {
+		t.Errorf("wrong password: %d %q, unknown user: %d %q; want the same 401", wrongCode, wrongError, unknownCode, unknownError)
+	}
+	if code := call(t, "POST", "/api/admin/login", "", "not json", nil); code != 400 {
+		t.Errorf("malformed credentials: %d, want 400", code)
+	}
+}
+
+func TestDummyPasswordHash(t *testing.T) {
+	// Unknown users are checked against the dummy hash, which must cost as
+	// much as a real one for both answers to take the same time.
+	cost, err := bcrypt.Cost(dummyPasswordHash)
+	if err != nil || cost != bcrypt.DefaultCost {
+		t.Errorf("dummy hash cost = %d, %v; want %d", cost, err, bcrypt.DefaultCost)
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	openTestDB(t)
+	now := time.Unix(1234567890, 0)
+	setClock(t, now)
+	_, token := addTestAdmin(t, "alice", RoleSuperAdmin, nil, nil, nil)
+	_, loggedIn := login(t, "alice", "password-alice")
+
+	setClock(t, now.Add(sessionTTL-time.Second))
+	for _, session := range []string{token, loggedIn} {
+		if code := call(t, "GET", "/api/admin/me", session, nil, nil); code != 200 {
+			t.Errorf("session before expiry: %d, want 200", code)
+		}
+	}
+	setClock(t, now.Add(sessionTTL))
+	for _, session := range []string{token, loggedIn} {
+		if code := call(t, "GET", "/api/admin/me", session, nil, nil); code != 401 {
+			t.Errorf("expired session: %d, want 401", code)
+		}
+	}
+
+	// The next login clears the expired sessions.
+	if code, _ := login(t, "alice", "password-alice"); code != 200 {
+		t.Fatalf("login: %d", code)
+	}
+	if n := count(t, "SELECT COUNT(*) FROM admin_sessions"); n != 1 {
+		t.Errorf("%d sessions after a login, want only the new one", n)
+	}
+}
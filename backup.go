@@ -0,0 +1,459 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========== BACKUP & RESTORE ==========
+//
+// A backup is a .tar.gz holding:
+//
+//	StudyDz.db     a consistent snapshot taken with VACUUM INTO, safe while
+//	               the server runs
+//	files/<key>    every stored file the snapshot references
+//	manifest.json  the size and SHA-256 of each of the above
+//
+// `backup [file]` writes one, by default into BACKUP_DIR (default ./backups)
+// keeping the BACKUP_KEEP (default 7) most recent; BACKUP_INTERVAL, e.g. 24h,
+// makes the server do the same on a schedule. Super admins can download one
+// from GET /api/admin/backup. `restore <backup> <dir>` unpacks a backup into
+// an empty data directory, laid out for local storage, after checking every
+// checksum and the integrity of the database.
+
+const (
+	backupDBName       = "StudyDz.db"
+	backupManifestName = "manifest.json"
+	backupFilesDir     = "files"
+	defaultBackupKeep  = 7
+)
+
+type backupEntry struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type backupManifest struct {
+	CreatedAt     time.Time     `json:"created_at"`
+	SchemaVersion int           `json:"schema_version"`
+	Database      backupEntry   `json:"database"`
+	Files         []backupEntry `json:"files"`
+	// Missing lists referenced files that were not found in storage.
+	Missing []string `json:"missing"`
+}
+
+func backupDir() string {
+	if dir := os.Getenv("BACKUP_DIR"); dir != "" {
+		return dir
+	}
+	return "backups"
+}
+
+func backupKeep() int {
+	keep, err := strconv.Atoi(os.Getenv("BACKUP_KEEP"))
+	if err != nil || keep < 1 {
+		return defaultBackupKeep
+	}
+	return keep
+}
+
+func backupFileName(t time.Time) string {
+	return "studydz-" + t.UTC().Format("20060102-150405") + ".tar.gz"
+}
+
+// ========== WRITING BACKUPS ==========
+
+// hashingWriter counts and hashes what goes through it.
+type hashingWriter struct {
+	w    io.Writer
+	hash io.Writer
+	size int64
+	sum  func() string
+}
+
+func newHashingWriter(w io.Writer) *hashingWriter {
+	h := sha256.New()
+	return &hashingWriter{w: w, hash: h, sum: func() string { return hex.EncodeToString(h.Sum(nil)) }}
+}
+
+func (h *hashingWriter) Write(p []byte) (int, error) {
+	n, err := h.w.Write(p)
+	h.hash.Write(p[:n])
+	h.size += int64(n)
+	return n, err
+}
+
+// snapshotFileKeys lists the stored files referenced by a database snapshot.
+func snapshotFileKeys(snapshot string) ([]string, int, error) {
+	snap, err := sql.Open("sqlite", "file:"+snapshot+"?mode=ro")
+	if err != nil {
+		return nil, 0, err
+	}
+	defer snap.Close()
+
+	var version int
+	snap.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+
+	rows, err := snap.Query(`SELECT file_path FROM documents
+                             UNION SELECT file_path FROM document_versions
+                             ORDER BY 1`)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, 0, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, version, rows.Err()
+}
+
+// writeBackup streams a complete backup to w.
+func writeBackup(w io.Writer) (backupManifest, error) {
+	manifest := backupManifest{CreatedAt: timeNow().UTC(), Files: []backupEntry{}, Missing: []string{}}
+
+	tmp, err := os.MkdirTemp("", "studydz-backup-")
+	if err != nil {
+		return manifest, err
+	}
+	defer os.RemoveAll(tmp)
+	snapshot := filepath.Join(tmp, backupDBName)
+	if _, err := db.Exec("VACUUM INTO ?", snapshot); err != nil {
+		return manifest, fmt.Errorf("snapshot database: %w", err)
+	}
+	keys, version, err := snapshotFileKeys(snapshot)
+	if err != nil {
+		return manifest, err
+	}
+	manifest.SchemaVersion = version
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	f, err := os.Open(snapshot)
+	if err != nil {
+		return manifest, err
+	}
+	fi, err := f.Stat()
+	if err == nil {
+		manifest.Database, err = addBackupEntry(tw, backupDBName, f, fi.Size(), fi.ModTime())
+	}
+	f.Close()
+	if err != nil {
+		return manifest, err
+	}
+
+	for _, key := range keys {
+		body, info, err := store.Get(key)
+		if errors.Is(err, fs.ErrNotExist) {
+			log.Printf("⚠️  Backup: %s is referenced but missing", key)
+			manifest.Missing = append(manifest.Missing, key)
+			continue
+		}
+		if err != nil {
+			return manifest, err
+		}
+		entry, err := addBackupEntry(tw, path.Join(backupFilesDir, cleanKey(key)), body, info.Size, info.ModTime)
+		body.Close()
+		if err != nil {
+			return manifest, fmt.Errorf("back up %s: %w", key, err)
+		}
+		manifest.Files = append(manifest.Files, entry)
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return manifest, err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: backupManifestName, Mode: 0644, Size: int64(len(data)), ModTime: manifest.CreatedAt}); err != nil {
+		return manifest, err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return manifest, err
+	}
+	if err := tw.Close(); err != nil {
+		return manifest, err
+	}
+	return manifest, gz.Close()
+}
+
+func addBackupEntry(tw *tar.Writer, name string, r io.Reader, size int64, modTime time.Time) (backupEntry, error) {
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: size, ModTime: modTime}); err != nil {
+		return backupEntry{}, err
+	}
+	hw := newHashingWriter(tw)
+	if _, err := io.Copy(hw, r); err != nil {
+		return backupEntry{}, err
+	}
+	return backupEntry{Path: name, Size: hw.size, SHA256: hw.sum()}, nil
+}
+
+// createBackupFile writes a backup to file, going through a temporary name so
+// that an interrupted backup never looks complete.
+func createBackupFile(file string) (backupManifest, error) {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return backupManifest{}, err
+	}
+	partial := file + ".partial"
+	f, err := os.Create(partial)
+	if err != nil {
+		return backupManifest{}, err
+	}
+	manifest, err := writeBackup(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(partial, file)
+	}
+	if err != nil {
+		os.Remove(partial)
+	}
+	return manifest, err
+}
+
+// rotateBackups deletes all but the keep most recent backups in dir.
+func rotateBackups(dir string, keep int) error {
+	names, err := filepath.Glob(filepath.Join(dir, "studydz-*.tar.gz"))
+	if err != nil {
+		return err
+	}
+	// Names embed their UTC timestamp, so they sort oldest first.
+	sort.Strings(names)
+	for len(names) > keep {
+		if err := os.Remove(names[0]); err != nil {
+			return err
+		}
+		log.Printf("🗑️  Rotated out backup %s", filepath.Base(names[0]))
+		names = names[1:]
+	}
+	return nil
+}
+
+func runScheduledBackup() error {
+	file := filepath.Join(backupDir(), backupFileName(timeNow()))
+	manifest, err := createBackupFile(file)
+	if err != nil {
+		return err
+	}
+	log.Printf("💾 Backup written to %s (%d files, %d missing)", file, len(manifest.Files), len(manifest.Missing))
+	return rotateBackups(backupDir(), backupKeep())
+}
+
+func startBackupScheduler() {
+	interval, err := time.ParseDuration(os.Getenv("BACKUP_INTERVAL"))
+	if err != nil || interval <= 0 {
+		return
+	}
+	go func() {
+		for {
+			time.Sleep(interval)
+			if err := runScheduledBackup(); err != nil {
+				log.Printf("⚠️  Scheduled backup failed: %v", err)
+			}
+		}
+	}()
+}
+
+// ========== RESTORING BACKUPS ==========
+
+// restoreBackup unpacks archive into dir, which must be missing or empty. The
+// files are unpacked next to dir first and only moved in place once all of
+// them and the database have been verified; an entry the manifest does not
+// list fails the restore.
+func restoreBackup(archive, dir string) (backupManifest, error) {
+	var manifest backupManifest
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 {
+		return manifest, fmt.Errorf("%s is not empty", dir)
+	} else if err != nil && !os.IsNotExist(err) {
+		return manifest, err
+	}
+
+	parent := filepath.Dir(filepath.Clean(dir))
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return manifest, err
+	}
+	staging, err := os.MkdirTemp(parent, ".restore-")
+	if err != nil {
+		return manifest, err
+	}
+	defer os.RemoveAll(staging)
+
+	f, err := os.Open(archive)
+	if err != nil {
+		return manifest, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return manifest, fmt.Errorf("not a backup archive: %w", err)
+	}
+
+	unpacked := map[string]backupEntry{}
+	haveManifest := false
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return manifest, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if hdr.Name == backupManifestName {
+			if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+				return manifest, fmt.Errorf("invalid manifest: %w", err)
+			}
+			haveManifest = true
+			continue
+		}
+		entry, err := unpackBackupEntry(staging, hdr.Name, tr)
+		if err != nil {
+			return manifest, err
+		}
+		unpacked[entry.Path] = entry
+	}
+	if !haveManifest {
+		return manifest, errors.New("the archive has no manifest")
+	}
+
+	listed := append([]backupEntry{manifest.Database}, manifest.Files...)
+	for _, want := range listed {
+		if got, ok := unpacked[want.Path]; !ok {
+			return manifest, fmt.Errorf("%s is missing from the archive", want.Path)
+		} else if got != want {
+			return manifest, fmt.Errorf("%s does not match its checksum", want.Path)
+		}
+		delete(unpacked, want.Path)
+	}
+	// Whatever is left was never checked.
+	for name := range unpacked {
+		return manifest, fmt.Errorf("%s is not listed in the manifest", name)
+	}
+	if err := checkDatabaseFile(filepath.Join(staging, backupDBName)); err != nil {
+		return manifest, err
+	}
+
+	if err := os.Remove(dir); err != nil && !os.IsNotExist(err) {
+		return manifest, err
+	}
+	return manifest, os.Rename(staging, dir)
+}
+
+// unpackBackupEntry writes an archive entry to its place in a data directory:
+// the database at the root and stored files at their key.
+func unpackBackupEntry(root, name string, r io.Reader) (backupEntry, error) {
+	var target string
+	switch {
+	case name == backupDBName:
+		target = backupDBName
+	case strings.HasPrefix(name, backupFilesDir+"/") && cleanKey(strings.TrimPrefix(name, backupFilesDir+"/")) != "":
+		target = cleanKey(strings.TrimPrefix(name, backupFilesDir+"/"))
+	default:
+		return backupEntry{}, fmt.Errorf("unexpected entry %q in the archive", name)
+	}
+
+	p := filepath.Join(root, filepath.FromSlash(target))
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return backupEntry{}, err
+	}
+	f, err := os.Create(p)
+	if err != nil {
+		return backupEntry{}, err
+	}
+	hw := newHashingWriter(f)
+	_, err = io.Copy(hw, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return backupEntry{Path: name, Size: hw.size, SHA256: hw.sum()}, err
+}
+
+func checkDatabaseFile(file string) error {
+	restored, err := sql.Open("sqlite", "file:"+file+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer restored.Close()
+	var result string
+	if err := restored.QueryRow("PRAGMA integrity_check").Scan(&result); err != nil {
+		return fmt.Errorf("restored database: %w", err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("restored database is corrupt: %s", result)
+	}
+	return nil
+}
+
+// ========== BACKUP HANDLER & COMMANDS ==========
+
+// DownloadBackup streams a fresh backup. Errors past the first byte can only
+// be logged; the truncated archive then fails to restore.
+func DownloadBackup(c *gin.Context) {
+	c.Header("Content-Type", "application/gzip")
+	c.Header("Content-Disposition", `attachment; filename="`+backupFileName(timeNow())+`"`)
+	c.Header("Cache-Control", "no-store")
+	c.Status(200)
+	if _, err := writeBackup(c.Writer); err != nil {
+		log.Printf("⚠️  Backup download failed: %v", err)
+		c.Error(err)
+	}
+}
+
+func backupCommand(args []string) error {
+	switch len(args) {
+	case 0:
+		return runScheduledBackup()
+	case 1:
+		manifest, err := createBackupFile(args[0])
+		if err != nil {
+			return err
+		}
+		log.Printf("💾 Backup written to %s (%d files, %d missing)", args[0], len(manifest.Files), len(manifest.Missing))
+		return nil
+	default:
+		return errors.New("usage: backup [file] (default: a new file in BACKUP_DIR, rotated)")
+	}
+}
+
+func restoreCommand(args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: restore <backup.tar.gz> <empty data directory>")
+	}
+	manifest, err := restoreBackup(args[0], args[1])
+	if err != nil {
+		return err
+	}
+	log.Printf("✅ Restored the backup of %s (schema version %d, %d files) into %s",
+		manifest.CreatedAt.Format(time.RFC3339), manifest.SchemaVersion, len(manifest.Files), args[1])
+	if len(manifest.Missing) > 0 {
+		log.Printf("⚠️  %d files were already missing when the backup was taken", len(manifest.Missing))
+	}
+	return nil
+}
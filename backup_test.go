@@ -0,0 +1,172 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBackupRoundTrip(t *testing.T) {
+	openTestDB(t)
+	seedTestData(t)
+	useTestStorage(t)
+	_, coursKey := addTestDocument(t, "cours", "%PDF-1.4 cours")
+	_, lostKey := addTestDocument(t, "perdu", "%PDF-1.4 perdu")
+	if err := store.Delete(lostKey); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := filepath.Join(t.TempDir(), backupFileName(timeNow()))
+	manifest, err := createBackupFile(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Files) != 1 || manifest.Files[0].Path != "files/"+coursKey {
+		t.Errorf("manifest files = %+v, want only %s", manifest.Files, coursKey)
+	}
+	if len(manifest.Missing) != 1 || manifest.Missing[0] != lostKey {
+		t.Errorf("manifest missing = %v, want [%s]", manifest.Missing, lostKey)
+	}
+	if manifest.SchemaVersion != latestSchemaVersion() {
+		t.Errorf("schema version = %d, want %d", manifest.SchemaVersion, latestSchemaVersion())
+	}
+
+	dir := filepath.Join(t.TempDir(), "data")
+	if _, err := restoreBackup(archive, dir); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(coursKey)))
+	if err != nil || string(data) != "%PDF-1.4 cours" {
+		t.Errorf("restored file = %q, %v", data, err)
+	}
+	restored, err := sql.Open("sqlite", "file:"+filepath.Join(dir, backupDBName)+"?mode=ro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	var documents int
+	if err := restored.QueryRow("SELECT COUNT(*) FROM documents").Scan(&documents); err != nil || documents != 2 {
+		t.Errorf("restored database has %d documents, %v; want 2", documents, err)
+	}
+
+	// A restore never writes over existing data.
+	if _, err := restoreBackup(archive, dir); err == nil || !strings.Contains(err.Error(), "not empty") {
+		t.Errorf("restore into a used directory: %v", err)
+	}
+}
+
+func TestRestoreRejectsTamperedArchive(t *testing.T) {
+	openTestDB(t)
+	seedTestData(t)
+	useTestStorage(t)
+	addTestDocument(t, "cours", "%PDF-1.4 cours")
+
+	archive := filepath.Join(t.TempDir(), "backup.tar.gz")
+	if _, err := createBackupFile(archive); err != nil {
+		t.Fatal(err)
+	}
+
+	// Flip the content of the stored file, keeping its size.
+	tampered := filepath.Join(t.TempDir(), "tampered.tar.gz")
+	rewriteArchive(t, archive, tampered, func(name string, data []byte) []byte {
+		if strings.HasPrefix(name, backupFilesDir+"/") {
+			return bytes.ToUpper(data)
+		}
+		return data
+	}, nil)
+	dir := filepath.Join(t.TempDir(), "data")
+	_, err := restoreBackup(tampered, dir)
+	if err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Fatalf("restore of a tampered archive: %v, want a checksum error", err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("a failed restore left %s behind: %v", dir, err)
+	}
+}
+
+// rewriteArchive copies a backup, passing every entry through edit and adding
+// the extra entries before the manifest.
+func rewriteArchive(t *testing.T, src, dst string, edit func(name string, data []byte) []byte, extra map[string]string) {
+	t.Helper()
+	in, err := os.Open(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	gzIn, err := gzip.NewReader(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	gzOut := gzip.NewWriter(out)
+	tw := tar.NewWriter(gzOut)
+
+	tr := tar.NewReader(gzIn)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name == backupManifestName {
+			for name, content := range extra {
+				if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}); err != nil {
+					t.Fatal(err)
+				}
+				tw.Write([]byte(content))
+			}
+		}
+		data = edit(hdr.Name, data)
+		hdr.Size = int64(len(data))
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(data)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzOut.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRestoreRejectsUnlistedEntries(t *testing.T) {
+	openTestDB(t)
+	seedTestData(t)
+	useTestStorage(t)
+	addTestDocument(t, "cours", "%PDF-1.4 cours")
+
+	archive := filepath.Join(t.TempDir(), "backup.tar.gz")
+	if _, err := createBackupFile(archive); err != nil {
+		t.Fatal(err)
+	}
+
+	mixed := filepath.Join(t.TempDir(), "mixed.tar.gz")
+	rewriteArchive(t, archive, mixed, func(name string, data []byte) []byte { return data },
+		map[string]string{backupFilesDir + "/uploads/ajout.pdf": "%PDF-1.4 ajout"})
+	dir := filepath.Join(t.TempDir(), "data")
+	_, err := restoreBackup(mixed, dir)
+	if err == nil || !strings.Contains(err.Error(), "not listed in the manifest") {
+		t.Fatalf("restore of an archive with an unlisted file: %v, want a manifest error", err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("a failed restore left %s behind: %v", dir, err)
+	}
+}
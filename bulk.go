@@ -0,0 +1,176 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========== BULK UPLOAD ==========
+//
+// POST /api/admin/upload/bulk takes many "files" fields in one multipart
+// request. Every file is published on its own exactly like a single upload,
+// and the answer reports the outcome of each, so one bad file does not cost
+// the others. A file's metadata comes from, by priority:
+//
+//   - its entry in the optional "manifest" field, a JSON array of
+//     {"file", "title", "subject_id", "category_id"} matched by file name
+//   - the "subject_id" and "category_id" form fields shared by all files
+//   - its file name, for the title
+//
+// The request is limited to maxBulkFiles files and BULK_UPLOAD_MAX_BYTES
+// (default 500 MiB) in total.
+
+const (
+	maxBulkFiles              = 100
+	defaultBulkUploadMaxBytes = 500 << 20
+)
+
+type bulkEntry struct {
+	File       string `json:"file"`
+	Title      string `json:"title"`
+	SubjectID  int    `json:"subject_id"`
+	CategoryID int    `json:"category_id"`
+}
+
+func bulkUploadLimit() int64 {
+	limit, err := strconv.ParseInt(os.Getenv("BULK_UPLOAD_MAX_BYTES"), 10, 64)
+	if err != nil || limit <= 0 {
+		return defaultBulkUploadMaxBytes
+	}
+	return limit
+}
+
+// parseManifest indexes the manifest entries by file name.
+func parseManifest(manifest string) (map[string]bulkEntry, error) {
+	entries := map[string]bulkEntry{}
+	if manifest == "" {
+		return entries, nil
+	}
+	var list []bulkEntry
+	if err := json.Unmarshal([]byte(manifest), &list); err != nil {
+		return nil, err
+	}
+	for _, entry := range list {
+		if entry.File == "" {
+			return nil, errors.New("every entry needs a file name")
+		}
+		if _, ok := entries[entry.File]; ok {
+			return nil, fmt.Errorf("%q is listed twice", entry.File)
+		}
+		entries[entry.File] = entry
+	}
+	return entries, nil
+}
+
+func UploadDocuments(c *gin.Context) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, bulkUploadLimit())
+	err := c.Request.ParseMultipartForm(32 << 20)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		c.JSON(413, gin.H{"error": "Upload is too large", "max_bytes": tooLarge.Limit})
+		return
+	}
+	if err != nil {
+		c.JSON(400, gin.H{"error": "No files uploaded"})
+		return
+	}
+
+	files := c.Request.MultipartForm.File["files"]
+	if len(files) == 0 {
+		c.JSON(400, gin.H{"error": "No files uploaded"})
+		return
+	}
+	if len(files) > maxBulkFiles {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("At most %d files can be uploaded at once", maxBulkFiles)})
+		return
+	}
+	entries, err := parseManifest(c.PostForm("manifest"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid manifest: " + err.Error()})
+		return
+	}
+	var defaults bulkEntry
+	for field, value := range map[string]*int{"subject_id": &defaults.SubjectID, "category_id": &defaults.CategoryID} {
+		if raw := c.PostForm(field); raw != "" {
+			if *value, err = strconv.Atoi(raw); err != nil {
+				c.JSON(400, gin.H{"error": "Invalid " + field})
+				return
+			}
+		}
+	}
+
+	results := []gin.H{}
+	uploaded := 0
+	seen := map[string]bool{}
+	for _, file := range files {
+		entry, ok := entries[file.Filename]
+		if !ok {
+			entry = bulkEntry{File: file.Filename}
+		}
+		if entry.SubjectID == 0 {
+			entry.SubjectID = defaults.SubjectID
+		}
+		if entry.CategoryID == 0 {
+			entry.CategoryID = defaults.CategoryID
+		}
+		seen[file.Filename] = true
+
+		result := publishBulkFile(c, file, entry)
+		if result["status"] == 200 {
+			uploaded++
+		}
+		results = append(results, result)
+	}
+	// Report manifest entries without a file, most likely a typo in a name.
+	for name := range entries {
+		if !seen[name] {
+			results = append(results, gin.H{"file": name, "status": 400, "error": "No file with this name was uploaded"})
+		}
+	}
+
+	c.JSON(200, gin.H{"uploaded": uploaded, "failed": len(results) - uploaded, "results": results})
+}
+
+// publishBulkFile publishes one file of a bulk upload and describes the
+// outcome with the status and body a single upload would have answered.
+func publishBulkFile(c *gin.Context, file *multipart.FileHeader, entry bulkEntry) gin.H {
+	if entry.Title == "" {
+		entry.Title = titleFromFileName(file.Filename)
+	}
+
+	var published publishedDocument
+	var err error
+	if entry.SubjectID == 0 || entry.CategoryID == 0 {
+		err = &uploadRejection{400, "subject_id and category_id are required", nil}
+	} else if err = checkAccess(c, RoleUploader, subjectScope, entry.SubjectID); errors.Is(err, sql.ErrNoRows) {
+		err = &uploadRejection{404, "Subject not found", nil}
+	} else if errors.Is(err, errForbidden) {
+		err = &uploadRejection{403, err.Error(), nil}
+	} else if err == nil {
+		published, err = publishDocument(entry.SubjectID, entry.CategoryID, entry.Title, multipartUpload(file), currentAdmin(c).ID)
+	}
+
+	status, result := 200, gin.H{"document_id": published.ID, "checksum": published.Checksum}
+	if err != nil {
+		var rejected *uploadRejection
+		if !errors.As(err, &rejected) {
+			log.Printf("⚠️  Bulk upload of %s failed: %v", file.Filename, err)
+		}
+		status, result = uploadErrorBody(err)
+	} else if published.Duplicate != nil {
+		result["duplicate"] = published.Duplicate
+	}
+	result["file"] = file.Filename
+	result["title"] = entry.Title
+	result["status"] = status
+	return result
+}
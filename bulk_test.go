@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestBulkUpload(t *testing.T) {
+	openTestDB(t)
+	seedTestData(t)
+	useTestStorage(t)
+	_, token := addTestAdmin(t, "uploader", RoleUploader, nil, nil, intPtr(1))
+
+	manifest := `[{"file": "examen.pdf", "title": "Examen final"},
+	              {"file": "ailleurs.pdf", "subject_id": 17},
+	              {"file": "absent.pdf"}]`
+	w := serve(multipartRequest(t, "/api/admin/upload/bulk", token,
+		map[string]string{"subject_id": "1", "category_id": "1", "manifest": manifest},
+		testFile{"files", "cours-1.pdf", testPDF},
+		testFile{"files", "examen.pdf", testPDF + "examen"},
+		testFile{"files", "setup.exe", "MZ\x90\x00"},
+		testFile{"files", "ailleurs.pdf", testPDF + "ailleurs"}))
+	var resp struct {
+		Uploaded int `json:"uploaded"`
+		Failed   int `json:"failed"`
+		Results  []struct {
+			File       string `json:"file"`
+			Title      string `json:"title"`
+			Status     int    `json:"status"`
+			DocumentID int64  `json:"document_id"`
+		} `json:"results"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != 200 || resp.Uploaded != 2 || resp.Failed != 3 {
+		t.Fatalf("bulk upload: %d, %d uploaded and %d failed: %s", w.Code, resp.Uploaded, resp.Failed, w.Body)
+	}
+
+	want := map[string]struct {
+		status int
+		title  string
+	}{
+		"cours-1.pdf":  {200, "cours 1"},
+		"examen.pdf":   {200, "Examen final"},
+		"setup.exe":    {415, "setup"},
+		"ailleurs.pdf": {403, "ailleurs"},
+		"absent.pdf":   {400, ""},
+	}
+	for _, r := range resp.Results {
+		expected, ok := want[r.File]
+		if !ok || r.Status != expected.status || r.Title != expected.title {
+			t.Errorf("%s: %d %q, want %d %q", r.File, r.Status, r.Title, expected.status, expected.title)
+		}
+		if r.Status == 200 {
+			if n := count(t, "SELECT COUNT(*) FROM documents WHERE id = ? AND title = ? AND subject_id = 1", r.DocumentID, r.Title); n != 1 {
+				t.Errorf("%s: document %d not published", r.File, r.DocumentID)
+			}
+		}
+		delete(want, r.File)
+	}
+	if len(want) != 0 {
+		t.Errorf("no result for %v", want)
+	}
+	if n := count(t, "SELECT COUNT(*) FROM documents"); n != 2 {
+		t.Errorf("%d documents, want 2", n)
+	}
+}
+
+func TestBulkUploadRequest(t *testing.T) {
+	openTestDB(t)
+	seedTestData(t)
+	useTestStorage(t)
+	_, token := addTestAdmin(t, "root", RoleSuperAdmin, nil, nil, nil)
+	t.Setenv("BULK_UPLOAD_MAX_BYTES", "4096")
+
+	tests := []struct {
+		name   string
+		fields map[string]string
+		files  []testFile
+		status int
+	}{
+		{"no files", map[string]string{"subject_id": "1"}, nil, 400},
+		{"invalid manifest", map[string]string{"manifest": "{"}, []testFile{{"files", "a.pdf", testPDF}}, 400},
+		{"manifest listing a file twice", map[string]string{"manifest": `[{"file": "a.pdf"}, {"file": "a.pdf"}]`},
+			[]testFile{{"files", "a.pdf", testPDF}}, 400},
+		{"invalid subject", map[string]string{"subject_id": "x"}, []testFile{{"files", "a.pdf", testPDF}}, 400},
+		{"too large", map[string]string{"subject_id": "1", "category_id": "1"},
+			[]testFile{{"files", "a.pdf", testPDF + string(make([]byte, 5000))}}, 413},
+	}
+	for _, tt := range tests {
+		w := serve(multipartRequest(t, "/api/admin/upload/bulk", token, tt.fields, tt.files...))
+		if w.Code != tt.status {
+			t.Errorf("%s: %d, want %d", tt.name, w.Code, tt.status)
+		}
+	}
+	if n := count(t, "SELECT COUNT(*) FROM documents"); n != 0 {
+		t.Errorf("%d documents published by refused requests", n)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/sync/singleflight"
+)
+
+// ========== READ CACHE ==========
+//
+// The public lists of levels, years, subjects and documents, and the stats,
+// are kept in memory under keys naming what they list:
+//
+//	levels
+//	years/<level_id>/
+//	subjects/<year_id>/
+//	documents/<subject_id or all>/<query string>
+//	stats
+//
+// Writes drop the keys they affect by prefix, e.g. a new document in subject
+// 17 drops documents/17/, documents/all/ and stats. Downloads drop nothing:
+// the counts they change catch up within documentsTTL and statsTTL.
+//
+// The hierarchy lists behind Versioned routes are also tied to the
+// content_version they were loaded at, and reloaded once it moves on. That
+// keeps them in step with the ETag even between a write's commit and its
+// invalidation, and after writes from CLI commands, which cannot reach the
+// server's cache.
+//
+// Concurrent misses on a key share one load, and the least recently used
+// entries go beyond READ_CACHE_ENTRIES.
+
+const (
+	hierarchyTTL            = 10 * time.Minute
+	documentsTTL            = time.Minute
+	statsTTL                = 30 * time.Second
+	defaultReadCacheEntries = 1000
+	documentsWithoutSubject = "all"
+)
+
+type cacheEntry struct {
+	key     string
+	value   any
+	version int64
+	expires time.Time
+}
+
+type CacheStats struct {
+	Entries       int   `json:"entries"`
+	MaxEntries    int   `json:"max_entries"`
+	Hits          int64 `json:"hits"`
+	Misses        int64 `json:"misses"`
+	Shared        int64 `json:"shared"`
+	Evictions     int64 `json:"evictions"`
+	Invalidations int64 `json:"invalidations"`
+}
+
+type readCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // front is the most recently used
+	stats   CacheStats
+	// generation counts invalidations; a load that started before one is
+	// returned to its callers but not stored.
+	generation uint64
+	loads      singleflight.Group
+}
+
+var reads = newReadCache(readCacheEntries())
+
+func readCacheEntries() int {
+	n, err := strconv.Atoi(os.Getenv("READ_CACHE_ENTRIES"))
+	if err != nil || n <= 0 {
+		return defaultReadCacheEntries
+	}
+	return n
+}
+
+func newReadCache(maxEntries int) *readCache {
+	return &readCache{
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+		stats:   CacheStats{MaxEntries: maxEntries},
+	}
+}
+
+// get returns the value of key, loading it when missing or expired.
+func (rc *readCache) get(key string, ttl time.Duration, load func() (any, error)) (any, error) {
+	return rc.getAt(key, 0, ttl, load)
+}
+
+// getAt is get for a value of the given content version: an entry loaded at
+// another version is loaded again.
+func (rc *readCache) getAt(key string, version int64, ttl time.Duration, load func() (any, error)) (any, error) {
+	rc.mu.Lock()
+	if el, ok := rc.entries[key]; ok {
+		entry := el.Value.(*cacheEntry)
+		if !timeNow().Before(entry.expires) {
+			rc.remove(el)
+		} else if entry.version == version {
+			rc.lru.MoveToFront(el)
+			rc.stats.Hits++
+			rc.mu.Unlock()
+			return entry.value, nil
+		}
+	}
+	rc.stats.Misses++
+	generation := rc.generation
+	rc.mu.Unlock()
+
+	// Loads are shared within a generation and version only, so a miss
+	// after a write never waits on a load that read the data before it.
+	value, err, shared := rc.loads.Do(fmt.Sprintf("%d/%d/%s", generation, version, key), func() (any, error) {
+		value, err := load()
+		if err == nil {
+			rc.store(key, value, version, ttl, generation)
+		}
+		return value, err
+	})
+	if shared {
+		rc.mu.Lock()
+		rc.stats.Shared++
+		rc.mu.Unlock()
+	}
+	return value, err
+}
+
+func (rc *readCache) store(key string, value any, version int64, ttl time.Duration, generation uint64) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if generation != rc.generation {
+		return
+	}
+	if el, ok := rc.entries[key]; ok {
+		// A slow load never replaces one made at a later version.
+		if el.Value.(*cacheEntry).version > version {
+			return
+		}
+		rc.remove(el)
+	}
+	rc.entries[key] = rc.lru.PushFront(&cacheEntry{key: key, value: value, version: version, expires: timeNow().Add(ttl)})
+	for rc.lru.Len() > rc.stats.MaxEntries {
+		rc.remove(rc.lru.Back())
+		rc.stats.Evictions++
+	}
+}
+
+// remove drops an entry; the caller holds mu.
+func (rc *readCache) remove(el *list.Element) {
+	rc.lru.Remove(el)
+	delete(rc.entries, el.Value.(*cacheEntry).key)
+}
+
+// invalidate drops the entries whose key starts with one of prefixes; an
+// empty prefix drops everything.
+func (rc *readCache) invalidate(prefixes ...string) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.generation++
+	rc.stats.Invalidations++
+	for key, el := range rc.entries {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(key, prefix) {
+				rc.remove(el)
+				break
+			}
+		}
+	}
+}
+
+func (rc *readCache) snapshot() CacheStats {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	stats := rc.stats
+	stats.Entries = rc.lru.Len()
+	return stats
+}
+
+// ========== CACHE INVALIDATION ==========
+
+// parentKey is the key of the list of the children of a parent id, read
+// from a request's validated parameter.
+func parentKey(list, id string) string {
+	if n, err := strconv.Atoi(id); err == nil {
+		id = strconv.Itoa(n)
+	}
+	return list + "/" + id + "/"
+}
+
+// invalidateSubjectDocuments drops the document lists a document of one of
+// the subjects appears in.
+func invalidateSubjectDocuments(subjectIDs ...any) {
+	prefixes := []string{parentKey("documents", documentsWithoutSubject), "stats"}
+	for _, id := range subjectIDs {
+		prefixes = append(prefixes, parentKey("documents", fmt.Sprint(id)))
+	}
+	reads.invalidate(prefixes...)
+}
+
+// invalidateDocument drops the lists a document appears in, looking up its
+// subject.
+func invalidateDocument(id any) {
+	var subjectID int
+	if err := db.QueryRow("SELECT subject_id FROM documents WHERE id = ?", id).Scan(&subjectID); err != nil {
+		reads.invalidate("documents/", "stats")
+		return
+	}
+	invalidateSubjectDocuments(subjectID)
+}
+
+// invalidateTrashed follows a node moved to or restored from the trash, which
+// takes its descendants along.
+func invalidateTrashed(entity string, id any) {
+	switch entity {
+	case "documents":
+		invalidateDocument(id)
+	case "categories":
+		reads.invalidate("documents/")
+	default:
+		reads.invalidate("")
+	}
+}
+
+// ========== CACHE HANDLERS ==========
+
+func GetCacheStats(c *gin.Context) {
+	c.JSON(200, reads.snapshot())
+}
+
+func FlushCache(c *gin.Context) {
+	reads.invalidate("")
+	c.JSON(200, gin.H{"message": "Cache flushed"})
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// loader counts the loads of a read cache entry.
+type loader struct {
+	mu    sync.Mutex
+	loads int
+}
+
+func (l *loader) load(value any) func() (any, error) {
+	return func() (any, error) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.loads++
+		return value, nil
+	}
+}
+
+func TestReadCacheExpiryAndEviction(t *testing.T) {
+	start := time.Date(2024, 9, 30, 10, 0, 0, 0, time.UTC)
+	setClock(t, start)
+	rc := newReadCache(2)
+	var l loader
+
+	rc.get("levels", time.Minute, l.load(1))
+	rc.get("levels", time.Minute, l.load(2))
+	if l.loads != 1 {
+		t.Errorf("%d loads within the TTL, want 1", l.loads)
+	}
+	setClock(t, start.Add(time.Minute))
+	if v, _ := rc.get("levels", time.Minute, l.load(3)); v != 3 || l.loads != 2 {
+		t.Errorf("after the TTL: %v after %d loads, want 3 after 2", v, l.loads)
+	}
+
+	// levels is used last, so years/1/ goes first.
+	rc.get("years/1/", time.Hour, l.load("years"))
+	rc.get("levels", time.Hour, l.load(4))
+	rc.get("subjects/1/", time.Hour, l.load("subjects"))
+	stats := rc.snapshot()
+	if stats.Entries != 2 || stats.Evictions != 1 {
+		t.Errorf("%d entries and %d evictions, want 2 and 1", stats.Entries, stats.Evictions)
+	}
+	loads := l.loads
+	rc.get("levels", time.Hour, l.load(5))
+	rc.get("years/1/", time.Hour, l.load("years"))
+	if l.loads != loads+1 {
+		t.Errorf("%d loads, want only the evicted entry reloaded", l.loads-loads)
+	}
+
+	// Failed loads are not kept.
+	failed := func() (any, error) { return nil, errors.New("no database") }
+	if _, err := rc.get("stats", time.Hour, failed); err == nil {
+		t.Error("failed load returned no error")
+	}
+	if v, _ := rc.get("stats", time.Hour, l.load("stats")); v != "stats" {
+		t.Errorf("after a failed load: %v", v)
+	}
+}
+
+func TestReadCacheInvalidation(t *testing.T) {
+	rc := newReadCache(10)
+	var l loader
+	for _, key := range []string{"documents/1/", "documents/12/", "documents/all/", "stats"} {
+		rc.get(key, time.Hour, l.load(key))
+	}
+	rc.invalidate(parentKey("documents", "1"), "stats")
+	loads := l.loads
+	for _, key := range []string{"documents/1/", "documents/12/", "documents/all/", "stats"} {
+		rc.get(key, time.Hour, l.load(key))
+	}
+	if l.loads != loads+2 {
+		t.Errorf("%d reloads, want documents/1/ and stats only", l.loads-loads)
+	}
+
+	// A load overtaken by a write is returned but not kept.
+	rc.get("levels", time.Hour, func() (any, error) {
+		rc.invalidate("levels")
+		return "before the write", nil
+	})
+	if v, _ := rc.get("levels", time.Hour, l.load("after the write")); v != "after the write" {
+		t.Errorf("levels = %v, want the load after the write", v)
+	}
+
+	// An entry is only served at the version it was loaded at, and a slow
+	// load never replaces a later one.
+	rc.getAt("years/1/", 2, time.Hour, l.load("v2"))
+	if v, _ := rc.getAt("years/1/", 3, time.Hour, l.load("v3")); v != "v3" {
+		t.Errorf("at version 3: %v", v)
+	}
+	rc.getAt("years/1/", 2, time.Hour, l.load("v2 again"))
+	if v, _ := rc.getAt("years/1/", 3, time.Hour, l.load("v3 again")); v != "v3" {
+		t.Errorf("at version 3 after a slow load: %v, want v3", v)
+	}
+}
+
+func TestReadCacheSharesLoads(t *testing.T) {
+	rc := newReadCache(10)
+	release := make(chan struct{})
+	var l loader
+	load := func() (any, error) {
+		<-release
+		return l.load("levels")()
+	}
+
+	const callers = 8
+	var wg sync.WaitGroup
+	values := make(chan any, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, _ := rc.get("levels", time.Hour, load)
+			values <- v
+		}()
+	}
+	// Wait for every caller to miss, and to join the load, before letting it
+	// finish.
+	for rc.snapshot().Misses < callers {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(values)
+	for v := range values {
+		if v != "levels" {
+			t.Errorf("caller got %v", v)
+		}
+	}
+	if l.loads != 1 || rc.snapshot().Shared != callers {
+		t.Errorf("%d loads shared by %d callers, want 1 shared by %d", l.loads, rc.snapshot().Shared, callers)
+	}
+}
+
+func TestReadCacheFollowsWrites(t *testing.T) {
+	openTestDB(t)
+	seedTestData(t)
+	useTestStorage(t)
+	_, token := addTestAdmin(t, "root", RoleSuperAdmin, nil, nil, nil)
+	listed := func() int {
+		var page struct {
+			Total int `json:"total"`
+		}
+		w := serve(testRequest("GET", "/api/documents?subject_id=1", "", nil))
+		json.Unmarshal(w.Body.Bytes(), &page)
+		return page.Total
+	}
+
+	if n := listed(); n != 0 {
+		t.Fatalf("%d documents listed before any upload", n)
+	}
+	w := serve(multipartRequest(t, "/api/admin/upload", token,
+		map[string]string{"subject_id": "1", "category_id": "1", "title": "Cours"},
+		testFile{"file", "cours.pdf", testPDF}))
+	if w.Code != 200 {
+		t.Fatalf("upload: %d %s", w.Code, w.Body)
+	}
+	scanPendingFiles()
+	if n := listed(); n != 1 {
+		t.Errorf("%d documents listed once scanned, want 1", n)
+	}
+
+	var id int
+	db.QueryRow("SELECT id FROM documents").Scan(&id)
+	if err := trashNode("documents", id); err != nil {
+		t.Fatal(err)
+	}
+	if n := listed(); n != 0 {
+		t.Errorf("%d documents listed after trashing it, want 0", n)
+	}
+}
@@ -0,0 +1,15 @@
+package main
+
+import "time"
+
+// timeNow is the clock of everything that compares against the current
+// time: sessions, TOTP steps and lockouts, request signing, cache and upload
+// expiry, trash retention, backups and fsck grace periods. Network deadlines
+// use the real clock.
+var timeNow = time.Now
+
+// currentTimestamp is timeNow in the UTC form of SQLite's CURRENT_TIMESTAMP,
+// for the columns that default to it.
+func currentTimestamp() string {
+	return timeNow().UTC().Format("2006-01-02 15:04:05")
+}
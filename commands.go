@@ -0,0 +1,35 @@
+package main
+
+import "fmt"
+
+// ========== CLI COMMANDS ==========
+
+type command struct {
+	// needsSchema commands run after the database has been migrated and seeded.
+	needsSchema bool
+	run         func(args []string) error
+}
+
+var commands = map[string]command{
+	"backup":       {needsSchema: true, run: backupCommand},
+	"create-admin": {needsSchema: true, run: createAdminCommand},
+	"fsck":         {needsSchema: true, run: fsckCommand},
+	"import":       {needsSchema: true, run: importCommand},
+	"migrate":      {run: migrateCommand},
+	"restore":      {run: restoreCommand},
+}
+
+// runCommand executes a one-off maintenance command instead of starting the
+// HTTP server, e.g. `go run . create-admin alice`.
+func runCommand(args []string) error {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+	if cmd.needsSchema {
+		if err := initDB(); err != nil {
+			return err
+		}
+	}
+	return cmd.run(args[1:])
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========== NODE CONTEXT ==========
+//
+// GET /api/{years,subjects,documents}/:id/context returns what a page needs
+// around a node: its ancestry from the level down, in French and Arabic, and
+// the previous and next nodes beside it (years of the same level, subjects of
+// the same year; a document is placed beside its subject's neighbours).
+
+type Crumb struct {
+	Type   string `json:"type"`
+	ID     int    `json:"id"`
+	Name   string `json:"name"`
+	NameAr string `json:"name_ar"`
+	Icon   string `json:"icon,omitempty"`
+}
+
+type NodeContext struct {
+	Breadcrumb []Crumb `json:"breadcrumb"`
+	Previous   *Crumb  `json:"previous"`
+	Next       *Crumb  `json:"next"`
+}
+
+// contextAncestry loads the ancestry of a year, subject or document: depth
+// crumbs from the level down.
+var contextAncestry = map[string]struct {
+	depth    int
+	query    string
+	notFound string
+}{
+	"years": {2, `SELECT l.id, l.name, l.name_ar, y.id, y.name, y.name_ar
+               FROM years y
+               JOIN levels l ON l.id = y.level_id
+               WHERE y.id = ? AND y.deleted_at IS NULL AND l.deleted_at IS NULL`, "Year not found"},
+	"subjects": {3, `SELECT l.id, l.name, l.name_ar, y.id, y.name, y.name_ar, s.id, s.name, s.name_ar, s.icon
+                  FROM subjects s
+                  JOIN years y ON y.id = s.year_id
+                  JOIN levels l ON l.id = y.level_id
+                  WHERE s.id = ? AND s.deleted_at IS NULL AND y.deleted_at IS NULL AND l.deleted_at IS NULL`, "Subject not found"},
+	"documents": {4, `SELECT l.id, l.name, l.name_ar, y.id, y.name, y.name_ar, s.id, s.name, s.name_ar, s.icon, d.id, d.title, d.title
+                   FROM documents d
+                   JOIN subjects s ON s.id = d.subject_id
+                   JOIN years y ON y.id = s.year_id
+                   JOIN levels l ON l.id = y.level_id
+                   WHERE d.id = ? AND d.deleted_at IS NULL AND d.scan_status = 'clean'
+                     AND s.deleted_at IS NULL AND y.deleted_at IS NULL AND l.deleted_at IS NULL`, "Document not found"},
+}
+
+// contextSiblings finds the neighbours of a year within its level and of a
+// subject within its year, in the order the lists show them.
+var contextSiblings = map[string]struct {
+	previous string
+	next     string
+}{
+	"year": {
+		`SELECT id, name, name_ar, '' FROM years WHERE level_id = ? AND id < ? AND deleted_at IS NULL ORDER BY id DESC LIMIT 1`,
+		`SELECT id, name, name_ar, '' FROM years WHERE level_id = ? AND id > ? AND deleted_at IS NULL ORDER BY id LIMIT 1`,
+	},
+	"subject": {
+		`SELECT id, name, name_ar, icon FROM subjects WHERE year_id = ? AND id < ? AND deleted_at IS NULL ORDER BY id DESC LIMIT 1`,
+		`SELECT id, name, name_ar, icon FROM subjects WHERE year_id = ? AND id > ? AND deleted_at IS NULL ORDER BY id LIMIT 1`,
+	},
+}
+
+func loadContext(entity string, id any) (*NodeContext, error) {
+	crumbs := []Crumb{{Type: "level"}, {Type: "year"}, {Type: "subject"}, {Type: "document"}}
+	dest := []any{
+		&crumbs[0].ID, &crumbs[0].Name, &crumbs[0].NameAr,
+		&crumbs[1].ID, &crumbs[1].Name, &crumbs[1].NameAr,
+		&crumbs[2].ID, &crumbs[2].Name, &crumbs[2].NameAr, &crumbs[2].Icon,
+		&crumbs[3].ID, &crumbs[3].Name, &crumbs[3].NameAr,
+	}
+	// The columns of the first depth crumbs; subjects also have an icon.
+	depth := contextAncestry[entity].depth
+	columns := []int{0, 3, 6, 10, 13}[depth]
+	if err := db.QueryRow(contextAncestry[entity].query, id).Scan(dest[:columns]...); err != nil {
+		return nil, err
+	}
+
+	ctx := &NodeContext{Breadcrumb: crumbs[:depth]}
+	// Neighbours of the deepest year or subject, the parent's id first.
+	sibling, parent, node := "year", crumbs[0].ID, crumbs[1].ID
+	if depth > 2 {
+		sibling, parent, node = "subject", crumbs[1].ID, crumbs[2].ID
+	}
+	for _, side := range []struct {
+		query string
+		dest  **Crumb
+	}{
+		{contextSiblings[sibling].previous, &ctx.Previous},
+		{contextSiblings[sibling].next, &ctx.Next},
+	} {
+		crumb := &Crumb{Type: sibling}
+		err := db.QueryRow(side.query, parent, node).Scan(&crumb.ID, &crumb.Name, &crumb.NameAr, &crumb.Icon)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		*side.dest = crumb
+	}
+	return ctx, nil
+}
+
+// listParents are the id parameters naming the parent of a list.
+var listParents = map[string]struct {
+	table    string
+	notFound string
+}{
+	"level_id":    {"levels", "Level not found"},
+	"year_id":     {"years", "Year not found"},
+	"subject_id":  {"subjects", "Subject not found"},
+	"category_id": {"categories", "Category not found"},
+}
+
+// requireParents answers 404 when one of params names no live row, so that
+// lists tell an unknown parent from an empty one.
+func requireParents(c *gin.Context, params ...string) bool {
+	for _, param := range params {
+		value := c.Query(param)
+		if value == "" {
+			continue
+		}
+		parent := listParents[param]
+		var exists bool
+		err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM "+parent.table+" WHERE id = ? AND deleted_at IS NULL)", value).Scan(&exists)
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return false
+		}
+		if !exists {
+			c.JSON(404, gin.H{"error": parent.notFound})
+			return false
+		}
+	}
+	return true
+}
+
+func respondContext(c *gin.Context, entity string) {
+	ctx, err := loadContext(entity, c.Param("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(404, gin.H{"error": contextAncestry[entity].notFound})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, ctx)
+}
+
+func GetYearContext(c *gin.Context) {
+	respondContext(c, "years")
+}
+
+func GetSubjectContext(c *gin.Context) {
+	respondContext(c, "subjects")
+}
+
+func GetDocumentContext(c *gin.Context) {
+	respondContext(c, "documents")
+}
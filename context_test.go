@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestNodeContext(t *testing.T) {
+	openTestDB(t)
+	seedTestData(t)
+	useTestStorage(t)
+	docID, _ := addTestDocument(t, "cours", "%PDF-1.4 cours")
+	scanPendingFiles()
+	if err := trashNode("subjects", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	crumbIDs := func(ctx NodeContext) string {
+		ids := ""
+		for _, c := range ctx.Breadcrumb {
+			ids += fmt.Sprintf("%s:%d ", c.Type, c.ID)
+		}
+		return ids
+	}
+	sibling := func(c *Crumb) string {
+		if c == nil {
+			return "none"
+		}
+		return fmt.Sprintf("%s:%d", c.Type, c.ID)
+	}
+
+	tests := []struct {
+		target         string
+		breadcrumb     string
+		previous, next string
+	}{
+		{"/api/years/1/context", "level:1 year:1 ", "none", "year:2"},
+		{"/api/years/5/context", "level:1 year:5 ", "year:4", "none"},
+		// Subject 2 is in the trash, so subjects 1 and 3 are neighbours.
+		{"/api/subjects/1/context", "level:1 year:1 subject:1 ", "none", "subject:3"},
+		{"/api/subjects/3/context", "level:1 year:1 subject:3 ", "subject:1", "subject:4"},
+		{fmt.Sprintf("/api/documents/%d/context", docID), fmt.Sprintf("level:1 year:1 subject:1 document:%d ", docID), "none", "subject:3"},
+	}
+	for _, tt := range tests {
+		var ctx NodeContext
+		if code := call(t, "GET", tt.target, "", nil, &ctx); code != 200 {
+			t.Errorf("%s: %d", tt.target, code)
+			continue
+		}
+		if got := crumbIDs(ctx); got != tt.breadcrumb {
+			t.Errorf("%s: breadcrumb %q, want %q", tt.target, got, tt.breadcrumb)
+		}
+		if sibling(ctx.Previous) != tt.previous || sibling(ctx.Next) != tt.next {
+			t.Errorf("%s: between %s and %s, want %s and %s", tt.target, sibling(ctx.Previous), sibling(ctx.Next), tt.previous, tt.next)
+		}
+	}
+
+	var ctx NodeContext
+	call(t, "GET", fmt.Sprintf("/api/documents/%d/context", docID), "", nil, &ctx)
+	if d := ctx.Breadcrumb[3]; d.Name != "cours" || ctx.Breadcrumb[2].NameAr != "الرياضيات" {
+		t.Errorf("document crumbs %+v", ctx.Breadcrumb)
+	}
+}
+
+func TestContextNotFound(t *testing.T) {
+	openTestDB(t)
+	seedTestData(t)
+	useTestStorage(t)
+	docID, _ := addTestDocument(t, "cours", "%PDF-1.4 cours")
+	scanPendingFiles()
+	pending, _ := addTestDocument(t, "en attente", "%PDF-1.4 en attente")
+	if err := trashNode("years", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := trashNode("categories", 5); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		target string
+		status int
+	}{
+		{"/api/years/99/context", 404},
+		{"/api/years/2/context", 404},
+		// Subject 17 is in trashed year 2.
+		{"/api/subjects/17/context", 404},
+		{fmt.Sprintf("/api/documents/%d/context", pending), 404},
+		{fmt.Sprintf("/api/documents/%d/context", docID), 200},
+
+		// Lists tell an unknown or trashed parent from an empty one.
+		{"/api/years?level_id=4", 200},
+		{"/api/years?level_id=99", 404},
+		{"/api/subjects?year_id=2", 404},
+		{"/api/subjects?year_id=3", 200},
+		{"/api/documents?subject_id=17", 404},
+		{"/api/documents?category_id=5", 404},
+		{"/api/documents?category_id=4", 200},
+	}
+	for _, tt := range tests {
+		if code := call(t, "GET", tt.target, "", nil, nil); code != tt.status {
+			t.Errorf("%s: %d, want %d", tt.target, code, tt.status)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// openTestDB points db at a fresh, fully migrated database in a temporary
+// directory, with an empty read cache, for the duration of the test.
+func openTestDB(t *testing.T) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "test.db")
+	testDB, err := sql.Open("sqlite", "file:"+file+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, savedReads := db, reads
+	db, reads = testDB, newReadCache(defaultReadCacheEntries)
+	t.Cleanup(func() {
+		testDB.Close()
+		db, reads = saved, savedReads
+	})
+	if err := migrateUp(0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// setClock fixes timeNow at now for the duration of the test.
+func setClock(t *testing.T, now time.Time) {
+	t.Helper()
+	saved := timeNow
+	timeNow = func() time.Time { return now }
+	t.Cleanup(func() { timeNow = saved })
+}
+
+// seedTestData fills the test database with the default levels, years,
+// subjects and categories.
+func seedTestData(t *testing.T) {
+	t.Helper()
+	if err := insertDefaultData(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// useTestStorage points store at a temporary directory for the duration of
+// the test and returns the directory.
+func useTestStorage(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	saved := store
+	store = &localStorage{root: dir}
+	t.Cleanup(func() { store = saved })
+	return dir
+}
+
+// addTestDocument stores content as a new document of subject 1 in
+// category 1 and returns its id and blob key.
+func addTestDocument(t *testing.T, title, content string) (int64, string) {
+	t.Helper()
+	sum := sha256.Sum256([]byte(content))
+	file := storedFile{
+		Name:     title + ".pdf",
+		Size:     int64(len(content)),
+		Checksum: hex.EncodeToString(sum[:]),
+		MimeType: "application/pdf",
+	}
+	file.Path = blobKey(file.Checksum)
+	if err := store.Put(file.Path, strings.NewReader(content), file.Size); err != nil {
+		t.Fatal(err)
+	}
+	id, err := createDocument(1, 1, title, file, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id, file.Path
+}
+
+// addTestAdmin creates an admin holding role, scoped to the given ids, and
+// returns the admin id and a session token.
+func addTestAdmin(t *testing.T, username, role string, levelID, yearID, subjectID *int) (int, string) {
+	t.Helper()
+	id, err := createAdmin(username, "password-"+username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if role != "" {
+		if _, err := grantRole(id, role, levelID, yearID, subjectID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return id, addTestSession(t, id)
+}
+
+// addTestSession opens a new session for the admin and returns its token.
+func addTestSession(t *testing.T, adminID int) string {
+	t.Helper()
+	token, err := newSessionToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO admin_sessions (token_hash, admin_id, expires_at) VALUES (?, ?, ?)",
+		hashToken(token), adminID, timeNow().Add(sessionTTL).Unix()); err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// testRequest builds a request carrying the session token, if any. A body
+// that is not an io.Reader is sent as JSON.
+func testRequest(method, target, token string, body any) *http.Request {
+	var reader io.Reader
+	switch b := body.(type) {
+	case nil:
+	case io.Reader:
+		reader = b
+	default:
+		data, _ := json.Marshal(b)
+		reader = bytes.NewReader(data)
+	}
+	req := httptest.NewRequest(method, target, reader)
+	if _, ok := body.(io.Reader); !ok && body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req
+}
+
+// serve runs req through the application's router.
+func serve(req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	newRouter().ServeHTTP(w, req)
+	return w
+}
+
+// call sends a request through the router and decodes its JSON answer into
+// out, when given.
+func call(t *testing.T, method, target, token string, body, out any) int {
+	t.Helper()
+	w := serve(testRequest(method, target, token, body))
+	if out != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: %d %s: %v", method, target, w.Code, w.Body, err)
+		}
+	}
+	return w.Code
+}
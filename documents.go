@@ -0,0 +1,274 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========== DOCUMENT FILES ==========
+
+// storedFile describes an uploaded file once it is in storage.
+type storedFile struct {
+	Name     string
+	Path     string
+	Size     int64
+	Checksum string
+	MimeType string
+}
+
+// Uploaded files are content-addressed: each distinct content is stored once,
+// as blobs/<first two hex digits>/<sha256>, however many documents or
+// versions use it. Files uploaded before that live under uploads/.
+const blobDir = "blobs"
+
+func blobKey(checksum string) string {
+	return path.Join(blobDir, checksum[:2], checksum)
+}
+
+// blobRefs keeps removeFiles from deleting a blob that an upload has found or
+// written but not yet referenced: uploads hold it for reading until their row
+// is committed, removeFiles for writing while it checks and deletes a file.
+var blobRefs sync.RWMutex
+
+// storeUploadedFile writes the blob of an inspected upload unless the same
+// content is already stored, reporting whether it wrote it. A blob of the
+// wrong size is written again.
+func storeUploadedFile(file incomingFile, stored storedFile) (bool, error) {
+	if info, err := store.Stat(stored.Path); err == nil && info.Size == stored.Size {
+		return false, nil
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+
+	src, err := file.Open()
+	if err != nil {
+		return false, err
+	}
+	defer src.Close()
+	if err := store.Put(stored.Path, src, file.Size); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// recordUploadedFile stores the blob of an inspected upload and runs record to
+// insert the row referencing it, holding blobRefs in between. If either
+// fails, a blob this upload wrote is removed again.
+func recordUploadedFile(file incomingFile, stored storedFile, record func() error) error {
+	blobRefs.RLock()
+	wrote, err := storeUploadedFile(file, stored)
+	if err == nil {
+		err = record()
+	}
+	blobRefs.RUnlock()
+
+	if err != nil && wrote {
+		removeFiles([]string{stored.Path})
+	}
+	return err
+}
+
+// ========== DUPLICATE UPLOADS ==========
+
+// duplicatePolicy is what UploadDocument does when the uploaded content is
+// already the current file of a live document, from DUPLICATE_UPLOADS:
+// "warn" (default) uploads it and reports the existing document, "refuse"
+// answers 409 and "allow" says nothing.
+func duplicatePolicy() string {
+	switch policy := os.Getenv("DUPLICATE_UPLOADS"); policy {
+	case "refuse", "allow":
+		return policy
+	default:
+		return "warn"
+	}
+}
+
+type DuplicateDocument struct {
+	ID          int    `json:"id"`
+	Title       string `json:"title"`
+	SubjectID   int    `json:"subject_id"`
+	SubjectName string `json:"subject_name"`
+}
+
+func findDuplicate(checksum string) (*DuplicateDocument, error) {
+	var dup DuplicateDocument
+	err := db.QueryRow(`SELECT d.id, d.title, d.subject_id, s.name_ar
+                        FROM documents d
+                        JOIN subjects s ON d.subject_id = s.id
+                        WHERE d.content_hash = ? AND d.deleted_at IS NULL
+                        ORDER BY d.id LIMIT 1`, checksum).
+		Scan(&dup.ID, &dup.Title, &dup.SubjectID, &dup.SubjectName)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &dup, nil
+}
+
+// ========== PUBLISHING ==========
+
+type publishedDocument struct {
+	ID        int64
+	Checksum  string
+	Duplicate *DuplicateDocument
+}
+
+// publishDocument validates, stores and records an upload as a new document,
+// then queues it for scanning. Every way of uploading goes through it;
+// rejections are *uploadRejection errors for respondUploadError. Without a
+// title the document is named after its file.
+func publishDocument(subjectID, categoryID any, title string, file incomingFile, adminID int) (publishedDocument, error) {
+	var published publishedDocument
+	if strings.TrimSpace(title) == "" {
+		title = titleFromFileName(file.Name)
+	}
+
+	limit, err := uploadLimit(categoryID)
+	if err != nil {
+		return published, err
+	}
+	stored, err := inspectUpload(file, limit)
+	if err != nil {
+		return published, err
+	}
+	published.Checksum = stored.Checksum
+
+	if policy := duplicatePolicy(); policy != "allow" {
+		if published.Duplicate, err = findDuplicate(stored.Checksum); err != nil {
+			return published, err
+		}
+		if published.Duplicate != nil && policy == "refuse" {
+			return published, &uploadRejection{409, "This file has already been uploaded", gin.H{"duplicate": published.Duplicate}}
+		}
+	}
+
+	err = recordUploadedFile(file, stored, func() (err error) {
+		published.ID, err = createDocument(subjectID, categoryID, title, stored, adminID)
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, errTrashedParent) {
+			return published, &uploadRejection{404, "Subject or category not found", nil}
+		}
+		if isForeignKeyError(err) {
+			return published, &uploadRejection{400, "Unknown subject or category", nil}
+		}
+		return published, err
+	}
+
+	requestScan()
+	return published, nil
+}
+
+// ========== DOCUMENT EDIT HANDLERS ==========
+
+func UpdateDocument(c *gin.Context) {
+	id := c.Param("id")
+	var doc Document
+	if err := c.BindJSON(&doc); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if doc.Title == "" {
+		c.JSON(400, gin.H{"error": "Title is required"})
+		return
+	}
+
+	// Moving a document needs upload rights on both the old and the new subject.
+	if !authorize(c, RoleUploader, documentScope, id) || !authorize(c, RoleUploader, subjectScope, doc.SubjectID) {
+		return
+	}
+
+	var category int
+	err := db.QueryRow("SELECT id FROM categories WHERE id = ? AND deleted_at IS NULL", doc.CategoryID).Scan(&category)
+	if err == sql.ErrNoRows {
+		c.JSON(400, gin.H{"error": "Unknown category"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	// The lists of the subject it leaves change too.
+	var oldSubject int
+	if err := db.QueryRow("SELECT subject_id FROM documents WHERE id = ?", id).Scan(&oldSubject); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	result, err := db.Exec(`UPDATE documents SET title = ?, subject_id = ?, category_id = ?, updated_at = ?
+                            WHERE id = ? AND deleted_at IS NULL`,
+		doc.Title, doc.SubjectID, doc.CategoryID, currentTimestamp(), id)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(404, gin.H{"error": "Document not found"})
+		return
+	}
+	logIndexError(reindexDocument(db, id))
+	invalidateSubjectDocuments(oldSubject, doc.SubjectID)
+
+	c.JSON(200, gin.H{"message": "Document updated successfully"})
+}
+
+// ReplaceDocumentFile uploads a new version of a document while keeping its
+// id, download count and earlier versions.
+func ReplaceDocumentFile(c *gin.Context) {
+	id := c.Param("id")
+	if !authorize(c, RoleUploader, documentScope, id) {
+		return
+	}
+
+	file, ok := formFile(c)
+	if !ok {
+		return
+	}
+
+	var categoryID int
+	if err := db.QueryRow("SELECT category_id FROM documents WHERE id = ?", id).Scan(&categoryID); err != nil {
+		c.JSON(404, gin.H{"error": "Document not found"})
+		return
+	}
+	limit, err := uploadLimit(categoryID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	docID, _ := strconv.ParseInt(id, 10, 64)
+	upload := multipartUpload(file)
+	stored, err := inspectUpload(upload, limit)
+	if err != nil {
+		respondUploadError(c, err)
+		return
+	}
+
+	var version int
+	err = recordUploadedFile(upload, stored, func() (err error) {
+		version, err = addVersion(docID, stored, c.PostForm("note"), currentAdmin(c).ID)
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, errNotFound) {
+			c.JSON(404, gin.H{"error": "Document not found"})
+			return
+		}
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	requestScan()
+	c.JSON(200, gin.H{"message": "File replaced successfully", "checksum": stored.Checksum, "version": version})
+}
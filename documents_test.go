@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpdateDocument(t *testing.T) {
+	openTestDB(t)
+	seedTestData(t)
+	useTestStorage(t)
+	_, token := addTestAdmin(t, "uploader", RoleUploader, nil, nil, intPtr(1))
+	docID, _ := addTestDocument(t, "cours", testPDF)
+	target := fmt.Sprintf("/api/admin/documents/%d", docID)
+	setClock(t, time.Date(2024, 9, 30, 10, 0, 0, 0, time.UTC))
+
+	tests := []struct {
+		name   string
+		body   map[string]any
+		status int
+	}{
+		{"empty title", map[string]any{"title": "", "subject_id": 1, "category_id": 1}, 400},
+		{"unknown category", map[string]any{"title": "Cours", "subject_id": 1, "category_id": 99}, 400},
+		{"move out of scope", map[string]any{"title": "Cours", "subject_id": 17, "category_id": 1}, 403},
+		{"rename and recategorise", map[string]any{"title": "Cours 1", "subject_id": 1, "category_id": 2}, 200},
+	}
+	for _, tt := range tests {
+		if code := call(t, "PUT", target, token, tt.body, nil); code != tt.status {
+			t.Errorf("%s: %d, want %d", tt.name, code, tt.status)
+		}
+	}
+	var title string
+	var subject, category int
+	db.QueryRow("SELECT title, subject_id, category_id FROM documents WHERE id = ?", docID).Scan(&title, &subject, &category)
+	if title != "Cours 1" || subject != 1 || category != 2 {
+		t.Errorf("document is %q in subject %d, category %d", title, subject, category)
+	}
+	if n := count(t, "SELECT COUNT(*) FROM documents WHERE id = ? AND updated_at = '2024-09-30 10:00:00'", docID); n != 1 {
+		t.Error("updated_at is not the time of the edit")
+	}
+
+	if code := call(t, "PUT", "/api/admin/documents/9999", token, tests[3].body, nil); code != 404 {
+		t.Errorf("unknown document: %d, want 404", code)
+	}
+	if err := trashNode("documents", docID); err != nil {
+		t.Fatal(err)
+	}
+	if code := call(t, "PUT", target, token, tests[3].body, nil); code != 404 {
+		t.Errorf("trashed document: %d, want 404", code)
+	}
+}
+
+func TestReplaceDocumentFile(t *testing.T) {
+	openTestDB(t)
+	seedTestData(t)
+	useTestStorage(t)
+	_, token := addTestAdmin(t, "uploader", RoleUploader, nil, nil, intPtr(1))
+	docID, oldKey := addTestDocument(t, "cours", testPDF)
+	scanPendingFiles()
+	db.Exec("UPDATE documents SET downloads = 7 WHERE id = ?", docID)
+	target := fmt.Sprintf("/api/admin/documents/%d/file", docID)
+
+	replacement := testPDF + "% corrigé\n"
+	replace := func(name, content string) *httptest.ResponseRecorder {
+		req := multipartRequest(t, target, token, map[string]string{"note": "corrigé"}, testFile{"file", name, content})
+		req.Method = "PUT"
+		return serve(req)
+	}
+	w := replace("cours-v2.pdf", replacement)
+	if w.Code != 200 {
+		t.Fatalf("replace: %d %s", w.Code, w.Body)
+	}
+
+	var path, name, status string
+	var downloads, version int
+	db.QueryRow("SELECT file_path, file_name, scan_status, downloads, current_version FROM documents WHERE id = ?", docID).
+		Scan(&path, &name, &status, &downloads, &version)
+	if path == oldKey || name != "cours-v2.pdf" || downloads != 7 || version != 2 {
+		t.Errorf("after replace: %s %s, %d downloads, version %d", path, name, downloads, version)
+	}
+	// The new file waits for its scan before students can download it.
+	if status != scanPending {
+		t.Errorf("scan status = %s, want pending", status)
+	}
+	if code := call(t, "GET", fmt.Sprintf("/api/download/%d", docID), "", nil, nil); code != 404 {
+		t.Errorf("download before the scan: %d, want 404", code)
+	}
+	scanPendingFiles()
+	if w := serve(testRequest("GET", fmt.Sprintf("/api/download/%d", docID), "", nil)); w.Code != 200 || w.Body.String() != replacement {
+		t.Errorf("download after the scan: %d", w.Code)
+	}
+
+	w = replace("script.pdf", "<script></script>")
+	if w.Code != 415 {
+		t.Errorf("replace with a disguised file: %d, want 415", w.Code)
+	}
+	if count(t, "SELECT COUNT(*) FROM document_versions WHERE document_id = ?", docID) != 2 {
+		t.Error("a rejected replacement added a version")
+	}
+
+	if err := trashNode("documents", docID); err != nil {
+		t.Fatal(err)
+	}
+	w = replace("cours-v3.pdf", testPDF+"% v3\n")
+	if w.Code != 404 {
+		t.Errorf("replace of a trashed document: %d %s, want 404", w.Code, w.Body)
+	}
+	if count(t, "SELECT COUNT(*) FROM document_versions WHERE document_id = ?", docID) != 2 {
+		t.Error("a trashed document got a version")
+	}
+}
+
+func TestDuplicateUploads(t *testing.T) {
+	openTestDB(t)
+	seedTestData(t)
+	dir := useTestStorage(t)
+	_, token := addTestAdmin(t, "root", RoleSuperAdmin, nil, nil, nil)
+
+	type uploadResponse struct {
+		DocumentID int64              `json:"document_id"`
+		Checksum   string             `json:"checksum"`
+		Duplicate  *DuplicateDocument `json:"duplicate"`
+	}
+	upload := func(title string) (int, uploadResponse) {
+		var resp uploadResponse
+		w := serve(multipartRequest(t, "/api/admin/upload", token,
+			map[string]string{"subject_id": "1", "category_id": "1", "title": title},
+			testFile{"file", title + ".pdf", testPDF}))
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+
+	code, first := upload("original")
+	if code != 200 || first.Duplicate != nil {
+		t.Fatalf("first upload: %d, duplicate %v", code, first.Duplicate)
+	}
+	sum := sha256.Sum256([]byte(testPDF))
+	if first.Checksum != hex.EncodeToString(sum[:]) {
+		t.Errorf("checksum = %s", first.Checksum)
+	}
+
+	// Warn, the default: stored once, reported.
+	code, second := upload("copie")
+	if code != 200 || second.Duplicate == nil || second.Duplicate.ID != int(first.DocumentID) {
+		t.Errorf("second upload: %d, duplicate %+v, want document %d", code, second.Duplicate, first.DocumentID)
+	}
+	blobs := 0
+	filepath.WalkDir(filepath.Join(dir, blobDir), func(_ string, d fs.DirEntry, _ error) error {
+		if d != nil && !d.IsDir() {
+			blobs++
+		}
+		return nil
+	})
+	if blobs != 1 {
+		t.Errorf("%d blobs stored for the same content, want 1", blobs)
+	}
+
+	t.Setenv("DUPLICATE_UPLOADS", "refuse")
+	if code, _ := upload("troisieme"); code != 409 {
+		t.Errorf("refused duplicate: %d, want 409", code)
+	}
+	t.Setenv("DUPLICATE_UPLOADS", "allow")
+	if code, resp := upload("quatrieme"); code != 200 || resp.Duplicate != nil {
+		t.Errorf("allowed duplicate: %d, duplicate %v", code, resp.Duplicate)
+	}
+
+	// Trashed documents are not duplicates.
+	t.Setenv("DUPLICATE_UPLOADS", "refuse")
+	db.Exec("UPDATE documents SET deleted_at = CURRENT_TIMESTAMP")
+	if code, _ := upload("cinquieme"); code != 200 {
+		t.Errorf("upload of a trashed document's content: %d, want 200", code)
+	}
+}
+
+func TestPartialBlobs(t *testing.T) {
+	openTestDB(t)
+	seedTestData(t)
+	dir := useTestStorage(t)
+	_, token := addTestAdmin(t, "root", RoleSuperAdmin, nil, nil, nil)
+	sum := sha256.Sum256([]byte(testPDF))
+	key := blobKey(hex.EncodeToString(sum[:]))
+
+	// A short write leaves neither the key nor a temporary file behind.
+	if err := store.Put(key, strings.NewReader(testPDF[:10]), int64(len(testPDF))); err == nil {
+		t.Error("short write succeeded")
+	}
+	entries, _ := os.ReadDir(filepath.Dir(filepath.Join(dir, key)))
+	if len(entries) != 0 {
+		t.Errorf("%d files left by a short write", len(entries))
+	}
+
+	// A truncated blob already at the key is written again, not reused.
+	os.WriteFile(filepath.Join(dir, key), []byte(testPDF[:10]), 0644)
+	w := serve(multipartRequest(t, "/api/admin/upload", token,
+		map[string]string{"subject_id": "1", "category_id": "1", "title": "Cours"},
+		testFile{"file", "cours.pdf", testPDF}))
+	if w.Code != 200 {
+		t.Fatalf("upload: %d %s", w.Code, w.Body)
+	}
+	if stored, _ := os.ReadFile(filepath.Join(dir, key)); string(stored) != testPDF {
+		t.Errorf("blob holds %d bytes, want %d", len(stored), len(testPDF))
+	}
+}
+
+func TestFailedUploadRemovesOnlyItsBlob(t *testing.T) {
+	openTestDB(t)
+	seedTestData(t)
+	useTestStorage(t)
+	publish := func(content string) error {
+		file := incomingFile{
+			Name: "cours.pdf",
+			Size: int64(len(content)),
+			Open: func() (io.ReadCloser, error) { return io.NopCloser(strings.NewReader(content)), nil },
+		}
+		_, err := publishDocument(9999, 1, "Cours", file, 0)
+		return err
+	}
+
+	// The blob of another upload that has not recorded it yet.
+	sum := sha256.Sum256([]byte(testPDF))
+	shared := blobKey(hex.EncodeToString(sum[:]))
+	if err := store.Put(shared, strings.NewReader(testPDF), int64(len(testPDF))); err != nil {
+		t.Fatal(err)
+	}
+	if err := publish(testPDF); err == nil {
+		t.Fatal("publishing to an unknown subject succeeded")
+	}
+	if _, err := store.Stat(shared); err != nil {
+		t.Errorf("failed upload removed a blob it did not write: %v", err)
+	}
+
+	own := testPDF + "% autre\n"
+	sum = sha256.Sum256([]byte(own))
+	if err := publish(own); err == nil {
+		t.Fatal("publishing to an unknown subject succeeded")
+	}
+	if _, err := store.Stat(blobKey(hex.EncodeToString(sum[:]))); err == nil {
+		t.Error("failed upload left its blob behind")
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========== INTEGRITY CHECK ==========
+//
+// fsck compares the database with storage and reports:
+//
+//   - documents and versions whose file is missing
+//   - recorded file sizes that differ from the stored file
+//   - stored files that no row references
+//   - documents, subjects and years whose parent row no longer exists
+//
+// It runs as `fsck [-repair]` or through GET /api/admin/fsck and
+// POST /api/admin/fsck/repair. Repairing moves live documents whose current
+// file is missing or corrupt to the trash, corrects the sizes of legacy
+// files, deletes unreferenced files older than fsckOrphanGrace and purges
+// orphaned rows with their descendants.
+
+// fsckOrphanGrace spares files that an upload in progress has stored but not
+// yet recorded.
+const fsckOrphanGrace = time.Hour
+
+// fsckPrefixes are the parts of storage holding document files.
+var fsckPrefixes = []string{"blobs/", "uploads/", trashDir + "/", quarantineDir + "/"}
+
+type fsckFile struct {
+	DocumentID   int    `json:"document_id"`
+	Version      int    `json:"version"`
+	FilePath     string `json:"file_path"`
+	Current      bool   `json:"current"`
+	RecordedSize int64  `json:"recorded_size"`
+	ActualSize   int64  `json:"actual_size,omitempty"`
+	live         bool
+}
+
+type fsckOrphanFile struct {
+	Key     string    `json:"key"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+type fsckOrphanRow struct {
+	Table   string `json:"table"`
+	ID      int    `json:"id"`
+	Missing string `json:"missing"`
+}
+
+type fsckReport struct {
+	MissingFiles   []fsckFile       `json:"missing_files"`
+	SizeMismatches []fsckFile       `json:"size_mismatches"`
+	OrphanFiles    []fsckOrphanFile `json:"orphan_files"`
+	OrphanRows     []fsckOrphanRow  `json:"orphan_rows"`
+	Repairs        []string         `json:"repairs"`
+}
+
+func (r *fsckReport) problems() int {
+	return len(r.MissingFiles) + len(r.SizeMismatches) + len(r.OrphanFiles) + len(r.OrphanRows)
+}
+
+// fsckFileRows lists the file of every document, then those of its older
+// versions.
+const fsckFileRows = `SELECT id, current_version, file_path, file_size, 1, deleted_at IS NULL FROM documents
+                      UNION ALL
+                      SELECT v.document_id, v.version, v.file_path, v.file_size, 0, d.deleted_at IS NULL
+                      FROM document_versions v JOIN documents d ON d.id = v.document_id
+                      WHERE v.version != d.current_version
+                      ORDER BY 1, 2`
+
+const fsckOrphanRows = `SELECT 'documents', d.id, 'subjects' FROM documents d
+                            WHERE NOT EXISTS (SELECT 1 FROM subjects WHERE id = d.subject_id)
+                        UNION ALL
+                        SELECT 'documents', d.id, 'categories' FROM documents d
+                            WHERE NOT EXISTS (SELECT 1 FROM categories WHERE id = d.category_id)
+                        UNION ALL
+                        SELECT 'subjects', s.id, 'years' FROM subjects s
+                            WHERE NOT EXISTS (SELECT 1 FROM years WHERE id = s.year_id)
+                        UNION ALL
+                        SELECT 'years', y.id, 'levels' FROM years y
+                            WHERE NOT EXISTS (SELECT 1 FROM levels WHERE id = y.level_id)`
+
+func checkIntegrity() (*fsckReport, error) {
+	report := &fsckReport{
+		MissingFiles:   []fsckFile{},
+		SizeMismatches: []fsckFile{},
+		OrphanFiles:    []fsckOrphanFile{},
+		OrphanRows:     []fsckOrphanRow{},
+		Repairs:        []string{},
+	}
+
+	rows, err := db.Query(fsckFileRows)
+	if err != nil {
+		return nil, err
+	}
+	var files []fsckFile
+	for rows.Next() {
+		var f fsckFile
+		if err := rows.Scan(&f.DocumentID, &f.Version, &f.FilePath, &f.RecordedSize, &f.Current, &f.live); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Versions share files, so each is looked up once; a size of -1 marks a
+	// missing file.
+	stats := map[string]ObjectInfo{}
+	for _, f := range files {
+		key := cleanKey(f.FilePath)
+		info, ok := stats[key]
+		if !ok {
+			info, err = store.Stat(key)
+			if errors.Is(err, fs.ErrNotExist) {
+				info.Size = -1
+			} else if err != nil {
+				return nil, err
+			}
+			stats[key] = info
+		}
+		switch {
+		case info.Size < 0:
+			report.MissingFiles = append(report.MissingFiles, f)
+		case info.Size != f.RecordedSize:
+			f.ActualSize = info.Size
+			report.SizeMismatches = append(report.SizeMismatches, f)
+		}
+	}
+
+	for _, prefix := range fsckPrefixes {
+		err := store.List(prefix, func(key string, info ObjectInfo) error {
+			if _, ok := stats[key]; !ok {
+				report.OrphanFiles = append(report.OrphanFiles, fsckOrphanFile{Key: key, Size: info.Size, ModTime: info.ModTime})
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err = db.Query(fsckOrphanRows)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var o fsckOrphanRow
+		if err := rows.Scan(&o.Table, &o.ID, &o.Missing); err != nil {
+			return nil, err
+		}
+		report.OrphanRows = append(report.OrphanRows, o)
+	}
+	return report, rows.Err()
+}
+
+// isLegacyKey reports whether key is an "uploads/" or "trash/" file, stored
+// under its upload name rather than its checksum.
+func isLegacyKey(key string) bool {
+	key = cleanKey(key)
+	return strings.HasPrefix(key, "uploads/") || strings.HasPrefix(key, trashDir+"/")
+}
+
+// repairIntegrity fixes what checkIntegrity found, recording each repair in
+// the report. It goes on after a failed repair and returns the first error.
+func repairIntegrity(report *fsckReport) error {
+	var firstErr error
+	done := func(err error, format string, args ...any) {
+		msg := fmt.Sprintf(format, args...)
+		if err != nil {
+			msg += ": " + err.Error()
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		report.Repairs = append(report.Repairs, msg)
+	}
+
+	// Orphaned rows first: purging them also removes their files.
+	purge := map[string]func(any) error{
+		"documents": deleteDocument,
+		"subjects":  deleteSubjectCascade,
+		"years":     deleteYearCascade,
+	}
+	purged := map[string]bool{}
+	for _, o := range report.OrphanRows {
+		key := fmt.Sprintf("%s/%d", o.Table, o.ID)
+		if purged[key] {
+			continue
+		}
+		purged[key] = true
+		err := purge[o.Table](o.ID)
+		if errors.Is(err, errNotFound) {
+			// Already gone with an orphaned parent.
+			continue
+		}
+		done(err, "purged orphaned %s %d", o.Table, o.ID)
+	}
+
+	trashLive := func(f fsckFile, problem string) {
+		if !f.Current || !f.live || purged[fmt.Sprintf("documents/%d", f.DocumentID)] {
+			return
+		}
+		err := trashNode("documents", f.DocumentID)
+		if errors.Is(err, errNotFound) {
+			return
+		}
+		done(err, "moved document %d to the trash, its file %s is %s", f.DocumentID, f.FilePath, problem)
+	}
+	for _, f := range report.MissingFiles {
+		trashLive(f, "missing")
+	}
+
+	// Only legacy files are rewritten in place; a blob is named by its
+	// checksum, so a blob of the wrong size is corrupt and stays reported.
+	fixed := map[string]bool{}
+	for _, f := range report.SizeMismatches {
+		if !isLegacyKey(f.FilePath) {
+			trashLive(f, "corrupt")
+			continue
+		}
+		if fixed[f.FilePath] {
+			continue
+		}
+		fixed[f.FilePath] = true
+		_, err := db.Exec("UPDATE document_versions SET file_size = ? WHERE file_path = ?", f.ActualSize, f.FilePath)
+		if err == nil {
+			_, err = db.Exec("UPDATE documents SET file_size = ? WHERE file_path = ?", f.ActualSize, f.FilePath)
+		}
+		done(err, "recorded size %d for %s", f.ActualSize, f.FilePath)
+	}
+
+	cutoff := timeNow().Add(-fsckOrphanGrace)
+	for _, o := range report.OrphanFiles {
+		if o.ModTime.After(cutoff) {
+			done(nil, "kept %s, written less than %s ago", o.Key, fsckOrphanGrace)
+			continue
+		}
+		// removeFiles keeps files that a row started using since the check.
+		removeFiles([]string{o.Key})
+		done(nil, "deleted unreferenced file %s", o.Key)
+	}
+	return firstErr
+}
+
+// ========== INTEGRITY HANDLERS ==========
+
+func GetIntegrityReport(c *gin.Context) {
+	report, err := checkIntegrity()
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, report)
+}
+
+func RepairIntegrity(c *gin.Context) {
+	report, err := checkIntegrity()
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if err := repairIntegrity(report); err != nil {
+		c.JSON(500, gin.H{"error": err.Error(), "report": report})
+		return
+	}
+	c.JSON(200, report)
+}
+
+func fsckCommand(args []string) error {
+	repair := len(args) == 1 && args[0] == "-repair"
+	if len(args) > 1 || len(args) == 1 && !repair {
+		return errors.New("usage: fsck [-repair]")
+	}
+
+	report, err := checkIntegrity()
+	if err != nil {
+		return err
+	}
+	for _, f := range report.MissingFiles {
+		fmt.Printf("missing  document %d v%d: %s\n", f.DocumentID, f.Version, f.FilePath)
+	}
+	for _, f := range report.SizeMismatches {
+		fmt.Printf("size     document %d v%d: %s is %d bytes, recorded %d\n", f.DocumentID, f.Version, f.FilePath, f.ActualSize, f.RecordedSize)
+	}
+	for _, o := range report.OrphanFiles {
+		fmt.Printf("orphan   file %s (%d bytes)\n", o.Key, o.Size)
+	}
+	for _, o := range report.OrphanRows {
+		fmt.Printf("orphan   %s %d: no %s row\n", o.Table, o.ID, o.Missing)
+	}
+	log.Printf("🔎 %d problems found", report.problems())
+	if !repair || report.problems() == 0 {
+		return nil
+	}
+
+	err = repairIntegrity(report)
+	for _, msg := range report.Repairs {
+		fmt.Println("repair  ", msg)
+	}
+	return err
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFsckFindsAndRepairs(t *testing.T) {
+	openTestDB(t)
+	seedTestData(t)
+	dir := useTestStorage(t)
+
+	_, okKey := addTestDocument(t, "cours", "%PDF-1.4 cours")
+	lostID, lostKey := addTestDocument(t, "perdu", "%PDF-1.4 perdu")
+	grownID, blob := addTestDocument(t, "resume", "%PDF-1.4 resume")
+	truncatedID, truncatedKey := addTestDocument(t, "serie", "%PDF-1.4 serie")
+	if err := store.Delete(lostKey); err != nil {
+		t.Fatal(err)
+	}
+	// A legacy file that grew has its size corrected; a truncated blob no
+	// longer matches its checksum.
+	grownKey := "uploads/resume.pdf"
+	if err := store.Put(grownKey, strings.NewReader("%PDF-1.4 resume, longer"), 23); err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range []string{"documents", "document_versions"} {
+		if _, err := db.Exec("UPDATE "+table+" SET file_path = ? WHERE file_path = ?", grownKey, blob); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Delete(blob); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(truncatedKey, strings.NewReader("%PDF-1.4"), 8); err != nil {
+		t.Fatal(err)
+	}
+	// An old orphan is deleted; a fresh one may belong to an upload in progress.
+	for key, age := range map[string]time.Duration{"blobs/ff/old": 2 * fsckOrphanGrace, "blobs/ff/fresh": 0} {
+		if err := store.Put(key, strings.NewReader("orphan"), 6); err != nil {
+			t.Fatal(err)
+		}
+		modTime := time.Now().Add(-age)
+		if err := os.Chtimes(filepath.Join(dir, filepath.FromSlash(key)), modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := checkIntegrity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.MissingFiles) != 1 || report.MissingFiles[0].FilePath != lostKey || !report.MissingFiles[0].Current {
+		t.Errorf("missing files = %+v, want the current file of document %d", report.MissingFiles, lostID)
+	}
+	if len(report.SizeMismatches) != 2 || report.SizeMismatches[0].DocumentID != int(grownID) || report.SizeMismatches[0].ActualSize != 23 ||
+		report.SizeMismatches[1].DocumentID != int(truncatedID) || report.SizeMismatches[1].ActualSize != 8 {
+		t.Errorf("size mismatches = %+v, want document %d at 23 bytes and %d at 8", report.SizeMismatches, grownID, truncatedID)
+	}
+	if len(report.OrphanFiles) != 2 {
+		t.Errorf("orphan files = %+v, want blobs/ff/old and blobs/ff/fresh", report.OrphanFiles)
+	}
+	if len(report.OrphanRows) != 0 {
+		t.Errorf("orphan rows = %+v, want none", report.OrphanRows)
+	}
+
+	if err := repairIntegrity(report); err != nil {
+		t.Fatalf("repair: %v (%v)", err, report.Repairs)
+	}
+	for _, id := range []int64{lostID, truncatedID} {
+		var trashed bool
+		if err := db.QueryRow("SELECT deleted_at IS NOT NULL FROM documents WHERE id = ?", id).Scan(&trashed); err != nil || !trashed {
+			t.Errorf("document %d with a missing or corrupt file not trashed: %v", id, err)
+		}
+	}
+	if count(t, "SELECT COUNT(*) FROM documents WHERE file_size = 8") != 0 {
+		t.Errorf("size of the truncated blob recorded")
+	}
+	var size int64
+	if err := db.QueryRow("SELECT file_size FROM documents WHERE id = ?", grownID).Scan(&size); err != nil || size != 23 {
+		t.Errorf("document %d size = %d, %v; want 23", grownID, size, err)
+	}
+	for key, kept := range map[string]bool{"blobs/ff/old": false, "blobs/ff/fresh": true, okKey: true} {
+		if _, err := store.Stat(key); (err == nil) != kept {
+			t.Errorf("%s kept = %v, want %v", key, err == nil, kept)
+		}
+	}
+
+	// The fresh orphan and the trashed documents' missing and corrupt files
+	// remain.
+	report, err = checkIntegrity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.SizeMismatches) != 1 || report.SizeMismatches[0].DocumentID != int(truncatedID) ||
+		len(report.OrphanFiles) != 1 || report.OrphanFiles[0].Key != "blobs/ff/fresh" {
+		t.Errorf("after repair: %+v", report)
+	}
+}
+
+func TestFsckOrphanRows(t *testing.T) {
+	openTestDB(t)
+	seedTestData(t)
+	useTestStorage(t)
+	docID, key := addTestDocument(t, "cours", "%PDF-1.4 cours")
+
+	// A subject whose year disappeared behind the foreign keys' back.
+	if _, err := db.Exec("PRAGMA foreign_keys = OFF"); err != nil {
+		t.Fatal(err)
+	}
+	db.Exec("DELETE FROM years WHERE id = (SELECT year_id FROM subjects WHERE id = 1)")
+	db.Exec("PRAGMA foreign_keys = ON")
+
+	report, err := checkIntegrity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, o := range report.OrphanRows {
+		found = found || o.Table == "subjects" && o.ID == 1 && o.Missing == "years"
+	}
+	if !found {
+		t.Fatalf("orphan rows = %+v, want subject 1", report.OrphanRows)
+	}
+
+	if err := repairIntegrity(report); err != nil {
+		t.Fatalf("repair: %v (%v)", err, report.Repairs)
+	}
+	var documents int
+	db.QueryRow("SELECT COUNT(*) FROM documents WHERE id = ?", docID).Scan(&documents)
+	if documents != 0 {
+		t.Errorf("document %d of the orphaned subject not purged", docID)
+	}
+	if _, err := store.Stat(key); err == nil {
+		t.Errorf("file %s of the purged document kept", key)
+	}
+}
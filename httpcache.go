@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========== HTTP CACHING ==========
+//
+// Levels, years, subjects and categories change only through admin writes,
+// each of which bumps content_version (triggers from migration 14). The read
+// APIs over them answer with an ETag and Last-Modified taken from that row,
+// and with 304 Not Modified when the client already has the current version,
+// so browsers and CDNs can keep serving them between edits. Only successful
+// responses carry these validators.
+
+const (
+	// versionedCacheControl has clients revalidate on every use, which the
+	// ETag makes a cheap 304 until the next edit.
+	versionedCacheControl = "public, no-cache"
+	// apiCacheControl lets caches reuse an unversioned response for a
+	// minute, then serve it while revalidating for five more.
+	apiCacheControl = "public, max-age=60, stale-while-revalidate=300"
+	// pageCacheControl covers the static pages, which change only on deploy.
+	pageCacheControl = "public, max-age=300"
+)
+
+func contentVersion() (int64, time.Time, error) {
+	var version int64
+	var updatedAt time.Time
+	err := db.QueryRow("SELECT version, updated_at FROM content_version WHERE id = 1").Scan(&version, &updatedAt)
+	return version, updatedAt, err
+}
+
+// contentVersionKey holds, in the gin context, the content version Versioned
+// tagged the request with.
+const contentVersionKey = "content_version"
+
+// requestContentVersion is the content version of a request behind
+// Versioned, or 0 when there is none.
+func requestContentVersion(c *gin.Context) int64 {
+	return c.GetInt64(contentVersionKey)
+}
+
+// heldResponse keeps a handler's response back until Versioned knows whether
+// it succeeded.
+type heldResponse struct {
+	gin.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *heldResponse) WriteHeader(code int)              { w.status = code }
+func (w *heldResponse) WriteHeaderNow()                   {}
+func (w *heldResponse) Write(b []byte) (int, error)       { return w.body.Write(b) }
+func (w *heldResponse) WriteString(s string) (int, error) { return w.body.WriteString(s) }
+func (w *heldResponse) Status() int                       { return w.status }
+func (w *heldResponse) Written() bool                     { return false }
+func (w *heldResponse) Size() int                         { return w.body.Len() }
+
+// Versioned tags successful responses with the content version and answers
+// 304 when the request's validators match it. The schema version is part of
+// the ETag since an upgrade can change the responses without any write.
+//
+// The version is read before the handler runs and handed to it, and cached
+// bodies are only served at the version they were loaded at, so a write
+// landing meanwhile leaves the tag stale rather than the body.
+func Versioned() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		version, updatedAt, err := contentVersion()
+		if err != nil {
+			c.Next()
+			return
+		}
+		c.Set(contentVersionKey, version)
+		etag := fmt.Sprintf(`"%d-%d"`, latestSchemaVersion(), version)
+		updatedAt = updatedAt.UTC().Truncate(time.Second)
+
+		held := &heldResponse{ResponseWriter: c.Writer, status: http.StatusOK}
+		c.Writer = held
+		c.Next()
+		c.Writer = held.ResponseWriter
+
+		if held.status >= 200 && held.status < 300 {
+			c.Header("ETag", etag)
+			c.Header("Last-Modified", updatedAt.Format(http.TimeFormat))
+			c.Header("Cache-Control", versionedCacheControl)
+			if notModified(c.Request, etag, updatedAt) {
+				c.Writer.Header().Del("Content-Type")
+				c.Writer.WriteHeader(http.StatusNotModified)
+				c.Writer.WriteHeaderNow()
+				return
+			}
+		}
+		c.Writer.WriteHeader(held.status)
+		c.Writer.Write(held.body.Bytes())
+	}
+}
+
+// notModified evaluates If-None-Match, or If-Modified-Since when there is no
+// If-None-Match, as RFC 9110 orders them.
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		for _, tag := range strings.Split(match, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == etag || tag == "*" {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !modified.After(since)
+}
+
+// CacheFor sets Cache-Control on responses that carry no version, such as
+// the static pages, whose If-Modified-Since http.ServeFile already answers.
+// Like Versioned, it leaves errors uncached.
+func CacheFor(policy string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Writer = &policyResponse{ResponseWriter: c.Writer, policy: policy}
+		c.Next()
+	}
+}
+
+// policyResponse sets Cache-Control as the status goes out, on successful
+// and 304 responses only.
+type policyResponse struct {
+	gin.ResponseWriter
+	policy string
+}
+
+func (w *policyResponse) WriteHeader(code int) {
+	if !w.Written() && (code >= 200 && code < 300 || code == http.StatusNotModified) {
+		w.Header().Set("Cache-Control", w.policy)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *policyResponse) WriteHeaderNow() {
+	w.WriteHeader(w.Status())
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *policyResponse) Write(b []byte) (int, error) {
+	w.WriteHeaderNow()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *policyResponse) WriteString(s string) (int, error) {
+	w.WriteHeaderNow()
+	return w.ResponseWriter.WriteString(s)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCacheForSkipsErrors(t *testing.T) {
+	openTestDB(t)
+	seedTestData(t)
+
+	tests := []struct {
+		target       string
+		status       int
+		cacheControl string
+	}{
+		{"/level.html", 200, pageCacheControl},
+		{"/api/documents?subject_id=1", 200, apiCacheControl},
+		{"/api/stats", 200, apiCacheControl},
+		{"/api/documents?subject_id=9999", 404, ""},
+		{"/api/documents?limit=-1", 400, ""},
+		{"/api/documents/9999/context", 404, ""},
+	}
+	for _, tt := range tests {
+		w := serve(testRequest("GET", tt.target, "", nil))
+		if w.Code != tt.status || w.Header().Get("Cache-Control") != tt.cacheControl {
+			t.Errorf("%s: %d with Cache-Control %q, want %d with %q",
+				tt.target, w.Code, w.Header().Get("Cache-Control"), tt.status, tt.cacheControl)
+		}
+	}
+}
+
+func TestVersionedReads(t *testing.T) {
+	openTestDB(t)
+	seedTestData(t)
+	_, token := addTestAdmin(t, "root", RoleSuperAdmin, nil, nil, nil)
+
+	get := func(target, etag string) *httptest.ResponseRecorder {
+		req := testRequest("GET", target, "", nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		return serve(req)
+	}
+
+	w := get("/api/levels", "")
+	etag := w.Header().Get("ETag")
+	if w.Code != 200 || etag == "" || w.Header().Get("Cache-Control") != versionedCacheControl || w.Header().Get("Last-Modified") == "" {
+		t.Fatalf("levels: %d, ETag %q, Cache-Control %q", w.Code, etag, w.Header().Get("Cache-Control"))
+	}
+	if w := get("/api/levels", etag); w.Code != 304 || w.Body.Len() != 0 {
+		t.Errorf("matching If-None-Match: %d with %d bytes, want an empty 304", w.Code, w.Body.Len())
+	}
+	if w := get("/api/years?level_id=1", `"other", W/`+etag); w.Code != 304 {
+		t.Errorf("weak tag in a list: %d, want 304", w.Code)
+	}
+	if w := get("/api/levels", `"0-0"`); w.Code != 200 {
+		t.Errorf("stale If-None-Match: %d, want 200", w.Code)
+	}
+	if w := get("/api/years?level_id=99", etag); w.Code != 404 || w.Header().Get("ETag") != "" {
+		t.Errorf("unknown parent: %d with ETag %q, want 404 without one", w.Code, w.Header().Get("ETag"))
+	}
+
+	// A write gives a new tag and the new body.
+	if code := call(t, "POST", "/api/admin/levels", token,
+		map[string]string{"name": "Formation", "name_ar": "تكوين", "color": "#000000"}, nil); code != 201 {
+		t.Fatalf("create level: %d", code)
+	}
+	w = get("/api/levels", etag)
+	var levels []Level
+	json.Unmarshal(w.Body.Bytes(), &levels)
+	if w.Code != 200 || w.Header().Get("ETag") == etag || len(levels) != 5 {
+		t.Errorf("after a write: %d, ETag %q, %d levels", w.Code, w.Header().Get("ETag"), len(levels))
+	}
+
+	// So does a write from a CLI command, which the server's cache never hears of.
+	etag = w.Header().Get("ETag")
+	db.Exec("UPDATE levels SET name = 'Ecole' WHERE id = 1")
+	w = get("/api/levels", etag)
+	levels = nil
+	json.Unmarshal(w.Body.Bytes(), &levels)
+	if w.Code != 200 || w.Header().Get("ETag") == etag || levels[0].Name != "Ecole" {
+		t.Errorf("after a write elsewhere: %d, ETag %q, level %q", w.Code, w.Header().Get("ETag"), levels[0].Name)
+	}
+}
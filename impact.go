@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========== DELETE IMPACT PREVIEW ==========
+
+// DeleteImpact describes everything a delete would remove. ConfirmToken is
+// derived from the counts, so it stops matching as soon as the subtree changes
+// between the preview and the delete.
+type DeleteImpact struct {
+	Entity       string `json:"entity"`
+	ID           string `json:"id"`
+	Years        int    `json:"years"`
+	Subjects     int    `json:"subjects"`
+	Documents    int    `json:"documents"`
+	Bytes        int64  `json:"bytes"`
+	Downloads    int    `json:"downloads"`
+	Blocked      bool   `json:"blocked"`
+	ConfirmToken string `json:"confirm_token"`
+}
+
+type impactQuery struct {
+	table     string
+	years     string
+	subjects  string
+	documents string
+	restrict  bool
+}
+
+var impactQueries = map[string]impactQuery{
+	"level": {
+		table:     "levels",
+		years:     "level_id = ?",
+		subjects:  subjectsOfLevel,
+		documents: documentsOfLevel,
+	},
+	"year": {
+		table:     "years",
+		subjects:  "year_id = ?",
+		documents: documentsOfYear,
+	},
+	"subject": {
+		table:     "subjects",
+		documents: "subject_id = ?",
+	},
+	"category": {
+		table:     "categories",
+		documents: "category_id = ?",
+		restrict:  true,
+	},
+}
+
+func computeImpact(entity string, id string) (DeleteImpact, error) {
+	q := impactQueries[entity]
+	impact := DeleteImpact{Entity: entity, ID: id}
+
+	var exists int
+	if err := db.QueryRow("SELECT COUNT(*) FROM "+q.table+" WHERE id = ? AND deleted_at IS NULL", id).Scan(&exists); err != nil {
+		return impact, err
+	}
+	if exists == 0 {
+		return impact, errNotFound
+	}
+
+	if q.years != "" {
+		if err := db.QueryRow("SELECT COUNT(*) FROM years WHERE "+q.years+" AND deleted_at IS NULL", id).Scan(&impact.Years); err != nil {
+			return impact, err
+		}
+	}
+	if q.subjects != "" {
+		if err := db.QueryRow("SELECT COUNT(*) FROM subjects WHERE "+q.subjects+" AND deleted_at IS NULL", id).Scan(&impact.Subjects); err != nil {
+			return impact, err
+		}
+	}
+	err := db.QueryRow("SELECT COUNT(*), COALESCE(SUM(downloads), 0) FROM documents WHERE "+q.documents+" AND deleted_at IS NULL", id).
+		Scan(&impact.Documents, &impact.Downloads)
+	if err != nil {
+		return impact, err
+	}
+	// Bytes are those the delete frees once purged: the files of every stored
+	// version, each counted once, unless a document outside the node uses
+	// them too. Documents in the trash count, as a restore needs their files;
+	// those of the node itself go with it when it is purged.
+	err = db.QueryRow(`SELECT COALESCE(SUM(file_size), 0) FROM (
+                           SELECT MAX(file_size) AS file_size FROM document_versions
+                           WHERE document_id IN (SELECT id FROM documents WHERE `+q.documents+` AND deleted_at IS NULL)
+                             AND file_path NOT IN (SELECT file_path FROM document_versions
+                                                   WHERE document_id NOT IN (SELECT id FROM documents WHERE `+q.documents+`))
+                           GROUP BY file_path
+                       )`, id, id).
+		Scan(&impact.Bytes)
+	if err != nil {
+		return impact, err
+	}
+
+	impact.Blocked = q.restrict && impact.Documents > 0
+	impact.ConfirmToken = impact.token()
+	return impact, nil
+}
+
+// token deliberately leaves out downloads, which change on every student
+// download and would otherwise invalidate a preview almost immediately.
+func (i DeleteImpact) token() string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s:%s:%d:%d:%d:%d",
+		i.Entity, i.ID, i.Years, i.Subjects, i.Documents, i.Bytes)))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (i DeleteImpact) hasDependents() bool {
+	return i.Years+i.Subjects+i.Documents > 0
+}
+
+// confirmDelete lets a delete through when it removes nothing but the node
+// itself, or when the request carries the confirm token of a current preview.
+func confirmDelete(c *gin.Context, entity string, id string) bool {
+	impact, err := computeImpact(entity, id)
+	if err != nil {
+		respondDeleteError(c, err)
+		return false
+	}
+	if impact.Blocked || !impact.hasDependents() {
+		return true
+	}
+
+	token := c.Query("confirm")
+	if token == "" {
+		c.JSON(409, gin.H{"error": "This delete removes dependent records; confirm it with the token from the impact preview", "impact": impact})
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(impact.ConfirmToken)) != 1 {
+		c.JSON(409, gin.H{"error": "Confirm token does not match the current impact; review it again", "impact": impact})
+		return false
+	}
+	return true
+}
+
+func respondImpact(c *gin.Context, entity string) {
+	impact, err := computeImpact(entity, c.Param("id"))
+	if err != nil {
+		respondDeleteError(c, err)
+		return
+	}
+	c.JSON(200, impact)
+}
+
+// ========== IMPACT HANDLERS ==========
+
+func GetLevelImpact(c *gin.Context) {
+	respondImpact(c, "level")
+}
+
+func GetYearImpact(c *gin.Context) {
+	if !authorize(c, RoleLevelEditor, yearScope, c.Param("id")) {
+		return
+	}
+	respondImpact(c, "year")
+}
+
+func GetSubjectImpact(c *gin.Context) {
+	if !authorize(c, RoleLevelEditor, subjectScope, c.Param("id")) {
+		return
+	}
+	respondImpact(c, "subject")
+}
+
+func GetCategoryImpact(c *gin.Context) {
+	respondImpact(c, "category")
+}
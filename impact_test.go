@@ -0,0 +1,83 @@
+package main
+
+import "testing"
+
+func TestImpactBytesCountFreedFiles(t *testing.T) {
+	openTestDB(t)
+	seedTestData(t)
+	useTestStorage(t)
+
+	// Subject 1 holds two documents with the same content, a third one, and a
+	// fourth whose content subject 2 uses too.
+	first, _ := addTestDocument(t, "cours", "same content")
+	addTestDocument(t, "cours bis", "same content")
+	addTestDocument(t, "exercices", "other content")
+	shared, sharedKey := addTestDocument(t, "resume", "shared content")
+	var file storedFile
+	if err := db.QueryRow("SELECT file_name, file_path, file_size, content_hash, mime_type FROM documents WHERE id = ?", shared).
+		Scan(&file.Name, &file.Path, &file.Size, &file.Checksum, &file.MimeType); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := createDocument(2, 1, "resume", file, 0); err != nil {
+		t.Fatal(err)
+	}
+	// A second version of the first document adds its own file.
+	second := storedFile{Name: "cours.pdf", Path: "blobs/zz/v2", Size: 1000, Checksum: "v2", MimeType: "application/pdf"}
+	if _, err := addVersion(first, second, "", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	impact, err := computeImpact("subject", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if impact.Documents != 4 {
+		t.Errorf("Documents = %d, want 4", impact.Documents)
+	}
+	want := int64(len("same content") + len("other content") + 1000)
+	if impact.Bytes != want {
+		t.Errorf("Bytes = %d, want %d: each file once, without %s", impact.Bytes, want, sharedKey)
+	}
+
+	// Subject 2 shares its only file with subject 1, so deleting it frees nothing.
+	impact, err = computeImpact("subject", "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if impact.Documents != 1 || impact.Bytes != 0 {
+		t.Errorf("subject 2: %d documents, %d bytes, want 1 and 0", impact.Documents, impact.Bytes)
+	}
+}
+
+func TestImpactBytesKeepFilesOfTrashedDocuments(t *testing.T) {
+	openTestDB(t)
+	seedTestData(t)
+	useTestStorage(t)
+
+	// Subject 2's document shares the file and sits in the trash: restoring
+	// it later needs the file, so deleting subject 1 frees nothing.
+	addTestDocument(t, "resume", "shared content")
+	elsewhere, _ := addTestDocument(t, "resume", "shared content")
+	db.Exec("UPDATE documents SET subject_id = 2 WHERE id = ?", elsewhere)
+	if err := trashNode("documents", elsewhere); err != nil {
+		t.Fatal(err)
+	}
+	impact, err := computeImpact("subject", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if impact.Documents != 1 || impact.Bytes != 0 {
+		t.Errorf("%d documents, %d bytes, want 1 and 0", impact.Documents, impact.Bytes)
+	}
+
+	// A document of subject 1 already in the trash goes when the subject is
+	// purged, so its own file does not keep the shared one alive.
+	db.Exec("UPDATE documents SET subject_id = 1 WHERE id = ?", elsewhere)
+	impact, err = computeImpact("subject", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(len("shared content")); impact.Bytes != want {
+		t.Errorf("with the trashed copy inside the subject: %d bytes, want %d", impact.Bytes, want)
+	}
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"archive/zip"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========== ARCHIVE IMPORT ==========
+//
+// Archives organised as Level/Year/Subject/Category/file.pdf are imported in
+// one go, from a ZIP through POST /api/admin/import or from a ZIP or a local
+// directory with `import [-dry-run] [-create] <path>`. Each segment is matched
+// by name or name_ar, ignoring case, against the levels, years of that level,
+// subjects of that year and categories. A folder wrapping the whole tree, as
+// archivers often add, is skipped.
+//
+// Segments that match nothing are reported; with create they are added as new
+// nodes named after the folder, otherwise their files are left out. A dry run
+// only reports the plan. Files are published one by one like any upload, so
+// one bad file does not stop the others.
+
+const newLevelColor = "#7c3aed"
+
+// importSource is a file found in the archive, at its slash-separated path.
+type importSource struct {
+	Path string
+	File incomingFile
+}
+
+type importOptions struct {
+	DryRun  bool
+	Create  bool
+	AdminID int
+	// allowed reports whether the files of an existing subject may be
+	// imported, nil when everything is.
+	allowed func(subjectID int) error
+}
+
+// importNode is a level, year, subject or category named in the archive that
+// does not exist yet.
+type importNode struct {
+	Kind    string `json:"kind"`
+	Name    string `json:"name"`
+	Parent  string `json:"parent,omitempty"`
+	ID      int    `json:"id,omitempty"`
+	Created bool   `json:"created"`
+}
+
+type importItem struct {
+	Path       string             `json:"path"`
+	Title      string             `json:"title,omitempty"`
+	LevelID    int                `json:"level_id,omitempty"`
+	YearID     int                `json:"year_id,omitempty"`
+	SubjectID  int                `json:"subject_id,omitempty"`
+	CategoryID int                `json:"category_id,omitempty"`
+	Status     string             `json:"status"`
+	Error      string             `json:"error,omitempty"`
+	DocumentID int64              `json:"document_id,omitempty"`
+	Duplicate  *DuplicateDocument `json:"duplicate,omitempty"`
+}
+
+// importReport counts as failed the files left out, or that would be in a dry
+// run.
+type importReport struct {
+	DryRun    bool         `json:"dry_run"`
+	Imported  int          `json:"imported"`
+	Failed    int          `json:"failed"`
+	Files     []importItem `json:"files"`
+	Unmatched []importNode `json:"unmatched"`
+}
+
+// Statuses of an imported file.
+const (
+	importReady     = "ready"     // dry run: would be imported as is
+	importCreate    = "create"    // dry run: would be imported once missing nodes are created
+	importUnmatched = "unmatched" // a segment matches nothing and create is off
+	importSkipped   = "skipped"   // not at Level/Year/Subject/Category/file depth or not allowed
+	importImported  = "imported"
+	importFailed    = "failed"
+)
+
+// ========== SOURCES ==========
+
+// skipImportPath leaves out folders and files added by the OS, such as
+// __MACOSX/ and .DS_Store.
+func skipImportPath(p string) bool {
+	for _, segment := range strings.Split(p, "/") {
+		if strings.HasPrefix(segment, ".") || segment == "__MACOSX" {
+			return true
+		}
+	}
+	return false
+}
+
+func zipSources(r *zip.Reader) []importSource {
+	var sources []importSource
+	for _, f := range r.File {
+		p := strings.Trim(path.Clean("/"+f.Name), "/")
+		if f.FileInfo().IsDir() || p == "" || skipImportPath(p) {
+			continue
+		}
+		f := f
+		sources = append(sources, importSource{Path: p, File: incomingFile{
+			Name: path.Base(p),
+			Size: int64(f.UncompressedSize64),
+			Open: f.Open,
+		}})
+	}
+	return sources
+}
+
+func dirSources(root string) ([]importSource, error) {
+	var sources []importSource
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if skipImportPath(rel) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		sources = append(sources, importSource{Path: rel, File: incomingFile{
+			Name: d.Name(),
+			Size: info.Size(),
+			Open: func() (io.ReadCloser, error) { return os.Open(p) },
+		}})
+		return nil
+	})
+	return sources, err
+}
+
+// stripWrapperFolders drops a leading folder shared by every file as long as
+// some files are deeper than Level/Year/Subject/Category/file.
+func stripWrapperFolders(sources []importSource) {
+	for len(sources) > 0 {
+		first, _, _ := strings.Cut(sources[0].Path, "/")
+		tooDeep := false
+		for _, s := range sources {
+			if !strings.HasPrefix(s.Path, first+"/") {
+				return
+			}
+			tooDeep = tooDeep || strings.Count(s.Path, "/") > 4
+		}
+		if !tooDeep {
+			return
+		}
+		for i := range sources {
+			sources[i].Path = strings.TrimPrefix(sources[i].Path, first+"/")
+		}
+	}
+}
+
+// ========== MATCHING ==========
+
+// importResolver finds the nodes named by path segments, remembering missing
+// ones so each is reported and created once.
+type importResolver struct {
+	opts    importOptions
+	ids     map[string]int
+	missing []importNode
+}
+
+var importLookups = map[string]string{
+	"level":    "SELECT id FROM levels WHERE deleted_at IS NULL AND (name = ? COLLATE NOCASE OR name_ar = ?)",
+	"year":     "SELECT id FROM years WHERE deleted_at IS NULL AND (name = ? COLLATE NOCASE OR name_ar = ?) AND level_id = ?",
+	"subject":  "SELECT id FROM subjects WHERE deleted_at IS NULL AND (name = ? COLLATE NOCASE OR name_ar = ?) AND year_id = ?",
+	"category": "SELECT id FROM categories WHERE deleted_at IS NULL AND (name = ? COLLATE NOCASE OR name_ar = ?)",
+}
+
+// resolve returns the id of the kind node called name under parentID, or 0
+// when it is missing and not created.
+func (r *importResolver) resolve(kind, name string, parentID int, parent string) (int, error) {
+	// Missing parents all have id 0, so their path tells their children apart.
+	key := strings.ToLower(kind + "/" + strconv.Itoa(parentID) + "/" + parent + "/" + name)
+	if id, ok := r.ids[key]; ok {
+		return id, nil
+	}
+
+	args := []any{name, name}
+	if kind == "year" || kind == "subject" {
+		args = append(args, parentID)
+	}
+	var id int
+	err := db.QueryRow(importLookups[kind], args...).Scan(&id)
+	if err == sql.ErrNoRows {
+		node := importNode{Kind: kind, Name: name, Parent: parent}
+		if r.opts.Create && !r.opts.DryRun {
+			if id, err = createImportNode(kind, name, parentID); err != nil {
+				return 0, err
+			}
+			node.ID, node.Created = id, true
+			log.Printf("📁 Created %s %q", kind, name)
+		}
+		r.missing = append(r.missing, node)
+		err = nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	r.ids[key] = id
+	return id, nil
+}
+
+func createImportNode(kind, name string, parentID int) (int, error) {
+	var result sql.Result
+	var err error
+	switch kind {
+	case "level":
+		result, err = db.Exec("INSERT INTO levels (name, name_ar, color) VALUES (?, ?, ?)", name, name, newLevelColor)
+	case "year":
+		result, err = db.Exec("INSERT INTO years (level_id, name, name_ar) VALUES (?, ?, ?)", parentID, name, name)
+	case "subject":
+		result, err = db.Exec("INSERT INTO subjects (year_id, name, name_ar) VALUES (?, ?, ?)", parentID, name, name)
+	case "category":
+		result, err = db.Exec("INSERT INTO categories (name, name_ar) VALUES (?, ?)", name, name)
+	}
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	switch kind {
+	case "level":
+		reads.invalidate("levels", "stats")
+	case "year":
+		reads.invalidate(parentKey("years", strconv.Itoa(parentID)), "stats")
+	case "subject":
+		logIndexError(reindexSubject(db, id))
+		reads.invalidate(parentKey("subjects", strconv.Itoa(parentID)), "stats")
+	case "category":
+		logIndexError(reindexCategory(db, id))
+	}
+	return int(id), nil
+}
+
+// planItem matches the folders of a file and tells whether it can be
+// imported.
+func (r *importResolver) planItem(source importSource) (importItem, error) {
+	item := importItem{Path: source.Path, Title: titleFromFileName(source.File.Name)}
+	segments := strings.Split(source.Path, "/")
+	if len(segments) != 5 {
+		item.Status, item.Error = importSkipped, "Expected Level/Year/Subject/Category/file"
+		return item, nil
+	}
+	if ext := strings.ToLower(path.Ext(source.Path)); !allowedExtension(ext) {
+		item.Status, item.Error = importSkipped, fmt.Sprintf("Files of type %q are not allowed", ext)
+		return item, nil
+	}
+
+	var err error
+	if item.LevelID, err = r.resolve("level", segments[0], 0, ""); err != nil {
+		return item, err
+	}
+	if item.YearID, err = r.resolve("year", segments[1], item.LevelID, segments[0]); err != nil {
+		return item, err
+	}
+	if item.SubjectID, err = r.resolve("subject", segments[2], item.YearID, path.Join(segments[:2]...)); err != nil {
+		return item, err
+	}
+	if item.CategoryID, err = r.resolve("category", segments[3], 0, ""); err != nil {
+		return item, err
+	}
+
+	switch {
+	case item.SubjectID != 0 && item.CategoryID != 0:
+		item.Status = importReady
+	case r.opts.Create:
+		item.Status = importCreate
+	default:
+		item.Status, item.Error = importUnmatched, "Some folders match no existing level, year, subject or category"
+	}
+	return item, nil
+}
+
+// runImport plans the import of sources and, unless it is a dry run, publishes
+// every file that can be.
+func runImport(sources []importSource, opts importOptions) (importReport, error) {
+	report := importReport{DryRun: opts.DryRun, Files: []importItem{}}
+	stripWrapperFolders(sources)
+	r := &importResolver{opts: opts, ids: map[string]int{}}
+
+	for _, source := range sources {
+		item, err := r.planItem(source)
+		if err != nil {
+			return report, err
+		}
+		if item.Status == importReady && opts.allowed != nil {
+			if err := opts.allowed(item.SubjectID); err != nil {
+				item.Status, item.Error = importSkipped, err.Error()
+			}
+		}
+		if item.Status == importReady && !opts.DryRun {
+			published, err := publishDocument(item.SubjectID, item.CategoryID, item.Title, source.File, opts.AdminID)
+			if err != nil {
+				_, body := uploadErrorBody(err)
+				item.Status, item.Error = importFailed, fmt.Sprint(body["error"])
+				var rejected *uploadRejection
+				if !errors.As(err, &rejected) {
+					log.Printf("⚠️  Import of %s failed: %v", source.Path, err)
+				}
+			} else {
+				item.Status, item.DocumentID, item.Duplicate = importImported, published.ID, published.Duplicate
+			}
+		}
+
+		switch item.Status {
+		case importImported:
+			report.Imported++
+		case importFailed, importUnmatched, importSkipped:
+			report.Failed++
+		}
+		report.Files = append(report.Files, item)
+	}
+	report.Unmatched = r.missing
+	if report.Unmatched == nil {
+		report.Unmatched = []importNode{}
+	}
+	return report, nil
+}
+
+// ========== IMPORT HANDLER ==========
+
+// ImportArchive imports the ZIP in the "archive" field. dry_run=true only
+// returns the plan; create=true, reserved to super admins, adds missing nodes.
+func ImportArchive(c *gin.Context) {
+	dryRun, _ := strconv.ParseBool(c.Query("dry_run"))
+	create, _ := strconv.ParseBool(c.Query("create"))
+
+	grants, err := currentGrants(c)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if create && !hasRole(grants, RoleSuperAdmin, nil) {
+		c.JSON(403, gin.H{"error": "Only super admins can create levels, years, subjects and categories"})
+		return
+	}
+
+	// The archive is bounded like a bulk upload.
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, bulkUploadLimit())
+	file, err := c.FormFile("archive")
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		c.JSON(413, gin.H{"error": "Archive is too large", "max_bytes": tooLarge.Limit})
+		return
+	}
+	if err != nil {
+		c.JSON(400, gin.H{"error": "No archive uploaded"})
+		return
+	}
+	archive, err := file.Open()
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	defer archive.Close()
+	zr, err := zip.NewReader(archive, file.Size)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Archive is not a valid ZIP file"})
+		return
+	}
+
+	report, err := runImport(zipSources(zr), importOptions{
+		DryRun:  dryRun,
+		Create:  create,
+		AdminID: currentAdmin(c).ID,
+		allowed: func(subjectID int) error { return checkAccess(c, RoleUploader, subjectScope, subjectID) },
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, report)
+}
+
+// ========== IMPORT COMMAND ==========
+
+func importCommand(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only print the plan")
+	create := flags.Bool("create", false, "create missing levels, years, subjects and categories")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: import [-dry-run] [-create] <directory or .zip>")
+	}
+	root := flags.Arg(0)
+
+	var sources []importSource
+	if strings.EqualFold(filepath.Ext(root), ".zip") {
+		zr, err := zip.OpenReader(root)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		sources = zipSources(&zr.Reader)
+	} else {
+		var err error
+		if sources, err = dirSources(root); err != nil {
+			return err
+		}
+	}
+
+	report, err := runImport(sources, importOptions{DryRun: *dryRun, Create: *create})
+	if err != nil {
+		return err
+	}
+
+	for _, node := range report.Unmatched {
+		state := "unmatched"
+		if node.Created {
+			state = "created"
+		} else if *create {
+			state = "to create"
+		}
+		fmt.Printf("%-9s %-8s %s\n", state, node.Kind, path.Join(node.Parent, node.Name))
+	}
+	for _, item := range report.Files {
+		fmt.Printf("%-9s %s", item.Status, item.Path)
+		if item.Error != "" {
+			fmt.Printf(" (%s)", item.Error)
+		} else if item.Duplicate != nil {
+			fmt.Printf(" (same content as document %d)", item.Duplicate.ID)
+		}
+		fmt.Println()
+	}
+	if *dryRun {
+		log.Printf("🔎 Dry run: %d files planned, nothing imported", len(report.Files))
+	} else {
+		log.Printf("✅ Imported %d files, %d not imported", report.Imported, report.Failed)
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Paths of seeded nodes: level 1, its year 1 and subject 1, category 1.
+const (
+	importTestSubject = "Primaire/Année 1 primaire/Mathématiques"
+	importTestUnknown = "Primaire/Année 1 primaire/Robotique"
+)
+
+func TestStripWrapperFolders(t *testing.T) {
+	tests := []struct {
+		paths []string
+		want  []string
+	}{
+		{[]string{"export/2024/L/Y/S/C/a.pdf", "export/2024/L/Y/S/C/b.pdf"}, []string{"L/Y/S/C/a.pdf", "L/Y/S/C/b.pdf"}},
+		{[]string{"L/Y/S/C/a.pdf", "L/Y/S/D/b.pdf"}, []string{"L/Y/S/C/a.pdf", "L/Y/S/D/b.pdf"}},
+		// Nothing deeper than expected: the shared folder is a level.
+		{[]string{"export/Y/S/C/a.pdf"}, []string{"export/Y/S/C/a.pdf"}},
+		// Not every file shares the folder.
+		{[]string{"export/L/Y/S/C/a.pdf", "other.pdf"}, []string{"export/L/Y/S/C/a.pdf", "other.pdf"}},
+	}
+	for _, tt := range tests {
+		sources := make([]importSource, len(tt.paths))
+		for i, p := range tt.paths {
+			sources[i].Path = p
+		}
+		stripWrapperFolders(sources)
+		for i, s := range sources {
+			if s.Path != tt.want[i] {
+				t.Errorf("%v: path %d = %q, want %q", tt.paths, i, s.Path, tt.want[i])
+			}
+		}
+	}
+}
+
+// writeImportTree lays out files under a wrapper folder in dir.
+func writeImportTree(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		p := filepath.Join(dir, "export", filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestImportCommand(t *testing.T) {
+	openTestDB(t)
+	seedTestData(t)
+	useTestStorage(t)
+	dir := t.TempDir()
+	writeImportTree(t, dir, map[string]string{
+		importTestSubject + "/Cours/lecon 1.pdf":   testPDF,
+		importTestSubject + "/Examens/examen.pdf":  testPDF + "examen",
+		importTestUnknown + "/Cours/capteurs.pdf":  testPDF + "capteurs",
+		importTestSubject + "/Cours/.DS_Store":     "ignored",
+		"Primaire/Année 1 primaire/notes.pdf":      testPDF + "notes",
+		importTestSubject + "/Cours/programme.exe": "MZ",
+	})
+	sources, err := dirSources(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A dry run plans without writing anything.
+	report, err := runImport(sources, importOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses := map[string]string{}
+	for _, item := range report.Files {
+		statuses[item.Path] = item.Status
+	}
+	want := map[string]string{
+		importTestSubject + "/Cours/lecon 1.pdf":   importReady,
+		importTestSubject + "/Examens/examen.pdf":  importReady,
+		importTestUnknown + "/Cours/capteurs.pdf":  importUnmatched,
+		"Primaire/Année 1 primaire/notes.pdf":      importSkipped,
+		importTestSubject + "/Cours/programme.exe": importSkipped,
+	}
+	if len(statuses) != len(want) {
+		t.Errorf("planned %v, want %v", statuses, want)
+	}
+	for p, status := range want {
+		if statuses[p] != status {
+			t.Errorf("dry run: %s is %q, want %q", p, statuses[p], status)
+		}
+	}
+	if len(report.Unmatched) != 1 || report.Unmatched[0].Kind != "subject" || report.Unmatched[0].Name != "Robotique" {
+		t.Errorf("unmatched = %+v, want the subject Robotique", report.Unmatched)
+	}
+	if n := count(t, "SELECT COUNT(*) FROM documents"); n != 0 {
+		t.Errorf("dry run published %d documents", n)
+	}
+
+	// Without -create, unmatched files are left out.
+	if err := importCommand([]string{dir}); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(t, "SELECT COUNT(*) FROM documents WHERE subject_id = 1"); n != 2 {
+		t.Errorf("%d documents imported into subject 1, want 2", n)
+	}
+	if n := count(t, "SELECT COUNT(*) FROM documents WHERE title = 'lecon 1' AND category_id = 1"); n != 1 {
+		t.Error("lecon 1.pdf not imported into Cours")
+	}
+	if n := count(t, "SELECT COUNT(*) FROM subjects WHERE name = 'Robotique'"); n != 0 {
+		t.Error("subject created without -create")
+	}
+
+	// With -create, the missing subject is added under its year.
+	if err := importCommand([]string{"-create", dir}); err != nil {
+		t.Fatal(err)
+	}
+	var subjectID int
+	if err := db.QueryRow("SELECT id FROM subjects WHERE name = 'Robotique' AND year_id = 1").Scan(&subjectID); err != nil {
+		t.Fatalf("subject not created: %v", err)
+	}
+	if n := count(t, "SELECT COUNT(*) FROM documents WHERE subject_id = ? AND title = 'capteurs'", subjectID); n != 1 {
+		t.Error("capteurs.pdf not imported into the created subject")
+	}
+}
+
+// zipRequest builds an import request carrying a ZIP of files.
+func zipRequest(t *testing.T, target, token string, files map[string]string) *http.Request {
+	t.Helper()
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+	zw.Close()
+	return multipartRequest(t, target, token, nil, testFile{"archive", "import.zip", archive.String()})
+}
+
+func TestImportArchive(t *testing.T) {
+	openTestDB(t)
+	seedTestData(t)
+	useTestStorage(t)
+	_, uploader := addTestAdmin(t, "uploader", RoleUploader, nil, nil, intPtr(1))
+	files := map[string]string{
+		importTestSubject + "/Cours/lecon.pdf":        testPDF,
+		importTestUnknown + "/Cours/capteurs.pdf":     testPDF + "capteurs",
+		"Primaire/Année 1 primaire/Arabe/Cours/a.pdf": testPDF + "arabe",
+	}
+
+	if w := serve(zipRequest(t, "/api/admin/import?create=true", uploader, files)); w.Code != 403 {
+		t.Errorf("create by an uploader: %d, want 403", w.Code)
+	}
+	if w := serve(multipartRequest(t, "/api/admin/import", uploader, nil,
+		testFile{"archive", "import.zip", "not a zip"})); w.Code != 400 {
+		t.Errorf("invalid archive: %d, want 400", w.Code)
+	}
+
+	w := serve(zipRequest(t, "/api/admin/import", uploader, files))
+	var report importReport
+	json.Unmarshal(w.Body.Bytes(), &report)
+	if w.Code != 200 || report.Imported != 1 || report.Failed != 2 {
+		t.Fatalf("import: %d, %d imported and %d failed: %s", w.Code, report.Imported, report.Failed, w.Body)
+	}
+	for _, item := range report.Files {
+		want := importImported
+		switch item.Path {
+		case importTestUnknown + "/Cours/capteurs.pdf":
+			want = importUnmatched
+		case "Primaire/Année 1 primaire/Arabe/Cours/a.pdf":
+			// Outside the uploader's subject.
+			want = importSkipped
+		}
+		if item.Status != want {
+			t.Errorf("%s: %q, want %q", item.Path, item.Status, want)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"io/fs"
+	"log"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========== REFERENTIAL INTEGRITY ==========
+//
+// Foreign keys are enforced on every connection (see openDB). Deleting a node
+// of the content hierarchy moves it to the trash (see trash.go); purging it
+// from there follows a fixed policy per relation:
+//
+//	levels     -> years      cascade
+//	years      -> subjects   cascade
+//	subjects   -> documents  cascade, the files of all versions are removed
+//	                         unless another document still uses them
+//	categories -> documents  restrict, the delete is refused with a 409
+//
+// The restrict rule already applies when a category is moved to the trash.
+//
+// Admin grants scoped to a deleted level, year or subject cascade in the schema.
+
+var errNotFound = errors.New("not found")
+
+// errRestricted reports the dependents that block a restricted delete.
+type errRestricted struct {
+	Dependents map[string]int
+}
+
+func (e *errRestricted) Error() string {
+	return "delete blocked by dependent rows"
+}
+
+func isForeignKeyError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "FOREIGN KEY constraint failed")
+}
+
+// cascadeDelete runs statements in one transaction, each bound to id, and
+// removes the files selected by filesQuery once the transaction commits. The
+// last statement must delete the node itself; errNotFound is returned when it
+// matched nothing.
+func cascadeDelete(filesQuery string, statements []string, id any) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	files, err := queryFilePaths(tx, filesQuery, id)
+	if err != nil {
+		return err
+	}
+
+	var result sql.Result
+	for _, stmt := range statements {
+		if result, err = tx.Exec(stmt, id); err != nil {
+			return err
+		}
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errNotFound
+	}
+	if err := pruneSearchIndex(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	removeFiles(files)
+	return nil
+}
+
+// removeFiles deletes files from storage, keeping those that some document
+// version still references, such as shared blobs, or an upload is about to.
+func removeFiles(paths []string) {
+	for _, path := range paths {
+		removeFile(path)
+	}
+}
+
+func removeFile(path string) {
+	blobRefs.Lock()
+	defer blobRefs.Unlock()
+	var refs int
+	if err := db.QueryRow("SELECT COUNT(*) FROM document_versions WHERE file_path = ?", path).Scan(&refs); err != nil {
+		log.Printf("⚠️  Could not check references to %s: %v", path, err)
+		return
+	}
+	if refs > 0 {
+		return
+	}
+	if err := store.Delete(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("⚠️  Could not remove %s: %v", path, err)
+	}
+}
+
+// versionFilesOf selects the files of every version of the documents matching
+// filter.
+func versionFilesOf(filter string) string {
+	return "SELECT file_path FROM document_versions WHERE document_id IN (SELECT id FROM documents WHERE " + filter + ")"
+}
+
+// Row filters selecting the descendants of a node, each bound to the node id.
+const (
+	subjectsOfLevel  = "year_id IN (SELECT id FROM years WHERE level_id = ?)"
+	documentsOfLevel = "subject_id IN (SELECT s.id FROM subjects s JOIN years y ON s.year_id = y.id WHERE y.level_id = ?)"
+	documentsOfYear  = "subject_id IN (SELECT id FROM subjects WHERE year_id = ?)"
+)
+
+func deleteLevelCascade(id any) error {
+	return cascadeDelete(
+		versionFilesOf(documentsOfLevel),
+		[]string{
+			"DELETE FROM documents WHERE " + documentsOfLevel,
+			"DELETE FROM subjects WHERE " + subjectsOfLevel,
+			"DELETE FROM years WHERE level_id = ?",
+			"DELETE FROM levels WHERE id = ?",
+		}, id)
+}
+
+func deleteYearCascade(id any) error {
+	return cascadeDelete(
+		versionFilesOf(documentsOfYear),
+		[]string{
+			"DELETE FROM documents WHERE " + documentsOfYear,
+			"DELETE FROM subjects WHERE year_id = ?",
+			"DELETE FROM years WHERE id = ?",
+		}, id)
+}
+
+func deleteSubjectCascade(id any) error {
+	return cascadeDelete(
+		versionFilesOf("subject_id = ?"),
+		[]string{
+			"DELETE FROM documents WHERE subject_id = ?",
+			"DELETE FROM subjects WHERE id = ?",
+		}, id)
+}
+
+func deleteDocument(id any) error {
+	return cascadeDelete(
+		versionFilesOf("id = ?"),
+		[]string{"DELETE FROM documents WHERE id = ?"},
+		id)
+}
+
+// trashCategoryRestrict moves a category to the trash unless live documents
+// still use it.
+func trashCategoryRestrict(id any) error {
+	var documents int
+	if err := db.QueryRow("SELECT COUNT(*) FROM documents WHERE category_id = ? AND deleted_at IS NULL", id).Scan(&documents); err != nil {
+		return err
+	}
+	if documents > 0 {
+		return &errRestricted{Dependents: map[string]int{"documents": documents}}
+	}
+	return trashNode("categories", id)
+}
+
+func deleteCategoryRestrict(id any) error {
+	var documents int
+	if err := db.QueryRow("SELECT COUNT(*) FROM documents WHERE category_id = ?", id).Scan(&documents); err != nil {
+		return err
+	}
+	if documents > 0 {
+		return &errRestricted{Dependents: map[string]int{"documents": documents}}
+	}
+
+	result, err := db.Exec("DELETE FROM categories WHERE id = ?", id)
+	if isForeignKeyError(err) {
+		return &errRestricted{Dependents: map[string]int{"documents": 1}}
+	}
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errNotFound
+	}
+	logIndexError(pruneSearchIndex(db))
+	return nil
+}
+
+// respondDeleteError maps the errors of the delete helpers to HTTP responses.
+func respondDeleteError(c *gin.Context, err error) {
+	var restricted *errRestricted
+	switch {
+	case errors.Is(err, errNotFound):
+		c.JSON(404, gin.H{"error": "Not found"})
+	case errors.As(err, &restricted):
+		c.JSON(409, gin.H{"error": "Cannot delete: other records still depend on it", "dependents": restricted.Dependents})
+	default:
+		c.JSON(500, gin.H{"error": err.Error()})
+	}
+}
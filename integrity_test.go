@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// count returns the number of rows matching the query.
+func count(t *testing.T, query string, args ...any) int {
+	t.Helper()
+	var n int
+	if err := db.QueryRow(query, args...).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestForeignKeysAreEnforced(t *testing.T) {
+	openTestDB(t)
+	seedTestData(t)
+
+	_, err := db.Exec(`INSERT INTO documents (subject_id, category_id, title, file_name, file_path)
+                       VALUES (9999, 1, 'Orphelin', 'orphelin.pdf', 'uploads/orphelin.pdf')`)
+	if !isForeignKeyError(err) {
+		t.Errorf("document of an unknown subject: %v, want a foreign key error", err)
+	}
+	if _, err := db.Exec("DELETE FROM years WHERE id = 1"); !isForeignKeyError(err) {
+		t.Errorf("deleting a year with subjects: %v, want a foreign key error", err)
+	}
+}
+
+func TestPurgeLevelCascades(t *testing.T) {
+	openTestDB(t)
+	seedTestData(t)
+	useTestStorage(t)
+	docID, key := addTestDocument(t, "cours", "%PDF-1.4 cours")
+	adminID, _ := addTestAdmin(t, "editor", RoleLevelEditor, intPtr(1), nil, nil)
+
+	if err := trashNode("levels", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := purgeNode("levels", 1); err != nil {
+		t.Fatal(err)
+	}
+	for query, want := range map[string]int{
+		"SELECT COUNT(*) FROM levels WHERE id = 1":                                          0,
+		"SELECT COUNT(*) FROM years WHERE level_id = 1":                                     0,
+		"SELECT COUNT(*) FROM subjects WHERE year_id BETWEEN 1 AND 5":                       0,
+		fmt.Sprintf("SELECT COUNT(*) FROM documents WHERE id = %d", docID):                  0,
+		fmt.Sprintf("SELECT COUNT(*) FROM document_versions WHERE document_id = %d", docID): 0,
+		fmt.Sprintf("SELECT COUNT(*) FROM admin_grants WHERE admin_id = %d", adminID):       0,
+		"SELECT COUNT(*) FROM years WHERE level_id = 2":                                     4,
+	} {
+		if got := count(t, query); got != want {
+			t.Errorf("%s = %d, want %d", query, got, want)
+		}
+	}
+	if _, err := store.Stat(key); err == nil {
+		t.Errorf("file %s of the purged level kept", key)
+	}
+}
+
+func TestPurgeKeepsSharedFiles(t *testing.T) {
+	openTestDB(t)
+	seedTestData(t)
+	useTestStorage(t)
+	addTestDocument(t, "cours", "%PDF-1.4 shared")
+	elsewhere, key := addTestDocument(t, "cours", "%PDF-1.4 shared")
+	db.Exec("UPDATE documents SET subject_id = 17 WHERE id = ?", elsewhere)
+
+	if err := trashNode("subjects", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := purgeNode("subjects", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Stat(key); err != nil {
+		t.Errorf("file %s shared with subject 17 removed: %v", key, err)
+	}
+}
+
+func TestCategoryDeleteIsRestricted(t *testing.T) {
+	openTestDB(t)
+	seedTestData(t)
+	useTestStorage(t)
+	_, token := addTestAdmin(t, "root", RoleSuperAdmin, nil, nil, nil)
+	docID, _ := addTestDocument(t, "cours", "%PDF-1.4 cours")
+
+	var body struct {
+		Dependents map[string]int `json:"dependents"`
+	}
+	if code := call(t, "DELETE", "/api/admin/categories/1", token, nil, &body); code != 409 || body.Dependents["documents"] != 1 {
+		t.Errorf("delete of a used category: %d %v, want 409 with 1 document", code, body.Dependents)
+	}
+
+	// A trashed document still holds its category back from the purge.
+	if err := trashNode("documents", docID); err != nil {
+		t.Fatal(err)
+	}
+	if code := call(t, "DELETE", "/api/admin/categories/1", token, nil, nil); code != 200 {
+		t.Fatalf("delete of a category whose documents are trashed: %d, want 200", code)
+	}
+	if code := call(t, "DELETE", "/api/admin/trash/categories/1", token, nil, nil); code != 409 {
+		t.Errorf("purge of a category with a trashed document: %d, want 409", code)
+	}
+	if code := call(t, "DELETE", fmt.Sprintf("/api/admin/trash/documents/%d", docID), token, nil, nil); code != 200 {
+		t.Fatalf("purge of the document: %d", code)
+	}
+	if code := call(t, "DELETE", "/api/admin/trash/categories/1", token, nil, nil); code != 200 {
+		t.Errorf("purge of an unused category: %d, want 200", code)
+	}
+}
@@ -0,0 +1,613 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ========== SCHEMA MIGRATIONS ==========
+
+// A migration moves the schema from version-1 to version. Steps run inside a
+// transaction together with the schema_migrations bookkeeping.
+type migration struct {
+	version int
+	name    string
+	up      []string
+	down    []string
+}
+
+// migrations must stay ordered by version. Never edit a released step: add a
+// new one instead.
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "initial schema",
+		up: []string{
+			`CREATE TABLE levels (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				name TEXT NOT NULL,
+				name_ar TEXT NOT NULL,
+				color TEXT NOT NULL,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+			)`,
+			`CREATE TABLE years (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				level_id INTEGER NOT NULL,
+				name TEXT NOT NULL,
+				name_ar TEXT NOT NULL,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				FOREIGN KEY (level_id) REFERENCES levels(id)
+			)`,
+			`CREATE TABLE subjects (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				year_id INTEGER NOT NULL,
+				name TEXT NOT NULL,
+				name_ar TEXT NOT NULL,
+				icon TEXT,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				FOREIGN KEY (year_id) REFERENCES years(id)
+			)`,
+			`CREATE TABLE categories (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				name TEXT NOT NULL,
+				name_ar TEXT NOT NULL,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+			)`,
+			`CREATE TABLE documents (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				subject_id INTEGER NOT NULL,
+				category_id INTEGER NOT NULL,
+				title TEXT NOT NULL,
+				file_name TEXT NOT NULL,
+				file_path TEXT NOT NULL,
+				file_size INTEGER DEFAULT 0,
+				downloads INTEGER DEFAULT 0,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				FOREIGN KEY (subject_id) REFERENCES subjects(id),
+				FOREIGN KEY (category_id) REFERENCES categories(id)
+			)`,
+		},
+		down: []string{
+			"DROP TABLE documents",
+			"DROP TABLE categories",
+			"DROP TABLE subjects",
+			"DROP TABLE years",
+			"DROP TABLE levels",
+		},
+	},
+	{
+		version: 2,
+		name:    "admin accounts and sessions",
+		// Databases from before migrations may already hold the admin tables
+		// of this step and the next two, created with IF NOT EXISTS at every
+		// start, so these steps must tolerate them being there.
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS admins (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				username TEXT NOT NULL UNIQUE,
+				password_hash TEXT NOT NULL,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+			)`,
+			`CREATE TABLE IF NOT EXISTS admin_sessions (
+				token_hash TEXT PRIMARY KEY,
+				admin_id INTEGER NOT NULL,
+				expires_at INTEGER NOT NULL,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				FOREIGN KEY (admin_id) REFERENCES admins(id) ON DELETE CASCADE
+			)`,
+		},
+		down: []string{
+			"DROP TABLE admin_sessions",
+			"DROP TABLE admins",
+		},
+	},
+	{
+		version: 3,
+		name:    "admin role grants",
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS admin_grants (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				admin_id INTEGER NOT NULL,
+				role TEXT NOT NULL,
+				level_id INTEGER,
+				year_id INTEGER,
+				subject_id INTEGER,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				FOREIGN KEY (admin_id) REFERENCES admins(id) ON DELETE CASCADE,
+				FOREIGN KEY (level_id) REFERENCES levels(id) ON DELETE CASCADE,
+				FOREIGN KEY (year_id) REFERENCES years(id) ON DELETE CASCADE,
+				FOREIGN KEY (subject_id) REFERENCES subjects(id) ON DELETE CASCADE
+			)`,
+		},
+		down: []string{
+			"DROP TABLE admin_grants",
+		},
+	},
+	{
+		version: 4,
+		name:    "two-factor authentication",
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS admin_totp (
+				admin_id INTEGER PRIMARY KEY,
+				secret TEXT NOT NULL,
+				enabled INTEGER NOT NULL DEFAULT 0,
+				last_step INTEGER NOT NULL DEFAULT 0,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				FOREIGN KEY (admin_id) REFERENCES admins(id) ON DELETE CASCADE
+			)`,
+			`CREATE TABLE IF NOT EXISTS admin_recovery_codes (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				admin_id INTEGER NOT NULL,
+				code_hash TEXT NOT NULL,
+				used_at DATETIME,
+				FOREIGN KEY (admin_id) REFERENCES admins(id) ON DELETE CASCADE
+			)`,
+			`CREATE TABLE IF NOT EXISTS role_policies (
+				role TEXT PRIMARY KEY,
+				require_2fa INTEGER NOT NULL DEFAULT 0
+			)`,
+		},
+		down: []string{
+			"DROP TABLE role_policies",
+			"DROP TABLE admin_recovery_codes",
+			"DROP TABLE admin_totp",
+		},
+	},
+	{
+		version: 5,
+		name:    "soft delete",
+		up: []string{
+			"ALTER TABLE levels ADD COLUMN deleted_at DATETIME",
+			"ALTER TABLE years ADD COLUMN deleted_at DATETIME",
+			"ALTER TABLE subjects ADD COLUMN deleted_at DATETIME",
+			"ALTER TABLE categories ADD COLUMN deleted_at DATETIME",
+			"ALTER TABLE documents ADD COLUMN deleted_at DATETIME",
+		},
+		down: []string{
+			"ALTER TABLE documents DROP COLUMN deleted_at",
+			"ALTER TABLE categories DROP COLUMN deleted_at",
+			"ALTER TABLE subjects DROP COLUMN deleted_at",
+			"ALTER TABLE years DROP COLUMN deleted_at",
+			"ALTER TABLE levels DROP COLUMN deleted_at",
+		},
+	},
+	{
+		version: 6,
+		name:    "document updated_at",
+		up: []string{
+			"ALTER TABLE documents ADD COLUMN updated_at DATETIME",
+		},
+		down: []string{
+			"ALTER TABLE documents DROP COLUMN updated_at",
+		},
+	},
+	{
+		version: 7,
+		name:    "document versions",
+		up: []string{
+			`CREATE TABLE document_versions (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				document_id INTEGER NOT NULL,
+				version INTEGER NOT NULL,
+				file_name TEXT NOT NULL,
+				file_path TEXT NOT NULL,
+				file_size INTEGER DEFAULT 0,
+				checksum TEXT NOT NULL DEFAULT '',
+				note TEXT NOT NULL DEFAULT '',
+				uploaded_by INTEGER,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				UNIQUE (document_id, version),
+				FOREIGN KEY (document_id) REFERENCES documents(id) ON DELETE CASCADE,
+				FOREIGN KEY (uploaded_by) REFERENCES admins(id) ON DELETE SET NULL
+			)`,
+			"ALTER TABLE documents ADD COLUMN current_version INTEGER NOT NULL DEFAULT 1",
+			// Existing files become version 1; their checksum is unknown.
+			`INSERT INTO document_versions (document_id, version, file_name, file_path, file_size, created_at)
+				SELECT id, 1, file_name, file_path, file_size, created_at FROM documents`,
+		},
+		down: []string{
+			"ALTER TABLE documents DROP COLUMN current_version",
+			"DROP TABLE document_versions",
+		},
+	},
+	{
+		version: 8,
+		name:    "document content hash",
+		up: []string{
+			"ALTER TABLE documents ADD COLUMN content_hash TEXT",
+			`UPDATE documents SET content_hash = (
+				SELECT NULLIF(v.checksum, '') FROM document_versions v
+				WHERE v.document_id = documents.id AND v.version = documents.current_version)`,
+			"CREATE INDEX idx_documents_content_hash ON documents(content_hash)",
+			"CREATE INDEX idx_document_versions_file_path ON document_versions(file_path)",
+		},
+		down: []string{
+			"DROP INDEX idx_document_versions_file_path",
+			"DROP INDEX idx_documents_content_hash",
+			"ALTER TABLE documents DROP COLUMN content_hash",
+		},
+	},
+	{
+		version: 9,
+		name:    "upload validation",
+		up: []string{
+			// NULL falls back to UPLOAD_MAX_BYTES.
+			"ALTER TABLE categories ADD COLUMN max_upload_size INTEGER",
+			"ALTER TABLE documents ADD COLUMN mime_type TEXT NOT NULL DEFAULT ''",
+			"ALTER TABLE document_versions ADD COLUMN mime_type TEXT NOT NULL DEFAULT ''",
+		},
+		down: []string{
+			"ALTER TABLE document_versions DROP COLUMN mime_type",
+			"ALTER TABLE documents DROP COLUMN mime_type",
+			"ALTER TABLE categories DROP COLUMN max_upload_size",
+		},
+	},
+	{
+		version: 10,
+		name:    "malware scan status",
+		up: []string{
+			// Files uploaded before scanning existed stay visible.
+			"ALTER TABLE document_versions ADD COLUMN scan_status TEXT NOT NULL DEFAULT 'clean'",
+			"ALTER TABLE document_versions ADD COLUMN scan_verdict TEXT NOT NULL DEFAULT ''",
+			"ALTER TABLE document_versions ADD COLUMN scanned_at DATETIME",
+			"ALTER TABLE documents ADD COLUMN scan_status TEXT NOT NULL DEFAULT 'clean'",
+			"ALTER TABLE documents ADD COLUMN scan_verdict TEXT NOT NULL DEFAULT ''",
+		},
+		down: []string{
+			"ALTER TABLE documents DROP COLUMN scan_verdict",
+			"ALTER TABLE documents DROP COLUMN scan_status",
+			"ALTER TABLE document_versions DROP COLUMN scanned_at",
+			"ALTER TABLE document_versions DROP COLUMN scan_verdict",
+			"ALTER TABLE document_versions DROP COLUMN scan_status",
+		},
+	},
+	{
+		version: 11,
+		name:    "resumable uploads",
+		up: []string{
+			`CREATE TABLE upload_sessions (
+				id TEXT PRIMARY KEY,
+				admin_id INTEGER NOT NULL,
+				subject_id INTEGER NOT NULL,
+				category_id INTEGER NOT NULL,
+				title TEXT NOT NULL,
+				file_name TEXT NOT NULL,
+				upload_length INTEGER NOT NULL,
+				upload_offset INTEGER NOT NULL DEFAULT 0,
+				document_id INTEGER,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				expires_at INTEGER NOT NULL,
+				FOREIGN KEY (admin_id) REFERENCES admins(id) ON DELETE CASCADE,
+				FOREIGN KEY (subject_id) REFERENCES subjects(id) ON DELETE CASCADE,
+				FOREIGN KEY (category_id) REFERENCES categories(id) ON DELETE CASCADE,
+				FOREIGN KEY (document_id) REFERENCES documents(id) ON DELETE SET NULL
+			)`,
+			"CREATE INDEX idx_upload_sessions_expires_at ON upload_sessions(expires_at)",
+		},
+		down: []string{
+			"DROP TABLE upload_sessions",
+		},
+	},
+	{
+		version: 12,
+		name:    "search index",
+		// Filled from Go by rebuildSearchIndex at startup, see search.go.
+		up: []string{
+			`CREATE VIRTUAL TABLE search_index USING fts5(
+				title, file_name, subject, category,
+				kind UNINDEXED, ref_id UNINDEXED,
+				level_id UNINDEXED, year_id UNINDEXED, subject_id UNINDEXED, category_id UNINDEXED,
+				tokenize = 'unicode61 remove_diacritics 2'
+			)`,
+		},
+		down: []string{
+			"DROP TABLE search_index",
+		},
+	},
+	{
+		version: 13,
+		name:    "search vocabulary",
+		// The terms of search_index, matched against mistyped words.
+		up: []string{
+			"CREATE VIRTUAL TABLE search_vocab USING fts5vocab(search_index, row)",
+		},
+		down: []string{
+			"DROP TABLE search_vocab",
+		},
+	},
+	{
+		version: 14,
+		name:    "content version",
+		// One row counting the writes to the hierarchy, see httpcache.go.
+		up: append([]string{
+			`CREATE TABLE content_version (
+				id INTEGER PRIMARY KEY CHECK (id = 1),
+				version INTEGER NOT NULL,
+				updated_at DATETIME NOT NULL
+			)`,
+			"INSERT INTO content_version (id, version, updated_at) VALUES (1, 1, CURRENT_TIMESTAMP)",
+		}, contentVersionTriggers("CREATE")...),
+		down: append(contentVersionTriggers("DROP"), "DROP TABLE content_version"),
+	},
+	{
+		version: 15,
+		name:    "scan attempts",
+		// Failed scans of a pending version, see scanner.go.
+		up: []string{
+			"ALTER TABLE document_versions ADD COLUMN scan_attempts INTEGER NOT NULL DEFAULT 0",
+		},
+		down: []string{
+			"ALTER TABLE document_versions DROP COLUMN scan_attempts",
+		},
+	},
+	{
+		version: 16,
+		name:    "two-factor attempt limit",
+		// Wrong login codes in a row and the end of the lockout, see totp.go.
+		up: []string{
+			"ALTER TABLE admin_totp ADD COLUMN failed_attempts INTEGER NOT NULL DEFAULT 0",
+			"ALTER TABLE admin_totp ADD COLUMN locked_until INTEGER NOT NULL DEFAULT 0",
+		},
+		down: []string{
+			"ALTER TABLE admin_totp DROP COLUMN locked_until",
+			"ALTER TABLE admin_totp DROP COLUMN failed_attempts",
+		},
+	},
+	{
+		version: 17,
+		name:    "trash delete batches",
+		// Names the delete that trashed a row, see trash.go. Rows already in
+		// the trash keep being grouped by their deleted_at.
+		up: trashBatchSteps("ALTER TABLE %s ADD COLUMN delete_batch TEXT",
+			"UPDATE %s SET delete_batch = deleted_at WHERE deleted_at IS NOT NULL"),
+		down: trashBatchSteps("ALTER TABLE %s DROP COLUMN delete_batch"),
+	},
+}
+
+// trashBatchSteps formats each step for every soft-deletable table.
+func trashBatchSteps(steps ...string) []string {
+	var statements []string
+	for _, table := range []string{"levels", "years", "subjects", "categories", "documents"} {
+		for _, step := range steps {
+			statements = append(statements, fmt.Sprintf(step, table))
+		}
+	}
+	return statements
+}
+
+// contentVersionTables are the tables behind the cached read APIs.
+var contentVersionTables = []string{"levels", "years", "subjects", "categories"}
+
+// contentVersionTriggers creates or drops the triggers bumping
+// content_version on every insert, update and delete of those tables.
+func contentVersionTriggers(action string) []string {
+	var statements []string
+	for _, table := range contentVersionTables {
+		for _, event := range []string{"INSERT", "UPDATE", "DELETE"} {
+			name := fmt.Sprintf("%s_%s_content_version", table, strings.ToLower(event))
+			if action == "DROP" {
+				statements = append(statements, "DROP TRIGGER "+name)
+				continue
+			}
+			statements = append(statements, fmt.Sprintf(`CREATE TRIGGER %s AFTER %s ON %s BEGIN
+				UPDATE content_version SET version = version + 1, updated_at = CURRENT_TIMESTAMP;
+			END`, name, event, table))
+		}
+	}
+	return statements
+}
+
+// ========== MIGRATION RUNNER ==========
+
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// ensureMigrationTable creates schema_migrations. A database created before
+// migrations existed already has the five original tables; it is adopted as
+// version 1 instead of being recreated.
+func ensureMigrationTable() error {
+	var exists int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations'").
+		Scan(&exists); err != nil {
+		return err
+	}
+	if exists > 0 {
+		return nil
+	}
+
+	if _, err := db.Exec(`CREATE TABLE schema_migrations (
+            version INTEGER PRIMARY KEY,
+            name TEXT NOT NULL,
+            applied_at DATETIME DEFAULT CURRENT_TIMESTAMP
+        )`); err != nil {
+		return err
+	}
+
+	var legacy int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'levels'").
+		Scan(&legacy); err != nil {
+		return err
+	}
+	if legacy > 0 {
+		if _, err := db.Exec("INSERT INTO schema_migrations (version, name) VALUES (?, ?)",
+			migrations[0].version, migrations[0].name); err != nil {
+			return err
+		}
+		log.Println("ℹ️  Existing database adopted as schema version 1")
+	}
+	return nil
+}
+
+func currentSchemaVersion() (int, error) {
+	if err := ensureMigrationTable(); err != nil {
+		return 0, err
+	}
+	var version int
+	err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	return version, err
+}
+
+func applyMigration(m migration, steps []string, record func(*sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, step := range steps {
+		if _, err := tx.Exec(step); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+	}
+	if err := record(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// migrateUp applies pending migrations up to target, or all of them when
+// target is 0.
+func migrateUp(target int) error {
+	current, err := currentSchemaVersion()
+	if err != nil {
+		return err
+	}
+	if target == 0 {
+		target = latestSchemaVersion()
+	}
+
+	for _, m := range migrations {
+		if m.version <= current || m.version > target {
+			continue
+		}
+		err := applyMigration(m, m.up, func(tx *sql.Tx) error {
+			_, err := tx.Exec("INSERT INTO schema_migrations (version, name) VALUES (?, ?)", m.version, m.name)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("⬆️  Applied migration %d: %s", m.version, m.name)
+	}
+	return nil
+}
+
+// migrateDown reverts the given number of most recent migrations.
+func migrateDown(steps int) error {
+	current, err := currentSchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+		m := migrations[i]
+		if m.version > current {
+			continue
+		}
+		err := applyMigration(m, m.down, func(tx *sql.Tx) error {
+			_, err := tx.Exec("DELETE FROM schema_migrations WHERE version = ?", m.version)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("⬇️  Reverted migration %d: %s", m.version, m.name)
+		steps--
+	}
+	return nil
+}
+
+// autoMigrateEnabled reports whether pending migrations are applied when the
+// server starts. Set AUTO_MIGRATE=false to run `migrate up` by hand instead.
+func autoMigrateEnabled() bool {
+	enabled, err := strconv.ParseBool(os.Getenv("AUTO_MIGRATE"))
+	return err != nil || enabled
+}
+
+// ensureSchema brings the database to the latest version, or refuses to
+// continue against an outdated schema when auto-migration is disabled.
+func ensureSchema() error {
+	if autoMigrateEnabled() {
+		return migrateUp(0)
+	}
+
+	current, err := currentSchemaVersion()
+	if err != nil {
+		return err
+	}
+	if current < latestSchemaVersion() {
+		return fmt.Errorf("database schema is at version %d but %d is required; run `migrate up`",
+			current, latestSchemaVersion())
+	}
+	return nil
+}
+
+// ========== MIGRATE COMMAND ==========
+
+func migrateCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: migrate up [version] | down [steps] | status")
+	}
+
+	switch args[0] {
+	case "up":
+		target := 0
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil {
+				return fmt.Errorf("invalid version %q", args[1])
+			}
+			target = n
+		}
+		return migrateUp(target)
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid step count %q", args[1])
+			}
+			steps = n
+		}
+		return migrateDown(steps)
+
+	case "status":
+		if err := ensureMigrationTable(); err != nil {
+			return err
+		}
+		applied := map[int]string{}
+		rows, err := db.Query("SELECT version, applied_at FROM schema_migrations")
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var version int
+			var appliedAt string
+			if err := rows.Scan(&version, &appliedAt); err != nil {
+				rows.Close()
+				return err
+			}
+			applied[version] = appliedAt
+		}
+		rows.Close()
+
+		for _, m := range migrations {
+			status := "pending"
+			if at, ok := applied[m.version]; ok {
+				status = "applied " + at
+			}
+			fmt.Printf("%3d  %-32s %s\n", m.version, m.name, status)
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unknown migrate action %q", args[0])
+	}
+}
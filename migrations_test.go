@@ -0,0 +1,176 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// openDBFile points db at a copy of the database file for the duration of
+// the test.
+func openDBFile(t *testing.T, src string) {
+	t.Helper()
+	data, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), filepath.Base(src))
+	if err := os.WriteFile(file, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fileDB, err := sql.Open("sqlite", "file:"+file+"?_pragma=foreign_keys(1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := db
+	db = fileDB
+	t.Cleanup(func() {
+		fileDB.Close()
+		db = saved
+	})
+}
+
+func TestLegacyDatabaseIsAdopted(t *testing.T) {
+	// StudyDz.db is a database from before migrations: the five content
+	// tables, created with IF NOT EXISTS at every start.
+	openDBFile(t, "StudyDz.db")
+	if _, err := db.Exec(`INSERT INTO documents (subject_id, category_id, title, file_name, file_path, file_size)
+                          VALUES (1, 1, 'Ancien', 'ancien.pdf', 'uploads/ancien.pdf', 42)`); err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := currentSchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 1 {
+		t.Fatalf("legacy database adopted as version %d, want 1", version)
+	}
+	if err := migrateUp(0); err != nil {
+		t.Fatal(err)
+	}
+	if version, _ := currentSchemaVersion(); version != latestSchemaVersion() {
+		t.Errorf("version after migrating = %d, want %d", version, latestSchemaVersion())
+	}
+
+	var subjects, versions int
+	db.QueryRow("SELECT COUNT(*) FROM subjects").Scan(&subjects)
+	if subjects != 217 {
+		t.Errorf("%d subjects after migrating, want the 217 of the legacy database", subjects)
+	}
+	// The legacy file became version 1 of its document.
+	db.QueryRow("SELECT COUNT(*) FROM document_versions WHERE file_path = 'uploads/ancien.pdf' AND version = 1").Scan(&versions)
+	if versions != 1 {
+		t.Errorf("legacy document has %d first versions, want 1", versions)
+	}
+
+	// Starting again changes nothing.
+	if err := initDB(); err != nil {
+		t.Fatal(err)
+	}
+	db.QueryRow("SELECT COUNT(*) FROM subjects").Scan(&subjects)
+	if subjects != 217 {
+		t.Errorf("%d subjects after a restart, want 217", subjects)
+	}
+}
+
+func TestMigrationsRoundTrip(t *testing.T) {
+	openTestDB(t)
+	if err := migrateDown(latestSchemaVersion()); err != nil {
+		t.Fatal(err)
+	}
+	var tables int
+	db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name NOT IN ('schema_migrations', 'sqlite_sequence')").Scan(&tables)
+	if tables != 0 {
+		t.Errorf("%d tables left after migrating all the way down", tables)
+	}
+	if err := migrateUp(0); err != nil {
+		t.Fatal(err)
+	}
+	if version, _ := currentSchemaVersion(); version != latestSchemaVersion() {
+		t.Errorf("version = %d, want %d", version, latestSchemaVersion())
+	}
+}
+
+// preMigrationAdminTables are the admin tables initDB created with IF NOT
+// EXISTS at every start before migrations existed.
+var preMigrationAdminTables = []string{
+	`CREATE TABLE IF NOT EXISTS admins (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            username TEXT NOT NULL UNIQUE,
+            password_hash TEXT NOT NULL,
+            created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+        )`,
+	`CREATE TABLE IF NOT EXISTS admin_sessions (
+            token_hash TEXT PRIMARY KEY,
+            admin_id INTEGER NOT NULL,
+            expires_at INTEGER NOT NULL,
+            created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+            FOREIGN KEY (admin_id) REFERENCES admins(id) ON DELETE CASCADE
+        )`,
+	`CREATE TABLE IF NOT EXISTS admin_grants (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            admin_id INTEGER NOT NULL,
+            role TEXT NOT NULL,
+            level_id INTEGER,
+            year_id INTEGER,
+            subject_id INTEGER,
+            created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+            FOREIGN KEY (admin_id) REFERENCES admins(id) ON DELETE CASCADE,
+            FOREIGN KEY (level_id) REFERENCES levels(id) ON DELETE CASCADE,
+            FOREIGN KEY (year_id) REFERENCES years(id) ON DELETE CASCADE,
+            FOREIGN KEY (subject_id) REFERENCES subjects(id) ON DELETE CASCADE
+        )`,
+	`CREATE TABLE IF NOT EXISTS admin_totp (
+            admin_id INTEGER PRIMARY KEY,
+            secret TEXT NOT NULL,
+            enabled INTEGER NOT NULL DEFAULT 0,
+            last_step INTEGER NOT NULL DEFAULT 0,
+            created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+            FOREIGN KEY (admin_id) REFERENCES admins(id) ON DELETE CASCADE
+        )`,
+	`CREATE TABLE IF NOT EXISTS admin_recovery_codes (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            admin_id INTEGER NOT NULL,
+            code_hash TEXT NOT NULL,
+            used_at DATETIME,
+            FOREIGN KEY (admin_id) REFERENCES admins(id) ON DELETE CASCADE
+        )`,
+	`CREATE TABLE IF NOT EXISTS role_policies (
+            role TEXT PRIMARY KEY,
+            require_2fa INTEGER NOT NULL DEFAULT 0
+        )`,
+}
+
+func TestPreMigrationAdminTablesAreKept(t *testing.T) {
+	openDBFile(t, "StudyDz.db")
+	for _, statement := range preMigrationAdminTables {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	adminID, err := createAdmin("ancien", "password-ancien")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO admin_grants (admin_id, role) VALUES (?, ?)", adminID, RoleSuperAdmin); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO admin_totp (admin_id, secret, enabled) VALUES (?, 'SECRET', 1)", adminID); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := initDB(); err != nil {
+		t.Fatal(err)
+	}
+	if version, _ := currentSchemaVersion(); version != latestSchemaVersion() {
+		t.Errorf("version after migrating = %d, want %d", version, latestSchemaVersion())
+	}
+	var grants, enabled int
+	db.QueryRow("SELECT COUNT(*) FROM admin_grants WHERE admin_id = ? AND role = ?", adminID, RoleSuperAdmin).Scan(&grants)
+	db.QueryRow("SELECT enabled FROM admin_totp WHERE admin_id = ?", adminID).Scan(&enabled)
+	if grants != 1 || enabled != 1 {
+		t.Errorf("after migrating: %d grants, two-factor enabled %d; want the existing ones", grants, enabled)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// ========== SEARCH NORMALISATION ==========
+//
+// Text goes through searchWords both before it is indexed and before it is
+// searched, so that the spellings students commonly type find each other:
+//
+//   - case, French accents and ligatures are folded: "Lycée" → "lycee"
+//   - Arabic tashkeel and tatweel are removed
+//   - alef, hamza, yaa and taa marbuta forms are unified: "أ إ آ ٱ" → "ا",
+//     "ؤ" → "و", "ئ ى" → "ي", "ة" → "ه"
+//   - the definite article is removed: "الرياضيات" → "رياضيات",
+//     "والحياة" → "حياة", "l'histoire" → "histoire"
+//   - Arabic-Indic digits become ASCII digits
+//
+// Small typos are tolerated when searching: a word that starts no indexed term
+// is replaced by the indexed terms close to it, see fuzzyTerms.
+
+// searchLetters folds the letters that decomposition and lowercasing leave
+// apart. Decomposition already splits the hamza and madda off "أ إ آ ؤ ئ".
+var searchLetters = map[rune]string{
+	'ٱ': "ا",
+	'ى': "ي",
+	'ی': "ي",
+	'ة': "ه",
+	'ک': "ك",
+	'ـ': "",
+	'œ': "oe",
+	'æ': "ae",
+	'ß': "ss",
+}
+
+// searchArticles are removed from the start of Arabic words, with the word
+// left at least minRunes long.
+var searchArticles = []struct {
+	prefix   string
+	minRunes int
+}{
+	{"وال", 3},
+	{"بال", 3},
+	{"ال", 2},
+}
+
+// searchWords splits text into normalised words.
+func searchWords(text string) []string {
+	var words []string
+	var word strings.Builder
+	flush := func() {
+		if word.Len() > 0 {
+			words = append(words, stripArticle(word.String()))
+			word.Reset()
+		}
+	}
+
+	for _, r := range norm.NFD.String(text) {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+			// Accents, tashkeel and the hamza split off by decomposition.
+		case r >= '٠' && r <= '٩':
+			word.WriteRune('0' + r - '٠')
+		case r >= '۰' && r <= '۹':
+			word.WriteRune('0' + r - '۰')
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if folded, ok := searchLetters[r]; ok {
+				word.WriteString(folded)
+			} else {
+				word.WriteRune(unicode.ToLower(r))
+			}
+		case (r == '\'' || r == '’') && word.String() == "l":
+			// French elided article.
+			word.Reset()
+		default:
+			flush()
+		}
+	}
+	flush()
+	return words
+}
+
+func stripArticle(word string) string {
+	for _, article := range searchArticles {
+		rest, ok := strings.CutPrefix(word, article.prefix)
+		if ok && utf8.RuneCountInString(rest) >= article.minRunes {
+			return rest
+		}
+	}
+	return word
+}
+
+// normalizeSearchText is the text stored in the index for a column.
+func normalizeSearchText(text string) string {
+	return strings.Join(searchWords(text), " ")
+}
+
+// ========== TYPO TOLERANCE ==========
+
+// maxFuzzyTerms caps the indexed terms a mistyped word is replaced by.
+const maxFuzzyTerms = 10
+
+// typoBudget is the number of edits tolerated in a word: none under four
+// letters, where almost any word is one edit from another.
+func typoBudget(word []rune) int {
+	switch {
+	case len(word) < 4:
+		return 0
+	case len(word) < 8:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// editDistance counts the insertions, deletions, substitutions and swaps of
+// adjacent letters turning a into b.
+func editDistance(a, b []rune) int {
+	prev2 := make([]int, len(b)+1)
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				cur[j] = min(cur[j], prev2[j-2]+1)
+			}
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(b)]
+}
+
+// typoDistance compares a searched word with an indexed term, or with the
+// start of a longer term since searched words match as prefixes. It returns
+// false when they are further apart than the word's typo budget.
+func typoDistance(word, term []rune) (int, bool) {
+	budget := typoBudget(word)
+	if budget == 0 || len(term) < len(word)-budget {
+		return 0, false
+	}
+	distance := editDistance(word, term)
+	if len(term) > len(word) {
+		distance = min(distance, editDistance(word, term[:len(word)]))
+	}
+	return distance, distance <= budget
+}
+
+// fuzzyTerms returns the indexed terms closest to word, closest first, when
+// no indexed term starts with word.
+func fuzzyTerms(q execer, word string) ([]string, error) {
+	rows, err := q.Query("SELECT 1 FROM search_vocab WHERE term >= ? AND term < ? LIMIT 1",
+		word, word+string(utf8.MaxRune))
+	if err != nil {
+		return nil, err
+	}
+	found := rows.Next()
+	err = rows.Err()
+	rows.Close()
+	if err != nil || found || typoBudget([]rune(word)) == 0 {
+		return nil, err
+	}
+
+	rows, err = q.Query("SELECT term FROM search_vocab")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type candidate struct {
+		term     string
+		distance int
+	}
+	var candidates []candidate
+	runes := []rune(word)
+	for rows.Next() {
+		var term string
+		if err := rows.Scan(&term); err != nil {
+			return nil, err
+		}
+		if distance, ok := typoDistance(runes, []rune(term)); ok {
+			candidates = append(candidates, candidate{term, distance})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].distance != candidates[j].distance {
+			return candidates[i].distance < candidates[j].distance
+		}
+		return candidates[i].term < candidates[j].term
+	})
+	terms := make([]string, 0, min(len(candidates), maxFuzzyTerms))
+	for _, c := range candidates[:min(len(candidates), maxFuzzyTerms)] {
+		terms = append(terms, c.term)
+	}
+	return terms, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import "testing"
+
+func TestNormalizeSearchTextEquivalents(t *testing.T) {
+	// Each group spells one name of insertDefaultData in the ways students
+	// type it; all must index and search the same.
+	groups := [][]string{
+		{"الرياضيات", "رياضيات", "الرياضيّات", "الرِّيَاضِيَّات", "الريـــاضيات"},
+		{"التربية الإسلامية", "التربيه الاسلاميه", "تربية إسلامية", "التربية الأسلامية"},
+		{"الإعلام الآلي", "الاعلام الالي", "إعلام آلي"},
+		{"الإقتصاد والمناجمنت", "الاقتصاد والمناجمنت", "اقتصاد والمناجمنت"},
+		{"اللغة الإنجليزية", "اللغه الانجليزيه", "لغة إنجليزية"},
+		{"الفلسفة", "فلسفه"},
+		{"Lycée", "lycee", "LYCÉE", "Lycee"},
+		{"Mathématiques", "mathematiques", "MATHÉMATIQUES"},
+		{"Éducation Islamique", "education islamique", "EDUCATION ISLAMIQUE"},
+		{"Économie et Management", "economie et management"},
+		{"Génie Électrique", "genie electrique"},
+		{"Chaînes YouTube", "chaines youtube"},
+		{"Histoire et Géographie", "histoire et geographie"},
+		{"l'histoire", "l’histoire", "histoire"},
+		{"Sciences de la Nature et de la Vie", "sciences de la nature et de la vie"},
+		{"٢٠٢٤", "۲۰۲۴", "2024"},
+	}
+	for _, group := range groups {
+		want := normalizeSearchText(group[0])
+		if want == "" {
+			t.Errorf("%q normalises to nothing", group[0])
+		}
+		for _, text := range group[1:] {
+			if got := normalizeSearchText(text); got != want {
+				t.Errorf("normalizeSearchText(%q) = %q, want %q as for %q", text, got, want, group[0])
+			}
+		}
+	}
+}
+
+func TestNormalizeSearchText(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"الرياضيات", "رياضيات"},
+		{"والحياة", "حياه"},
+		{"بالعربية", "عربيه"},
+		// The article stays when too little would be left.
+		{"الم", "الم"},
+		{"وال", "وال"},
+		{"Lycée", "lycee"},
+		{"Cœur", "coeur"},
+		{"L'Année 2", "annee 2"},
+		{"Exercices + Corrigés (2024)", "exercices corriges 2024"},
+	}
+	for _, tt := range tests {
+		if got := normalizeSearchText(tt.text); got != tt.want {
+			t.Errorf("normalizeSearchText(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"", "abc", 3},
+		{"abc", "abc", 0},
+		{"kitten", "sitting", 3},
+		{"chimie", "chimei", 1}, // adjacent swap counts once
+		{"physique", "phisique", 1},
+		{"رياضيات", "رياضيت", 1},
+		{"فيزياء", "فزياء", 1},
+	}
+	for _, tt := range tests {
+		if got := editDistance([]rune(tt.a), []rune(tt.b)); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := editDistance([]rune(tt.b), []rune(tt.a)); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tt.b, tt.a, got, tt.want)
+		}
+	}
+}
+
+func TestTypoDistance(t *testing.T) {
+	tests := []struct {
+		word, term string
+		distance   int
+		ok         bool
+	}{
+		// Under four letters no typo is tolerated.
+		{"bac", "bag", 0, false},
+		{"svt", "svt", 0, false},
+		// Four to seven letters: one edit.
+		{"chimei", "chimie", 1, true},
+		{"fisique", "physique", 0, false},
+		{"فزياء", "فيزياء", 1, true},
+		{"abcd", "abxy", 0, false},
+		// Eight letters and more: two edits.
+		{"phisique", "physique", 1, true},
+		{"matematiqes", "mathematiques", 2, true},
+		{"matematikes", "mathematiques", 0, false},
+		// A word is compared with the start of longer terms too.
+		{"mathematik", "mathematiques", 1, true},
+		{"رياضيت", "رياضيات", 1, true},
+		// Terms much shorter than the word are skipped.
+		{"philosophie", "philo", 0, false},
+	}
+	for _, tt := range tests {
+		distance, ok := typoDistance([]rune(tt.word), []rune(tt.term))
+		if ok != tt.ok || ok && distance != tt.distance {
+			t.Errorf("typoDistance(%q, %q) = %d, %v, want %d, %v", tt.word, tt.term, distance, ok, tt.distance, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========== PAGINATION ==========
+//
+// List endpoints answer with a Page. They take:
+//
+//	limit, offset   the page, limit defaulting to defaultPageLimit
+//	sort, order     one of the endpoint's sort fields, asc or desc
+//	...             the endpoint's filters, e.g. category_id or from/to
+//
+// Rows of equal sort value are ordered by id so that pages never overlap.
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 200
+	// Dates of the from/to filters; to includes the whole day.
+	filterDateLayout = "2006-01-02"
+)
+
+type Page struct {
+	Items   any    `json:"items"`
+	Total   int    `json:"total"`
+	Limit   int    `json:"limit"`
+	Offset  int    `json:"offset"`
+	HasMore bool   `json:"has_more"`
+	Sort    string `json:"sort"`
+	Order   string `json:"order"`
+}
+
+// listQuery gathers the filters, sort and page of a list request. Invalid
+// parameters are recorded in err so that handlers check once, after adding
+// their filters.
+type listQuery struct {
+	c       *gin.Context
+	conds   []string
+	args    []any
+	filters []string // the filter parameters applied, as param=value
+	sort    string
+	order   string
+	column  string
+	limit   int
+	offset  int
+	err     error
+}
+
+// newListQuery reads the page and sort of the request. sorts maps the sort
+// fields to their SQL expressions.
+func newListQuery(c *gin.Context, sorts map[string]string, defaultSort, defaultOrder string) *listQuery {
+	q := &listQuery{c: c, limit: defaultPageLimit}
+
+	q.sort = c.DefaultQuery("sort", defaultSort)
+	column, ok := sorts[q.sort]
+	if !ok {
+		fields := make([]string, 0, len(sorts))
+		for field := range sorts {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		q.fail("sort must be one of " + strings.Join(fields, ", "))
+	}
+	q.column = column
+
+	q.order = strings.ToLower(c.DefaultQuery("order", defaultOrder))
+	if q.order != "asc" && q.order != "desc" {
+		q.fail("order must be asc or desc")
+	}
+
+	if value := c.Query("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			q.fail(fmt.Sprintf("limit must be between 1 and %d", maxPageLimit))
+		}
+		q.limit = limit
+	}
+	if value := c.Query("offset"); value != "" {
+		offset, err := strconv.Atoi(value)
+		if err != nil || offset < 0 {
+			q.fail("offset must be a non-negative number")
+		}
+		q.offset = offset
+	}
+	return q
+}
+
+func (q *listQuery) fail(msg string) {
+	if q.err == nil {
+		q.err = errors.New(msg)
+	}
+}
+
+// where keeps the rows matching cond.
+func (q *listQuery) where(cond string, args ...any) {
+	q.conds = append(q.conds, cond)
+	q.args = append(q.args, args...)
+}
+
+// intFilter keeps the rows matching cond when the id parameter is given.
+func (q *listQuery) intFilter(param, cond string) {
+	value := q.c.Query(param)
+	if value == "" {
+		return
+	}
+	id, err := strconv.Atoi(value)
+	if err != nil {
+		q.fail("Invalid " + param)
+		return
+	}
+	q.where(cond, id)
+	q.filters = append(q.filters, param+"="+strconv.Itoa(id))
+}
+
+// dateFilter keeps the rows whose column lies between the from and to dates.
+func (q *listQuery) dateFilter(column string) {
+	bounds := []struct {
+		param string
+		op    string
+		days  int
+	}{
+		{"from", ">=", 0},
+		{"to", "<", 1},
+	}
+	for _, bound := range bounds {
+		value := q.c.Query(bound.param)
+		if value == "" {
+			continue
+		}
+		day, err := time.Parse(filterDateLayout, value)
+		if err != nil {
+			q.fail(bound.param + " must be a date like 2024-09-30")
+			continue
+		}
+		q.where(column+" "+bound.op+" ?", day.AddDate(0, 0, bound.days).Format("2006-01-02 15:04:05"))
+		q.filters = append(q.filters, bound.param+"="+day.Format(filterDateLayout))
+	}
+}
+
+// cacheKey names the page and filters in their validated form, so that
+// parameters the list ignores do not make new cache entries.
+func (q *listQuery) cacheKey() string {
+	return strings.Join(append([]string{
+		"sort=" + q.sort,
+		"order=" + q.order,
+		"limit=" + strconv.Itoa(q.limit),
+		"offset=" + strconv.Itoa(q.offset),
+	}, q.filters...), "&")
+}
+
+func (q *listQuery) whereClause() string {
+	if len(q.conds) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(q.conds, " AND ")
+}
+
+// count returns the number of rows matching the filters.
+func (q *listQuery) count(from string) (int, error) {
+	var total int
+	err := db.QueryRow("SELECT COUNT(*) "+from+q.whereClause(), q.args...).Scan(&total)
+	return total, err
+}
+
+// rows loads the requested page, id breaking ties in the sort.
+func (q *listQuery) rows(columns, from, id string) (*sql.Rows, error) {
+	query := "SELECT " + columns + " " + from + q.whereClause() +
+		" ORDER BY " + q.column + " " + q.order + ", " + id + " " + q.order + " LIMIT ? OFFSET ?"
+	return db.Query(query, append(q.args, q.limit, q.offset)...)
+}
+
+func (q *listQuery) page(items any, total int) Page {
+	return Page{
+		Items:   items,
+		Total:   total,
+		Limit:   q.limit,
+		Offset:  q.offset,
+		HasMore: q.offset+q.limit < total,
+		Sort:    q.sort,
+		Order:   q.order,
+	}
+}
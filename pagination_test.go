@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+var testSorts = map[string]string{"created_at": "d.created_at", "title": "d.title"}
+
+func testListQuery(query string) *listQuery {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/?"+query, nil)
+	q := newListQuery(c, testSorts, "created_at", "desc")
+	q.intFilter("category_id", "d.category_id = ?")
+	q.dateFilter("d.created_at")
+	return q
+}
+
+func TestListQueryParams(t *testing.T) {
+	tests := []struct {
+		query  string
+		ok     bool
+		limit  int
+		offset int
+		sort   string
+		order  string
+	}{
+		{"", true, defaultPageLimit, 0, "created_at", "desc"},
+		{"limit=1&offset=10", true, 1, 10, "created_at", "desc"},
+		{"limit=200", true, maxPageLimit, 0, "created_at", "desc"},
+		{"limit=201", false, 0, 0, "", ""},
+		{"limit=0", false, 0, 0, "", ""},
+		{"limit=-5", false, 0, 0, "", ""},
+		{"limit=abc", false, 0, 0, "", ""},
+		{"offset=-1", false, 0, 0, "", ""},
+		{"offset=1e3", false, 0, 0, "", ""},
+		{"sort=title&order=ASC", true, defaultPageLimit, 0, "title", "asc"},
+		{"sort=file_path", false, 0, 0, "", ""},
+		{"sort=title%3BDROP%20TABLE%20documents", false, 0, 0, "", ""},
+		{"order=sideways", false, 0, 0, "", ""},
+		{"category_id=3", true, defaultPageLimit, 0, "created_at", "desc"},
+		{"category_id=x", false, 0, 0, "", ""},
+		{"from=2024-09-01&to=2024-09-30", true, defaultPageLimit, 0, "created_at", "desc"},
+		{"from=01/09/2024", false, 0, 0, "", ""},
+		{"to=2024-13-01", false, 0, 0, "", ""},
+	}
+	for _, tt := range tests {
+		q := testListQuery(tt.query)
+		if (q.err == nil) != tt.ok {
+			t.Errorf("%q: err = %v, want ok = %v", tt.query, q.err, tt.ok)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if q.limit != tt.limit || q.offset != tt.offset || q.sort != tt.sort || q.order != tt.order {
+			t.Errorf("%q: limit %d offset %d sort %s %s, want %d %d %s %s",
+				tt.query, q.limit, q.offset, q.sort, q.order, tt.limit, tt.offset, tt.sort, tt.order)
+		}
+	}
+}
+
+func TestListQueryFilters(t *testing.T) {
+	q := testListQuery("category_id=3&from=2024-09-01&to=2024-09-30")
+	if got, want := q.whereClause(), " WHERE d.category_id = ? AND d.created_at >= ? AND d.created_at < ?"; got != want {
+		t.Errorf("where = %q, want %q", got, want)
+	}
+	// to includes the whole day.
+	want := []any{3, "2024-09-01 00:00:00", "2024-10-01 00:00:00"}
+	if len(q.args) != len(want) {
+		t.Fatalf("args = %v, want %v", q.args, want)
+	}
+	for i := range want {
+		if q.args[i] != want[i] {
+			t.Errorf("args = %v, want %v", q.args, want)
+			break
+		}
+	}
+}
+
+func TestListQueryCacheKey(t *testing.T) {
+	same := []string{
+		"category_id=1",
+		"category_id=01&utm_source=x",
+		"order=DESC&category_id=1&limit=50",
+		"offset=0&sort=created_at&category_id=1",
+	}
+	want := testListQuery(same[0]).cacheKey()
+	for _, query := range same[1:] {
+		if got := testListQuery(query).cacheKey(); got != want {
+			t.Errorf("%q: key %q, want %q", query, got, want)
+		}
+	}
+	for _, query := range []string{"category_id=2", "offset=50&category_id=1", "category_id=1&from=2024-09-01"} {
+		if got := testListQuery(query).cacheKey(); got == want {
+			t.Errorf("%q shares the key of %q", query, same[0])
+		}
+	}
+}
+
+func TestListQueryPage(t *testing.T) {
+	tests := []struct {
+		query   string
+		total   int
+		hasMore bool
+	}{
+		{"limit=10", 0, false},
+		{"limit=10", 10, false},
+		{"limit=10", 11, true},
+		{"limit=10&offset=10", 20, false},
+		{"limit=10&offset=10", 21, true},
+		{"limit=10&offset=30", 21, false},
+	}
+	for _, tt := range tests {
+		page := testListQuery(tt.query).page(nil, tt.total)
+		if page.HasMore != tt.hasMore || page.Total != tt.total {
+			t.Errorf("%q of %d: has_more = %v, want %v", tt.query, tt.total, page.HasMore, tt.hasMore)
+		}
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========== RESUMABLE UPLOADS ==========
+//
+// Large files can be sent in chunks that survive dropped connections, in the
+// style of the tus protocol:
+//
+//	POST   /api/admin/uploads      declare the file and its metadata
+//	HEAD   /api/admin/uploads/:id  Upload-Offset says how much arrived
+//	PATCH  /api/admin/uploads/:id  append bytes at Upload-Offset
+//	DELETE /api/admin/uploads/:id  abandon the upload
+//
+// Chunks are assembled in UPLOAD_TMP_DIR (default: the system temp dir). When
+// the last byte arrives the file is published exactly like a form upload.
+// Uploads untouched for uploadSessionTTL are discarded.
+
+const uploadSessionTTL = 24 * time.Hour
+
+type UploadSession struct {
+	ID         string `json:"id"`
+	SubjectID  int    `json:"subject_id"`
+	CategoryID int    `json:"category_id"`
+	Title      string `json:"title"`
+	FileName   string `json:"file_name"`
+	Size       int64  `json:"size"`
+	Offset     int64  `json:"offset"`
+	DocumentID *int64 `json:"document_id"`
+	ExpiresAt  int64  `json:"expires_at"`
+	adminID    int
+}
+
+func uploadTmpDir() string {
+	if dir := os.Getenv("UPLOAD_TMP_DIR"); dir != "" {
+		return dir
+	}
+	return filepath.Join(os.TempDir(), "studydz-uploads")
+}
+
+func partPath(id string) string {
+	return filepath.Join(uploadTmpDir(), id+".part")
+}
+
+// uploadLocks keeps two requests from writing the same upload at once.
+var uploadLocks sync.Map
+
+func lockUpload(id string) (unlock func(), ok bool) {
+	value, _ := uploadLocks.LoadOrStore(id, &sync.Mutex{})
+	mu := value.(*sync.Mutex)
+	if !mu.TryLock() {
+		return nil, false
+	}
+	return mu.Unlock, true
+}
+
+func loadUploadSession(c *gin.Context) (UploadSession, bool) {
+	var s UploadSession
+	err := db.QueryRow(`SELECT id, admin_id, subject_id, category_id, title, file_name, upload_length, upload_offset,
+                               document_id, expires_at
+                        FROM upload_sessions WHERE id = ? AND expires_at > ?`, c.Param("id"), timeNow().Unix()).
+		Scan(&s.ID, &s.adminID, &s.SubjectID, &s.CategoryID, &s.Title, &s.FileName, &s.Size, &s.Offset,
+			&s.DocumentID, &s.ExpiresAt)
+	if err == nil && s.adminID != currentAdmin(c).ID {
+		err = sql.ErrNoRows
+	}
+	if err == sql.ErrNoRows {
+		c.JSON(404, gin.H{"error": "Upload not found"})
+		return s, false
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return s, false
+	}
+	return s, true
+}
+
+func setUploadHeaders(c *gin.Context, s UploadSession) {
+	c.Header("Upload-Offset", strconv.FormatInt(s.Offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(s.Size, 10))
+	c.Header("Cache-Control", "no-store")
+}
+
+func discardUpload(id string) {
+	if err := os.Remove(partPath(id)); err != nil && !os.IsNotExist(err) {
+		log.Printf("⚠️  Could not remove upload part %s: %v", id, err)
+	}
+	db.Exec("DELETE FROM upload_sessions WHERE id = ?", id)
+	uploadLocks.Delete(id)
+}
+
+// ========== RESUMABLE UPLOAD HANDLERS ==========
+
+func CreateUpload(c *gin.Context) {
+	var req struct {
+		SubjectID  int    `json:"subject_id"`
+		CategoryID int    `json:"category_id"`
+		Title      string `json:"title"`
+		FileName   string `json:"file_name"`
+		Size       int64  `json:"size"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Size <= 0 || req.FileName == "" {
+		c.JSON(400, gin.H{"error": "file_name and a positive size are required"})
+		return
+	}
+	if !authorize(c, RoleUploader, subjectScope, req.SubjectID) {
+		return
+	}
+
+	// Refuse what publishing would refuse before any byte is sent.
+	var live bool
+	err := db.QueryRow("SELECT deleted_at IS NULL FROM categories WHERE id = ?", req.CategoryID).Scan(&live)
+	if err == sql.ErrNoRows {
+		c.JSON(400, gin.H{"error": "Unknown subject or category"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if !live {
+		c.JSON(404, gin.H{"error": "Category not found"})
+		return
+	}
+	limit, err := uploadLimit(req.CategoryID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Size > limit {
+		c.JSON(413, gin.H{"error": "File is too large", "max_bytes": limit})
+		return
+	}
+	name := sanitizeFileName(req.FileName)
+	if ext := filepath.Ext(name); !allowedExtension(ext) {
+		c.JSON(415, gin.H{"error": fmt.Sprintf("Files of type %q are not allowed", ext)})
+		return
+	}
+
+	id, err := newSessionToken()
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	expiresAt := timeNow().Add(uploadSessionTTL).Unix()
+	_, err = db.Exec(`INSERT INTO upload_sessions (id, admin_id, subject_id, category_id, title, file_name, upload_length, expires_at)
+                      VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		id, currentAdmin(c).ID, req.SubjectID, req.CategoryID, req.Title, name, req.Size, expiresAt)
+	if isForeignKeyError(err) {
+		c.JSON(400, gin.H{"error": "Unknown subject or category"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	session := UploadSession{ID: id, SubjectID: req.SubjectID, CategoryID: req.CategoryID, Title: req.Title,
+		FileName: name, Size: req.Size, ExpiresAt: expiresAt}
+	setUploadHeaders(c, session)
+	c.Header("Location", "/api/admin/uploads/"+id)
+	c.JSON(201, session)
+}
+
+func HeadUpload(c *gin.Context) {
+	session, ok := loadUploadSession(c)
+	if !ok {
+		return
+	}
+	setUploadHeaders(c, session)
+	c.Status(200)
+}
+
+func GetUpload(c *gin.Context) {
+	session, ok := loadUploadSession(c)
+	if !ok {
+		return
+	}
+	setUploadHeaders(c, session)
+	c.JSON(200, session)
+}
+
+// PatchUpload appends the request body at Upload-Offset. Whatever arrives
+// before a connection drops is kept, so the client resumes from the offset
+// reported by HEAD.
+func PatchUpload(c *gin.Context) {
+	session, ok := loadUploadSession(c)
+	if !ok {
+		return
+	}
+	unlock, ok := lockUpload(session.ID)
+	if !ok {
+		c.JSON(409, gin.H{"error": "Another request is writing this upload"})
+		return
+	}
+	defer unlock()
+
+	// Reload under the lock: the offset may have moved since.
+	if session, ok = loadUploadSession(c); !ok {
+		return
+	}
+	setUploadHeaders(c, session)
+	if session.DocumentID != nil {
+		c.JSON(409, gin.H{"error": "Upload already completed", "document_id": *session.DocumentID})
+		return
+	}
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset != session.Offset {
+		c.JSON(409, gin.H{"error": "Upload-Offset does not match the received length", "offset": session.Offset})
+		return
+	}
+	if c.Request.ContentLength > session.Size-session.Offset {
+		c.JSON(413, gin.H{"error": "Chunk goes past the declared upload length", "offset": session.Offset})
+		return
+	}
+
+	written, err := appendChunk(session, c.Request.Body)
+	session.Offset += written
+	expiresAt := timeNow().Add(uploadSessionTTL).Unix()
+	if _, dbErr := db.Exec("UPDATE upload_sessions SET upload_offset = ?, expires_at = ? WHERE id = ?",
+		session.Offset, expiresAt, session.ID); dbErr != nil && err == nil {
+		err = dbErr
+	}
+	setUploadHeaders(c, session)
+	if errors.Is(err, errChunkTooLarge) {
+		c.JSON(413, gin.H{"error": "Chunk goes past the declared upload length", "offset": session.Offset})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error(), "offset": session.Offset})
+		return
+	}
+
+	if session.Offset < session.Size {
+		c.JSON(200, gin.H{"offset": session.Offset, "size": session.Size})
+		return
+	}
+	finishUpload(c, session)
+}
+
+var errChunkTooLarge = errors.New("chunk past upload length")
+
+// appendChunk writes body at the session offset and returns how many bytes it
+// kept. A body going past the declared length is dropped entirely.
+func appendChunk(session UploadSession, body io.Reader) (int64, error) {
+	if err := os.MkdirAll(uploadTmpDir(), 0700); err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(partPath(session.ID), os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	// Drop bytes written after the last recorded offset, e.g. before a crash.
+	if err := f.Truncate(session.Offset); err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(session.Offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	written, err := io.Copy(f, io.LimitReader(body, session.Size-session.Offset))
+	if err != nil {
+		return written, err
+	}
+	if n, _ := body.Read(make([]byte, 1)); n > 0 {
+		return 0, errors.Join(errChunkTooLarge, f.Truncate(session.Offset))
+	}
+	return written, f.Sync()
+}
+
+func finishUpload(c *gin.Context, session UploadSession) {
+	// The subject may have gone to the trash, or the grant been revoked, since
+	// the upload was declared.
+	if err := checkAccess(c, RoleUploader, subjectScope, session.SubjectID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) || errors.Is(err, errForbidden) {
+			discardUpload(session.ID)
+		}
+		denyAccess(c, err)
+		return
+	}
+
+	part := partPath(session.ID)
+	file := incomingFile{
+		Name: session.FileName,
+		Size: session.Size,
+		Open: func() (io.ReadCloser, error) { return os.Open(part) },
+	}
+	published, err := publishDocument(session.SubjectID, session.CategoryID, session.Title, file, session.adminID)
+	if err != nil {
+		var rejected *uploadRejection
+		if errors.As(err, &rejected) {
+			discardUpload(session.ID)
+		}
+		respondUploadError(c, err)
+		return
+	}
+
+	// The session stays until it expires so a client that lost this answer
+	// can still learn the document id.
+	db.Exec("UPDATE upload_sessions SET document_id = ? WHERE id = ?", published.ID, session.ID)
+	os.Remove(part)
+
+	response := gin.H{"message": "File uploaded successfully", "document_id": published.ID, "checksum": published.Checksum,
+		"offset": session.Offset, "size": session.Size}
+	if published.Duplicate != nil {
+		response["duplicate"] = published.Duplicate
+	}
+	c.JSON(200, response)
+}
+
+func AbortUpload(c *gin.Context) {
+	session, ok := loadUploadSession(c)
+	if !ok {
+		return
+	}
+	unlock, ok := lockUpload(session.ID)
+	if !ok {
+		c.JSON(409, gin.H{"error": "Another request is writing this upload"})
+		return
+	}
+	// Discard under the lock so that no chunk lands in a session being removed.
+	discardUpload(session.ID)
+	unlock()
+	c.Status(204)
+}
+
+// ========== EXPIRY ==========
+
+func purgeExpiredUploads() {
+	rows, err := db.Query("SELECT id FROM upload_sessions WHERE expires_at <= ?", timeNow().Unix())
+	if err != nil {
+		log.Printf("⚠️  Could not list expired uploads: %v", err)
+		return
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if rows.Scan(&id) == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	discarded := 0
+	for _, id := range ids {
+		// A chunk being written extends the session; it is looked at again
+		// next time.
+		unlock, ok := lockUpload(id)
+		if !ok {
+			continue
+		}
+		discardUpload(id)
+		unlock()
+		discarded++
+	}
+	if discarded > 0 {
+		log.Printf("🧹 Discarded %d expired uploads", discarded)
+	}
+}
+
+func startUploadJanitor() {
+	go func() {
+		for {
+			purgeExpiredUploads()
+			time.Sleep(time.Hour)
+		}
+	}()
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// patchUpload sends a chunk of an upload at offset.
+func patchUpload(location, token string, offset int, chunk string) *httptest.ResponseRecorder {
+	req := testRequest("PATCH", location, token, strings.NewReader(chunk))
+	req.Header.Set("Upload-Offset", strconv.Itoa(offset))
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	return serve(req)
+}
+
+// createTestUpload declares an upload of a file of size bytes and returns its
+// location.
+func createTestUpload(t *testing.T, token, fileName string, size int) string {
+	t.Helper()
+	w := serve(testRequest("POST", "/api/admin/uploads", token, map[string]any{
+		"subject_id": 1, "category_id": 1, "title": "Cours", "file_name": fileName, "size": size,
+	}))
+	if w.Code != 201 || w.Header().Get("Upload-Offset") != "0" {
+		t.Fatalf("create upload: %d %s", w.Code, w.Body)
+	}
+	return w.Header().Get("Location")
+}
+
+func TestResumableUpload(t *testing.T) {
+	openTestDB(t)
+	seedTestData(t)
+	useTestStorage(t)
+	t.Setenv("UPLOAD_TMP_DIR", t.TempDir())
+	_, token := addTestAdmin(t, "uploader", RoleUploader, nil, nil, intPtr(1))
+	_, other := addTestAdmin(t, "other", RoleUploader, nil, nil, intPtr(1))
+	half := len(testPDF) / 2
+	location := createTestUpload(t, token, "cours.pdf", len(testPDF))
+
+	if w := patchUpload(location, token, 0, testPDF[:half]); w.Code != 200 || w.Header().Get("Upload-Offset") != strconv.Itoa(half) {
+		t.Fatalf("first chunk: %d, offset %s", w.Code, w.Header().Get("Upload-Offset"))
+	}
+	if w := serve(testRequest("HEAD", location, token, nil)); w.Header().Get("Upload-Offset") != strconv.Itoa(half) {
+		t.Errorf("HEAD offset = %s, want %d", w.Header().Get("Upload-Offset"), half)
+	}
+	if code := call(t, "GET", location, other, nil, nil); code != 404 {
+		t.Errorf("another admin's upload: %d, want 404", code)
+	}
+
+	// A resend from a stale offset and a chunk past the end change nothing.
+	if w := patchUpload(location, token, 0, testPDF[:half]); w.Code != 409 {
+		t.Errorf("stale offset: %d, want 409", w.Code)
+	}
+	if w := patchUpload(location, token, half, testPDF[half:]+"extra"); w.Code != 413 {
+		t.Errorf("chunk past the end: %d, want 413", w.Code)
+	}
+	var session UploadSession
+	call(t, "GET", location, token, nil, &session)
+	if session.Offset != int64(half) {
+		t.Errorf("offset after refused chunks = %d, want %d", session.Offset, half)
+	}
+
+	w := patchUpload(location, token, half, testPDF[half:])
+	var done struct {
+		DocumentID int64 `json:"document_id"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &done)
+	if w.Code != 200 || done.DocumentID == 0 {
+		t.Fatalf("last chunk: %d %s", w.Code, w.Body)
+	}
+	var title, path string
+	db.QueryRow("SELECT title, file_path FROM documents WHERE id = ?", done.DocumentID).Scan(&title, &path)
+	body, _, err := store.Get(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := io.ReadAll(body)
+	body.Close()
+	if title != "Cours" || string(stored) != testPDF {
+		t.Errorf("published %q with %d bytes", title, len(stored))
+	}
+	if _, err := os.Stat(partPath(session.ID)); !os.IsNotExist(err) {
+		t.Errorf("part file left after publishing: %v", err)
+	}
+	if w := patchUpload(location, token, len(testPDF), "x"); w.Code != 409 {
+		t.Errorf("patch after completion: %d, want 409", w.Code)
+	}
+}
+
+func TestResumableUploadValidation(t *testing.T) {
+	openTestDB(t)
+	seedTestData(t)
+	useTestStorage(t)
+	t.Setenv("UPLOAD_TMP_DIR", t.TempDir())
+	_, token := addTestAdmin(t, "uploader", RoleUploader, nil, nil, intPtr(1))
+	db.Exec("UPDATE categories SET max_upload_size = 100 WHERE id = 1")
+
+	tests := []struct {
+		subject  int
+		fileName string
+		size     int
+		status   int
+	}{
+		{1, "cours.pdf", 0, 400},
+		{1, "", 10, 400},
+		{1, "setup.exe", 10, 415},
+		{1, "cours.pdf", 101, 413},
+		{17, "cours.pdf", 10, 403},
+	}
+	for _, tt := range tests {
+		code := call(t, "POST", "/api/admin/uploads", token, map[string]any{
+			"subject_id": tt.subject, "category_id": 1, "file_name": tt.fileName, "size": tt.size,
+		}, nil)
+		if code != tt.status {
+			t.Errorf("%q of %d bytes in subject %d: %d, want %d", tt.fileName, tt.size, tt.subject, code, tt.status)
+		}
+	}
+
+	// So is a trashed category.
+	if err := trashNode("categories", 2); err != nil {
+		t.Fatal(err)
+	}
+	for category, status := range map[int]int{2: 404, 99: 400} {
+		code := call(t, "POST", "/api/admin/uploads", token, map[string]any{
+			"subject_id": 1, "category_id": category, "file_name": "cours.pdf", "size": 10,
+		}, nil)
+		if code != status {
+			t.Errorf("upload into category %d: %d, want %d", category, code, status)
+		}
+	}
+
+	// The content is sniffed once complete; a refused file ends the upload.
+	location := createTestUpload(t, token, "cours.pdf", 13)
+	if w := patchUpload(location, token, 0, "<html></html>"); w.Code != 415 {
+		t.Errorf("disguised file: %d, want 415", w.Code)
+	}
+	if code := call(t, "GET", location, token, nil, nil); code != 404 {
+		t.Errorf("refused upload still open: %d, want 404", code)
+	}
+
+	// So does a subject trashed while the file was on its way.
+	location = createTestUpload(t, token, "cours.pdf", len(testPDF))
+	if err := trashNode("subjects", 1); err != nil {
+		t.Fatal(err)
+	}
+	if w := patchUpload(location, token, 0, testPDF); w.Code != 404 {
+		t.Errorf("upload into a trashed subject: %d, want 404", w.Code)
+	}
+	if n := count(t, "SELECT COUNT(*) FROM upload_sessions"); n != 0 {
+		t.Errorf("%d upload sessions left", n)
+	}
+}
+
+func TestResumableUploadExpiry(t *testing.T) {
+	openTestDB(t)
+	seedTestData(t)
+	useTestStorage(t)
+	t.Setenv("UPLOAD_TMP_DIR", t.TempDir())
+	start := time.Date(2024, 9, 30, 10, 0, 0, 0, time.UTC)
+	setClock(t, start)
+	_, token := addTestAdmin(t, "uploader", RoleUploader, nil, nil, intPtr(1))
+	location := createTestUpload(t, token, "cours.pdf", len(testPDF))
+	id := location[strings.LastIndex(location, "/")+1:]
+
+	// Each chunk gives the upload another uploadSessionTTL.
+	setClock(t, start.Add(uploadSessionTTL-time.Minute))
+	if w := patchUpload(location, token, 0, testPDF[:10]); w.Code != 200 {
+		t.Fatalf("chunk before expiry: %d", w.Code)
+	}
+	setClock(t, start.Add(2*uploadSessionTTL-2*time.Minute))
+	purgeExpiredUploads()
+	if code := call(t, "GET", location, token, nil, nil); code != 200 {
+		t.Fatalf("upload touched within the TTL: %d, want 200", code)
+	}
+
+	setClock(t, start.Add(2*uploadSessionTTL))
+	if code := call(t, "GET", location, token, nil, nil); code != 404 {
+		t.Errorf("expired upload: %d, want 404", code)
+	}
+	purgeExpiredUploads()
+	if n := count(t, "SELECT COUNT(*) FROM upload_sessions WHERE id = ?", id); n != 0 {
+		t.Error("expired upload session kept")
+	}
+	if _, err := os.Stat(partPath(id)); !os.IsNotExist(err) {
+		t.Errorf("expired part file kept: %v", err)
+	}
+}
+
+func TestAbortUpload(t *testing.T) {
+	openTestDB(t)
+	seedTestData(t)
+	useTestStorage(t)
+	t.Setenv("UPLOAD_TMP_DIR", t.TempDir())
+	_, token := addTestAdmin(t, "uploader", RoleUploader, nil, nil, intPtr(1))
+	location := createTestUpload(t, token, "cours.pdf", len(testPDF))
+	id := location[strings.LastIndex(location, "/")+1:]
+	if w := patchUpload(location, token, 0, testPDF[:10]); w.Code != 200 {
+		t.Fatalf("chunk: %d", w.Code)
+	}
+
+	// An upload being written is not aborted under the writer.
+	unlock, ok := lockUpload(id)
+	if !ok {
+		t.Fatal("could not lock the upload")
+	}
+	if code := call(t, "DELETE", location, token, nil, nil); code != 409 {
+		t.Errorf("abort while writing: %d, want 409", code)
+	}
+	unlock()
+
+	if code := call(t, "DELETE", location, token, nil, nil); code != 204 {
+		t.Fatalf("abort: %d, want 204", code)
+	}
+	if code := call(t, "GET", location, token, nil, nil); code != 404 {
+		t.Errorf("aborted upload: %d, want 404", code)
+	}
+	if w := patchUpload(location, token, 10, testPDF[10:]); w.Code != 404 {
+		t.Errorf("chunk after abort: %d, want 404", w.Code)
+	}
+	if _, err := os.Stat(partPath(id)); !os.IsNotExist(err) {
+		t.Errorf("part file left after abort: %v", err)
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========== ROLES & GRANTS ==========
+
+const (
+	RoleSuperAdmin  = "super_admin"
+	RoleLevelEditor = "level_editor"
+	RoleUploader    = "uploader"
+)
+
+// roleRank orders roles so that a higher role implies the permissions of the
+// lower ones within the same scope.
+var roleRank = map[string]int{
+	RoleUploader:    1,
+	RoleLevelEditor: 2,
+	RoleSuperAdmin:  3,
+}
+
+// A Grant gives an admin a role over a scope. A grant with no level, year or
+// subject applies to the whole site.
+type Grant struct {
+	ID        int       `json:"id"`
+	AdminID   int       `json:"admin_id"`
+	Role      string    `json:"role"`
+	LevelID   *int      `json:"level_id"`
+	YearID    *int      `json:"year_id"`
+	SubjectID *int      `json:"subject_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// scope locates a node of the level/year/subject tree. Fields below the node
+// itself are zero, e.g. a year scope has no SubjectID.
+type scope struct {
+	LevelID   int
+	YearID    int
+	SubjectID int
+}
+
+func (g Grant) isGlobal() bool {
+	return g.LevelID == nil && g.YearID == nil && g.SubjectID == nil
+}
+
+func (g Grant) covers(s scope) bool {
+	switch {
+	case g.isGlobal():
+		return true
+	case g.LevelID != nil:
+		return *g.LevelID == s.LevelID
+	case g.YearID != nil:
+		return s.YearID != 0 && *g.YearID == s.YearID
+	default:
+		return s.SubjectID != 0 && *g.SubjectID == s.SubjectID
+	}
+}
+
+func loadGrants(adminID int) ([]Grant, error) {
+	rows, err := db.Query(`SELECT id, admin_id, role, level_id, year_id, subject_id, created_at
+                           FROM admin_grants WHERE admin_id = ? ORDER BY id`, adminID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	grants := []Grant{}
+	for rows.Next() {
+		var g Grant
+		if err := rows.Scan(&g.ID, &g.AdminID, &g.Role, &g.LevelID, &g.YearID, &g.SubjectID, &g.CreatedAt); err != nil {
+			return nil, err
+		}
+		grants = append(grants, g)
+	}
+	return grants, rows.Err()
+}
+
+func grantRole(adminID int, role string, levelID, yearID, subjectID *int) (int, error) {
+	result, err := db.Exec(`INSERT INTO admin_grants (admin_id, role, level_id, year_id, subject_id)
+                            VALUES (?, ?, ?, ?, ?)`, adminID, role, levelID, yearID, subjectID)
+	if err != nil {
+		return 0, err
+	}
+	id, _ := result.LastInsertId()
+	return int(id), nil
+}
+
+// ========== SCOPE RESOLUTION ==========
+
+func levelScope(levelID any) (scope, error) {
+	var s scope
+	err := db.QueryRow("SELECT id FROM levels WHERE id = ? AND deleted_at IS NULL", levelID).Scan(&s.LevelID)
+	return s, err
+}
+
+func yearScope(yearID any) (scope, error) {
+	var s scope
+	err := db.QueryRow("SELECT id, level_id FROM years WHERE id = ? AND deleted_at IS NULL", yearID).Scan(&s.YearID, &s.LevelID)
+	return s, err
+}
+
+func subjectScope(subjectID any) (scope, error) {
+	var s scope
+	err := db.QueryRow(`SELECT s.id, s.year_id, y.level_id
+                        FROM subjects s
+                        JOIN years y ON s.year_id = y.id
+                        WHERE s.id = ? AND s.deleted_at IS NULL`, subjectID).Scan(&s.SubjectID, &s.YearID, &s.LevelID)
+	return s, err
+}
+
+func documentScope(docID any) (scope, error) {
+	var subjectID int
+	if err := db.QueryRow("SELECT subject_id FROM documents WHERE id = ? AND deleted_at IS NULL", docID).Scan(&subjectID); err != nil {
+		return scope{}, err
+	}
+	return subjectScope(subjectID)
+}
+
+// ========== PERMISSION CHECKS ==========
+
+func currentGrants(c *gin.Context) ([]Grant, error) {
+	if grants, ok := c.Get("grants"); ok {
+		return grants.([]Grant), nil
+	}
+	grants, err := loadGrants(currentAdmin(c).ID)
+	if err != nil {
+		return nil, err
+	}
+	c.Set("grants", grants)
+	return grants, nil
+}
+
+func hasRole(grants []Grant, minRole string, s *scope) bool {
+	for _, g := range grants {
+		if roleRank[g.Role] < roleRank[minRole] {
+			continue
+		}
+		if s == nil && g.isGlobal() || s != nil && g.covers(*s) {
+			return true
+		}
+	}
+	return false
+}
+
+var errForbidden = errors.New("You do not have permission for this action")
+
+// checkAccess reports whether the caller holds at least minRole over the node
+// returned by resolve: sql.ErrNoRows when the node does not exist and
+// errForbidden when the caller lacks the role.
+func checkAccess(c *gin.Context, minRole string, resolve func(any) (scope, error), id any) error {
+	s, err := resolve(id)
+	if err != nil {
+		return err
+	}
+	grants, err := currentGrants(c)
+	if err != nil {
+		return err
+	}
+	if !hasRole(grants, minRole, &s) {
+		return errForbidden
+	}
+	return nil
+}
+
+// authorize is checkAccess writing a 404 or 403 response when access is
+// denied.
+func authorize(c *gin.Context, minRole string, resolve func(any) (scope, error), id any) bool {
+	err := checkAccess(c, minRole, resolve, id)
+	if err == nil {
+		return true
+	}
+	denyAccess(c, err)
+	return false
+}
+
+// denyAccess answers a checkAccess error.
+func denyAccess(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		c.AbortWithStatusJSON(404, gin.H{"error": "Not found"})
+	case errors.Is(err, errForbidden):
+		c.AbortWithStatusJSON(403, gin.H{"error": err.Error()})
+	default:
+		c.AbortWithStatusJSON(500, gin.H{"error": err.Error()})
+	}
+}
+
+// scopeColumns are the SQL conditions keeping the rows of a list that lie
+// within a level, year or subject, each taking its id.
+type scopeColumns struct {
+	level   string
+	year    string
+	subject string
+}
+
+// scopeFilter limits a list to the nodes the caller holds minRole over: no
+// condition for a site-wide grant, otherwise one per scoped grant. It answers
+// 403 and returns false when the caller holds minRole nowhere.
+func scopeFilter(c *gin.Context, minRole string, cols scopeColumns) (cond string, args []any, ok bool) {
+	grants, err := currentGrants(c)
+	if err != nil {
+		c.AbortWithStatusJSON(500, gin.H{"error": err.Error()})
+		return "", nil, false
+	}
+	var conds []string
+	for _, g := range grants {
+		if roleRank[g.Role] < roleRank[minRole] {
+			continue
+		}
+		switch {
+		case g.isGlobal():
+			return "", nil, true
+		case g.LevelID != nil:
+			conds, args = append(conds, cols.level), append(args, *g.LevelID)
+		case g.YearID != nil:
+			conds, args = append(conds, cols.year), append(args, *g.YearID)
+		default:
+			conds, args = append(conds, cols.subject), append(args, *g.SubjectID)
+		}
+	}
+	if len(conds) == 0 {
+		c.AbortWithStatusJSON(403, gin.H{"error": errForbidden.Error()})
+		return "", nil, false
+	}
+	return "(" + strings.Join(conds, " OR ") + ")", args, true
+}
+
+// RequireRole only lets through admins holding minRole site-wide.
+func RequireRole(minRole string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		grants, err := currentGrants(c)
+		if err != nil {
+			c.AbortWithStatusJSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		if !hasRole(grants, minRole, nil) {
+			c.AbortWithStatusJSON(403, gin.H{"error": "You do not have permission for this action"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// ========== USER MANAGEMENT HANDLERS ==========
+
+type AdminUser struct {
+	Admin
+	Grants []Grant `json:"grants"`
+}
+
+func GetAdminUsers(c *gin.Context) {
+	rows, err := db.Query("SELECT id, username, created_at FROM admins ORDER BY id")
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	var admins []Admin
+	for rows.Next() {
+		var a Admin
+		if err := rows.Scan(&a.ID, &a.Username, &a.CreatedAt); err != nil {
+			continue
+		}
+		admins = append(admins, a)
+	}
+	rows.Close()
+
+	users := []AdminUser{}
+	for _, a := range admins {
+		grants, err := loadGrants(a.ID)
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		users = append(users, AdminUser{Admin: a, Grants: grants})
+	}
+	c.JSON(200, users)
+}
+
+func CreateAdminUser(c *gin.Context) {
+	var input struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := c.BindJSON(&input); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	id, err := createAdmin(input.Username, input.Password)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(201, gin.H{"id": id, "username": input.Username})
+}
+
+func AssignRole(c *gin.Context) {
+	adminID := c.Param("id")
+	var grant Grant
+	if err := c.BindJSON(&grant); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, ok := roleRank[grant.Role]; !ok {
+		c.JSON(400, gin.H{"error": "Unknown role"})
+		return
+	}
+	scoped := 0
+	for _, id := range []*int{grant.LevelID, grant.YearID, grant.SubjectID} {
+		if id != nil {
+			scoped++
+		}
+	}
+	if scoped > 1 {
+		c.JSON(400, gin.H{"error": "A grant can be scoped to only one of level_id, year_id or subject_id"})
+		return
+	}
+	if grant.Role == RoleSuperAdmin && scoped > 0 {
+		c.JSON(400, gin.H{"error": "The super_admin role cannot be scoped"})
+		return
+	}
+
+	if err := db.QueryRow("SELECT id FROM admins WHERE id = ?", adminID).Scan(&grant.AdminID); err != nil {
+		c.JSON(404, gin.H{"error": "User not found"})
+		return
+	}
+	// The scope must be a live node; a trashed one would grant nothing.
+	for _, s := range []struct {
+		id       *int
+		resolve  func(any) (scope, error)
+		notFound string
+	}{
+		{grant.LevelID, levelScope, "Level not found"},
+		{grant.YearID, yearScope, "Year not found"},
+		{grant.SubjectID, subjectScope, "Subject not found"},
+	} {
+		if s.id == nil {
+			continue
+		}
+		if _, err := s.resolve(*s.id); errors.Is(err, sql.ErrNoRows) {
+			c.JSON(404, gin.H{"error": s.notFound})
+			return
+		} else if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	id, err := grantRole(grant.AdminID, grant.Role, grant.LevelID, grant.YearID, grant.SubjectID)
+	if isForeignKeyError(err) {
+		c.JSON(404, gin.H{"error": "User, level, year or subject not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	grant.ID = id
+	c.JSON(201, grant)
+}
+
+func RevokeRole(c *gin.Context) {
+	adminID := c.Param("id")
+	grantID := c.Param("grant_id")
+
+	var role string
+	err := db.QueryRow("SELECT role FROM admin_grants WHERE id = ? AND admin_id = ?", grantID, adminID).Scan(&role)
+	if err != nil {
+		c.JSON(404, gin.H{"error": "Grant not found"})
+		return
+	}
+
+	// Never remove the last site-wide super admin, or nobody could manage users.
+	if role == RoleSuperAdmin {
+		var remaining int
+		db.QueryRow("SELECT COUNT(*) FROM admin_grants WHERE role = ? AND id != ?", RoleSuperAdmin, grantID).Scan(&remaining)
+		if remaining == 0 {
+			c.JSON(409, gin.H{"error": "Cannot revoke the last super_admin grant"})
+			return
+		}
+	}
+
+	if _, err := db.Exec("DELETE FROM admin_grants WHERE id = ?", grantID); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"message": "Role revoked successfully"})
+}
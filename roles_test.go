@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func intPtr(v int) *int { return &v }
+
+func TestAuthRequired(t *testing.T) {
+	openTestDB(t)
+	_, token := addTestAdmin(t, "root", RoleSuperAdmin, nil, nil, nil)
+
+	tests := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"no session", "", 401},
+		{"unknown token", "0123456789abcdef", 401},
+		{"valid session", token, 200},
+	}
+	for _, tt := range tests {
+		if code := call(t, "GET", "/api/admin/me", tt.token, nil, nil); code != tt.status {
+			t.Errorf("%s: %d, want %d", tt.name, code, tt.status)
+		}
+	}
+
+	// The session cookie works like the bearer token.
+	req := testRequest("GET", "/api/admin/me", "", nil)
+	req.Header.Set("Cookie", sessionCookieName+"="+token)
+	if w := serve(req); w.Code != 200 {
+		t.Errorf("session cookie: %d, want 200", w.Code)
+	}
+
+	// An admin without any grant is signed in but may do nothing.
+	_, bare := addTestAdmin(t, "bare", "", nil, nil, nil)
+	if code := call(t, "GET", "/api/admin/me", bare, nil, nil); code != 200 {
+		t.Errorf("admin without grants on /me: %d, want 200", code)
+	}
+	if code := call(t, "GET", "/api/admin/subjects", bare, nil, nil); code != 403 {
+		t.Errorf("admin without grants on a list: %d, want 403", code)
+	}
+
+	if code := call(t, "POST", "/api/admin/logout", token, nil, nil); code != 200 {
+		t.Fatalf("logout: %d", code)
+	}
+	if code := call(t, "GET", "/api/admin/me", token, nil, nil); code != 401 {
+		t.Errorf("after logout: %d, want 401", code)
+	}
+}
+
+func TestScopedAccess(t *testing.T) {
+	openTestDB(t)
+	seedTestData(t)
+	useTestStorage(t)
+	// Subject 1 is in year 1 of level 1; subject 17 in year 2; year 6 in level 2.
+	_, uploader := addTestAdmin(t, "uploader", RoleUploader, nil, nil, intPtr(1))
+	_, editor := addTestAdmin(t, "editor", RoleLevelEditor, intPtr(1), nil, nil)
+	inScope, _ := addTestDocument(t, "cours", "%PDF-1.4 cours")
+	outOfScope, _ := addTestDocument(t, "autre", "%PDF-1.4 autre")
+	db.Exec("UPDATE documents SET subject_id = 17 WHERE id = ?", outOfScope)
+
+	year := map[string]any{"level_id": 1, "name": "Année 1", "name_ar": "السنة الأولى"}
+	moved := map[string]any{"level_id": 2, "name": "Année 1", "name_ar": "السنة الأولى"}
+	subject := map[string]any{"year_id": 1, "name": "Maths", "name_ar": "الرياضيات"}
+	level := map[string]any{"name": "Test", "name_ar": "اختبار", "color": "#000000"}
+
+	tests := []struct {
+		name, token, method, target string
+		body                        any
+		status                      int
+	}{
+		{"uploader creates a level", uploader, "POST", "/api/admin/levels", level, 403},
+		{"uploader edits their subject", uploader, "PUT", "/api/admin/subjects/1", subject, 403},
+		{"uploader deletes a document of another subject", uploader, "DELETE", fmt.Sprintf("/api/admin/documents/%d", outOfScope), nil, 403},
+		{"uploader deletes an unknown document", uploader, "DELETE", "/api/admin/documents/9999", nil, 404},
+		{"uploader deletes their document", uploader, "DELETE", fmt.Sprintf("/api/admin/documents/%d", inScope), nil, 200},
+		{"editor edits a year of their level", editor, "PUT", "/api/admin/years/1", year, 200},
+		{"editor edits a year of another level", editor, "PUT", "/api/admin/years/6", year, 403},
+		{"editor moves a year out of their level", editor, "PUT", "/api/admin/years/1", moved, 403},
+		{"editor edits a subject of their level", editor, "PUT", "/api/admin/subjects/17", map[string]any{"year_id": 2, "name": "Maths", "name_ar": "الرياضيات"}, 200},
+		{"editor creates a level", editor, "POST", "/api/admin/levels", level, 403},
+		{"editor reads the trash", editor, "GET", "/api/admin/trash", nil, 403},
+	}
+	for _, tt := range tests {
+		if code := call(t, tt.method, tt.target, tt.token, tt.body, nil); code != tt.status {
+			t.Errorf("%s: %d, want %d", tt.name, code, tt.status)
+		}
+	}
+}
+
+func TestScopedLists(t *testing.T) {
+	openTestDB(t)
+	seedTestData(t)
+	_, uploader := addTestAdmin(t, "uploader", RoleUploader, nil, nil, intPtr(1))
+	_, editor := addTestAdmin(t, "editor", RoleLevelEditor, nil, intPtr(2), nil)
+
+	var subjects struct {
+		Items []Subject `json:"items"`
+		Total int       `json:"total"`
+	}
+	call(t, "GET", "/api/admin/subjects", uploader, nil, &subjects)
+	if subjects.Total != 1 || len(subjects.Items) != 1 || subjects.Items[0].ID != 1 {
+		t.Errorf("uploader of subject 1 lists %d subjects: %+v", subjects.Total, subjects.Items)
+	}
+
+	var years []Year
+	call(t, "GET", "/api/admin/years", editor, nil, &years)
+	if len(years) != 1 || years[0].ID != 2 {
+		t.Errorf("editor of year 2 lists years %+v", years)
+	}
+	call(t, "GET", "/api/admin/subjects?limit=200", editor, nil, &subjects)
+	for _, s := range subjects.Items {
+		if s.YearID != 2 {
+			t.Errorf("editor of year 2 lists subject %d of year %d", s.ID, s.YearID)
+		}
+	}
+	if subjects.Total == 0 {
+		t.Error("editor of year 2 lists no subjects")
+	}
+}
+
+func TestUpdateTrashedNodes(t *testing.T) {
+	openTestDB(t)
+	seedTestData(t)
+	useTestStorage(t)
+	_, token := addTestAdmin(t, "root", RoleSuperAdmin, nil, nil, nil)
+	for _, node := range []struct {
+		entity string
+		id     int
+	}{{"levels", 4}, {"years", 2}, {"subjects", 1}, {"categories", 5}} {
+		if err := trashNode(node.entity, node.id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		target string
+		body   map[string]any
+	}{
+		{"/api/admin/levels/4", map[string]any{"name": "Université", "name_ar": "الجامعة", "color": "#06b6d4"}},
+		{"/api/admin/years/2", map[string]any{"level_id": 1, "name": "Année 2", "name_ar": "السنة الثانية"}},
+		{"/api/admin/subjects/1", map[string]any{"year_id": 1, "name": "Maths", "name_ar": "الرياضيات"}},
+		{"/api/admin/categories/5", map[string]any{"name": "Résumés", "name_ar": "ملخصات"}},
+		{"/api/admin/levels/99", map[string]any{"name": "x", "name_ar": "x", "color": "#000000"}},
+	}
+	for _, tt := range tests {
+		if code := call(t, "PUT", tt.target, token, tt.body, nil); code != 404 {
+			t.Errorf("PUT %s: %d, want 404", tt.target, code)
+		}
+	}
+	var name string
+	db.QueryRow("SELECT name FROM subjects WHERE id = 1").Scan(&name)
+	if name != "Mathématiques" {
+		t.Errorf("trashed subject renamed to %q", name)
+	}
+
+	if code := call(t, "PUT", "/api/admin/levels/1", token, map[string]any{"name": "Primaire", "name_ar": "ابتدائي", "color": "#ef4444"}, nil); code != 200 {
+		t.Errorf("PUT a live level: %d, want 200", code)
+	}
+}
+
+func TestAssignRole(t *testing.T) {
+	openTestDB(t)
+	seedTestData(t)
+	_, root := addTestAdmin(t, "root", RoleSuperAdmin, nil, nil, nil)
+	editorID, _ := addTestAdmin(t, "editor", "", nil, nil, nil)
+	if err := trashNode("years", 2); err != nil {
+		t.Fatal(err)
+	}
+	target := fmt.Sprintf("/api/admin/users/%d/grants", editorID)
+
+	tests := []struct {
+		name   string
+		target string
+		grant  map[string]any
+		status int
+	}{
+		{"level editor", target, map[string]any{"role": RoleLevelEditor, "level_id": 1}, 201},
+		{"uploader of a subject", target, map[string]any{"role": RoleUploader, "subject_id": 1}, 201},
+		{"unknown role", target, map[string]any{"role": "owner"}, 400},
+		{"two scopes", target, map[string]any{"role": RoleUploader, "level_id": 1, "year_id": 1}, 400},
+		{"scoped super admin", target, map[string]any{"role": RoleSuperAdmin, "level_id": 1}, 400},
+		{"unknown user", "/api/admin/users/999/grants", map[string]any{"role": RoleUploader}, 404},
+		{"unknown level", target, map[string]any{"role": RoleLevelEditor, "level_id": 999}, 404},
+		{"unknown year", target, map[string]any{"role": RoleLevelEditor, "year_id": 999}, 404},
+		{"unknown subject", target, map[string]any{"role": RoleUploader, "subject_id": 999}, 404},
+		{"trashed year", target, map[string]any{"role": RoleLevelEditor, "year_id": 2}, 404},
+		// Subject 17 went to the trash with year 2.
+		{"trashed subject", target, map[string]any{"role": RoleUploader, "subject_id": 17}, 404},
+	}
+	for _, tt := range tests {
+		if code := call(t, "POST", tt.target, root, tt.grant, nil); code != tt.status {
+			t.Errorf("%s: %d, want %d", tt.name, code, tt.status)
+		}
+	}
+	if n := count(t, "SELECT COUNT(*) FROM admin_grants WHERE admin_id = ?", editorID); n != 2 {
+		t.Errorf("%d grants, want 2", n)
+	}
+}
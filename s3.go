@@ -0,0 +1,365 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ========== S3 STORAGE ==========
+//
+// A minimal S3 client signing its requests with AWS Signature Version 4. It
+// talks to AWS as well as to S3-compatible services such as MinIO or R2.
+//
+//	S3_BUCKET              bucket name (required)
+//	S3_ACCESS_KEY_ID       credentials (required)
+//	S3_SECRET_ACCESS_KEY
+//	S3_REGION              default us-east-1
+//	S3_ENDPOINT            e.g. http://localhost:9000; default AWS for the region
+//	S3_PREFIX              optional prefix prepended to every key
+//	S3_PATH_STYLE          "true" for endpoint/bucket/key URLs; default true
+//	                       when S3_ENDPOINT is set, virtual-hosted otherwise
+
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+type s3Storage struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	prefix    string
+	accessKey string
+	secretKey string
+	pathStyle bool
+	client    *http.Client
+}
+
+func newS3StorageFromEnv() (*s3Storage, error) {
+	s := &s3Storage{
+		region:    os.Getenv("S3_REGION"),
+		bucket:    os.Getenv("S3_BUCKET"),
+		prefix:    strings.Trim(os.Getenv("S3_PREFIX"), "/"),
+		accessKey: os.Getenv("S3_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+		client:    &http.Client{},
+	}
+	if s.bucket == "" || s.accessKey == "" || s.secretKey == "" {
+		return nil, errors.New("S3 storage needs S3_BUCKET, S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY")
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+
+	endpoint := os.Getenv("S3_ENDPOINT")
+	s.pathStyle = endpoint != ""
+	if endpoint == "" {
+		endpoint = "https://s3." + s.region + ".amazonaws.com"
+	}
+	u, err := url.Parse(strings.TrimRight(endpoint, "/"))
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid S3_ENDPOINT %q", endpoint)
+	}
+	s.endpoint = u
+	if v := os.Getenv("S3_PATH_STYLE"); v != "" {
+		s.pathStyle, _ = strconv.ParseBool(v)
+	}
+	return s, nil
+}
+
+// objectPath returns the unescaped path of a key, including the bucket for
+// path-style requests.
+func (s *s3Storage) objectPath(key string) string {
+	p := cleanKey(key)
+	if s.prefix != "" {
+		p = s.prefix + "/" + p
+	}
+	if s.pathStyle {
+		return "/" + s.bucket + "/" + p
+	}
+	return "/" + p
+}
+
+func (s *s3Storage) newRequest(method, key string, body io.Reader) (*http.Request, error) {
+	u := *s.endpoint
+	if !s.pathStyle {
+		u.Host = s.bucket + "." + u.Host
+	}
+	u.Path = s.objectPath(key)
+	u.RawPath = awsEscapePath(u.Path)
+	return http.NewRequest(method, u.String(), body)
+}
+
+// do signs and sends a request, turning 404s into fs.ErrNotExist and other
+// non-2xx answers into errors carrying the S3 error body.
+func (s *s3Storage) do(req *http.Request, key string) (*http.Response, error) {
+	s.sign(req, unsignedPayload, timeNow())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("s3 %s %s: %w", req.Method, key, fs.ErrNotExist)
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return nil, fmt.Errorf("s3 %s %s: %s: %s", req.Method, key, resp.Status, strings.TrimSpace(string(msg)))
+}
+
+func (s *s3Storage) Put(key string, r io.Reader, size int64) error {
+	req, err := s.newRequest(http.MethodPut, key, r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		// A zero ContentLength with a body means unknown and would be sent
+		// chunked, which S3 refuses.
+		req.Body = http.NoBody
+	}
+	resp, err := s.do(req, key)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Storage) Get(key string) (io.ReadCloser, ObjectInfo, error) {
+	req, err := s.newRequest(http.MethodGet, key, nil)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	resp, err := s.do(req, key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	return resp.Body, objectInfoFrom(resp), nil
+}
+
+func (s *s3Storage) Stat(key string) (ObjectInfo, error) {
+	req, err := s.newRequest(http.MethodHead, key, nil)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	resp, err := s.do(req, key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	resp.Body.Close()
+	return objectInfoFrom(resp), nil
+}
+
+func (s *s3Storage) Delete(key string) error {
+	// S3 answers 204 whether or not the object existed; keep the local
+	// backend's contract of reporting missing files.
+	if _, err := s.Stat(key); err != nil {
+		return err
+	}
+	req, err := s.newRequest(http.MethodDelete, key, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req, key)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Move copies the object server-side and deletes the source; S3 has no rename.
+func (s *s3Storage) Move(src, dst string) error {
+	req, err := s.newRequest(http.MethodPut, dst, nil)
+	if err != nil {
+		return err
+	}
+	source := s.objectPath(src)
+	if !s.pathStyle {
+		source = "/" + s.bucket + source
+	}
+	req.Header.Set("X-Amz-Copy-Source", awsEscapePath(source))
+	resp, err := s.do(req, src)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return s.Delete(src)
+}
+
+// List pages through ListObjectsV2, 1000 keys at a time.
+func (s *s3Storage) List(prefix string, fn func(key string, info ObjectInfo) error) error {
+	fullPrefix := cleanKey(prefix)
+	if s.prefix != "" {
+		fullPrefix = s.prefix + "/" + fullPrefix
+	}
+	if strings.HasSuffix(prefix, "/") {
+		fullPrefix += "/"
+	}
+
+	token := ""
+	for {
+		u := *s.endpoint
+		u.Path = "/"
+		if s.pathStyle {
+			u.Path = "/" + s.bucket
+		} else {
+			u.Host = s.bucket + "." + u.Host
+		}
+		query := url.Values{"list-type": {"2"}, "prefix": {fullPrefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		// The query is sent exactly as it is signed.
+		u.RawQuery = canonicalQuery(query)
+		req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := s.do(req, prefix)
+		if err != nil {
+			return err
+		}
+		var page struct {
+			Contents []struct {
+				Key          string
+				Size         int64
+				LastModified time.Time
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("s3 list %s: %w", prefix, err)
+		}
+
+		for _, obj := range page.Contents {
+			key := obj.Key
+			if s.prefix != "" {
+				key = strings.TrimPrefix(key, s.prefix+"/")
+			}
+			if err := fn(key, ObjectInfo{Size: obj.Size, ModTime: obj.LastModified}); err != nil {
+				return err
+			}
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+func objectInfoFrom(resp *http.Response) ObjectInfo {
+	info := ObjectInfo{Size: resp.ContentLength}
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = t
+	}
+	return info
+}
+
+// ========== SIGNATURE V4 ==========
+
+// sign adds the SigV4 Authorization header. Host and the x-amz-* headers are
+// signed; the body is sent as payloadHash, usually UNSIGNED-PAYLOAD.
+func (s *s3Storage) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") || name == "range" {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	credentialScope := day + "/" + s.region + "/s3/aws4_request"
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + credentialScope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), day)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.accessKey+"/"+credentialScope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func canonicalQuery(values url.Values) string {
+	var pairs []string
+	for name, vs := range values {
+		for _, v := range vs {
+			pairs = append(pairs, awsEscape(name)+"="+awsEscape(v))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// awsEscape percent-encodes everything but the unreserved characters, as
+// SigV4 requires.
+func awsEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func awsEscapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		segments[i] = awsEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========== MALWARE SCANNING ==========
+//
+// Each uploaded version starts out "pending" and the document is hidden from
+// the public API until its current version is "clean". A background worker
+// scans pending files with the scanner chosen by SCANNER:
+//
+//	none   (default) every file is clean
+//	clamd  ClamAV's daemon at CLAMD_ADDRESS, e.g. tcp:localhost:3310 or
+//	       unix:/run/clamav/clamd.ctl
+//
+// Infected files move to quarantineDir and every version using them is
+// "rejected" with the scanner verdict. Files the scanner could not check stay
+// pending and are retried, waiting twice as long after each attempt. They are
+// "failed", with the error as verdict, after maxScanAttempts or as soon as the
+// scanner refuses them, e.g. past clamd's StreamMaxLength; an admin can then
+// queue them again.
+
+const (
+	scanPending  = "pending"
+	scanClean    = "clean"
+	scanRejected = "rejected"
+	scanFailed   = "failed"
+
+	quarantineDir = "quarantine"
+
+	// maxScanAttempts spans about four hours of retries.
+	maxScanAttempts = 8
+)
+
+// scanStatuses are the values of scan_status.
+var scanStatuses = []string{scanPending, scanClean, scanRejected, scanFailed}
+
+// errScanRefused is a scanner answering that it will not check a file, which
+// retrying does not change.
+var errScanRefused = errors.New("scanner refused the file")
+
+type Scanner interface {
+	// Scan reports whether r is infected and, if so, the signature found.
+	Scan(r io.Reader) (infected bool, verdict string, err error)
+}
+
+var scanner Scanner = noopScanner{}
+
+func openScanner() error {
+	switch kind := os.Getenv("SCANNER"); kind {
+	case "", "none":
+		scanner = noopScanner{}
+	case "clamd":
+		address := os.Getenv("CLAMD_ADDRESS")
+		if address == "" {
+			address = "tcp:localhost:3310"
+		}
+		network, addr, ok := strings.Cut(address, ":")
+		if !ok || (network != "tcp" && network != "unix") {
+			return fmt.Errorf("invalid CLAMD_ADDRESS %q", address)
+		}
+		scanner = &clamdScanner{network: network, address: addr, timeout: 2 * time.Minute}
+	default:
+		return fmt.Errorf("unknown SCANNER %q", kind)
+	}
+	return nil
+}
+
+type noopScanner struct{}
+
+func (noopScanner) Scan(r io.Reader) (bool, string, error) {
+	return false, "", nil
+}
+
+// ========== CLAMD ==========
+
+// clamdScanner streams files to clamd with the INSTREAM command: chunks
+// prefixed by their big-endian uint32 length, ended by a zero-length chunk.
+type clamdScanner struct {
+	network string
+	address string
+	timeout time.Duration
+}
+
+const clamdChunkSize = 64 << 10
+
+func (s *clamdScanner) Scan(r io.Reader) (bool, string, error) {
+	conn, err := net.DialTimeout(s.network, s.address, 10*time.Second)
+	if err != nil {
+		return false, "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(s.timeout))
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return false, "", err
+	}
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, readErr := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf[:4], uint32(n))
+			if _, err := conn.Write(buf[:4+n]); err != nil {
+				return false, "", err
+			}
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return false, "", readErr
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return false, "", err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return false, "", err
+	}
+	return parseClamdReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+// parseClamdReply reads answers such as "stream: OK" and
+// "stream: Eicar-Test-Signature FOUND".
+func parseClamdReply(reply string) (bool, string, error) {
+	result := strings.TrimSpace(strings.TrimPrefix(reply, "stream:"))
+	switch {
+	case result == "OK":
+		return false, "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return true, strings.TrimSuffix(result, " FOUND"), nil
+	case strings.HasSuffix(result, " ERROR"):
+		return false, "", fmt.Errorf("clamd: %s: %w", strings.TrimSuffix(result, " ERROR"), errScanRefused)
+	default:
+		return false, "", fmt.Errorf("clamd: %s", reply)
+	}
+}
+
+// ========== SCAN WORKER ==========
+
+var scanWakeup = make(chan struct{}, 1)
+
+// requestScan wakes the worker up after an upload instead of waiting for its
+// next round.
+func requestScan() {
+	select {
+	case scanWakeup <- struct{}{}:
+	default:
+	}
+}
+
+func startScanWorker() {
+	go func() {
+		for {
+			scanPendingFiles()
+			select {
+			case <-scanWakeup:
+			case <-time.After(time.Minute):
+			}
+		}
+	}()
+}
+
+// scanPendingFiles scans the pending files whose last failed attempt, if
+// any, is 2^attempts minutes old by timeNow.
+func scanPendingFiles() {
+	rows, err := db.Query(`SELECT DISTINCT file_path FROM document_versions
+                           WHERE scan_status = ?
+                             AND (scanned_at IS NULL OR scanned_at <= datetime(?, '-' || (1 << scan_attempts) || ' minutes'))`,
+		scanPending, currentTimestamp())
+	if err != nil {
+		log.Printf("⚠️  Could not list files to scan: %v", err)
+		return
+	}
+	var paths []string
+	for rows.Next() {
+		var p string
+		if rows.Scan(&p) == nil {
+			paths = append(paths, p)
+		}
+	}
+	rows.Close()
+
+	for _, p := range paths {
+		if err := scanFile(p); err != nil {
+			log.Printf("⚠️  Could not scan %s: %v", p, err)
+			if err := recordScanError(p, err); err != nil {
+				log.Printf("⚠️  Could not record the scan error of %s: %v", p, err)
+			}
+		}
+	}
+}
+
+func scanFile(key string) error {
+	body, _, err := store.Get(key)
+	if err != nil {
+		return err
+	}
+	infected, verdict, err := scanner.Scan(body)
+	body.Close()
+	if err != nil {
+		return err
+	}
+	if infected {
+		log.Printf("☣️  %s is infected: %s", key, verdict)
+		return quarantineFile(key, verdict)
+	}
+	return recordScan(key, key, scanClean, "")
+}
+
+// quarantineFile moves an infected file out of reach and rejects every version
+// that uses it.
+func quarantineFile(key, verdict string) error {
+	dst := path.Join(quarantineDir, path.Base(key))
+	if err := store.Move(key, dst); err != nil {
+		return err
+	}
+	if err := recordScan(key, dst, scanRejected, verdict); err != nil {
+		if moveErr := store.Move(dst, key); moveErr != nil {
+			log.Printf("⚠️  Could not move %s back: %v", key, moveErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// recordScan stores the result for the versions of key, now stored at
+// newKey, and mirrors it onto documents whose current version it is.
+func recordScan(key, newKey, status, verdict string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`UPDATE document_versions SET file_path = ?, scan_status = ?, scan_verdict = ?, scanned_at = ?
+                      WHERE file_path = ?`, newKey, status, verdict, currentTimestamp(), key)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE documents SET file_path = ?, scan_status = ?, scan_verdict = ?
+                      WHERE file_path = ?`, newKey, status, verdict, key)
+	if err != nil {
+		return err
+	}
+
+	// Documents appear in the public lists once clean.
+	rows, err := tx.Query("SELECT DISTINCT subject_id FROM documents WHERE file_path = ?", newKey)
+	if err != nil {
+		return err
+	}
+	var subjects []any
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		subjects = append(subjects, id)
+	}
+	rows.Close()
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if len(subjects) > 0 {
+		invalidateSubjectDocuments(subjects...)
+	}
+	return nil
+}
+
+// recordScanError counts a failed attempt at scanning key, and fails its
+// versions when the scanner refused the file or attempts ran out.
+func recordScanError(key string, scanErr error) error {
+	var attempts int
+	err := db.QueryRow("SELECT COALESCE(MAX(scan_attempts), 0) + 1 FROM document_versions WHERE file_path = ? AND scan_status = ?",
+		key, scanPending).Scan(&attempts)
+	if err != nil {
+		return err
+	}
+	if errors.Is(scanErr, errScanRefused) || attempts >= maxScanAttempts {
+		log.Printf("❌ Gave up scanning %s after %d attempts", key, attempts)
+		return recordScan(key, key, scanFailed, scanErr.Error())
+	}
+	_, err = db.Exec(`UPDATE document_versions SET scan_attempts = ?, scan_verdict = ?, scanned_at = ?
+                      WHERE file_path = ? AND scan_status = ?`, attempts, scanErr.Error(), currentTimestamp(), key, scanPending)
+	return err
+}
+
+type scanResult struct {
+	status  string
+	verdict string
+}
+
+// initialScan is the result a new version of file starts with: that of an
+// earlier scan of the same stored content, or pending.
+func initialScan(tx *sql.Tx, file storedFile) (scanResult, error) {
+	var scan scanResult
+	err := tx.QueryRow(`SELECT scan_status, scan_verdict FROM document_versions
+                        WHERE file_path = ? AND scan_status IN (?, ?) LIMIT 1`, file.Path, scanClean, scanRejected).
+		Scan(&scan.status, &scan.verdict)
+	if err == sql.ErrNoRows {
+		return scanResult{status: scanPending}, nil
+	}
+	return scan, err
+}
+
+// ========== SCAN HANDLERS ==========
+
+// RescanDocument queues the current file of a document whose scan failed
+// again, e.g. once clamd accepts larger streams.
+func RescanDocument(c *gin.Context) {
+	id := c.Param("id")
+	if !authorize(c, RoleUploader, documentScope, id) {
+		return
+	}
+
+	var key, status string
+	if err := db.QueryRow("SELECT file_path, scan_status FROM documents WHERE id = ?", id).Scan(&key, &status); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if status != scanFailed {
+		c.JSON(409, gin.H{"error": "Only failed scans can be retried", "scan_status": status})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`UPDATE document_versions SET scan_status = ?, scan_verdict = '', scan_attempts = 0, scanned_at = NULL
+                      WHERE file_path = ? AND scan_status = ?`, scanPending, key, scanFailed)
+	if err == nil {
+		_, err = tx.Exec("UPDATE documents SET scan_status = ?, scan_verdict = '' WHERE file_path = ? AND scan_status = ?",
+			scanPending, key, scanFailed)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	requestScan()
+	c.JSON(200, gin.H{"message": "Scan queued", "scan_status": scanPending})
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseClamdReply(t *testing.T) {
+	tests := []struct {
+		reply    string
+		infected bool
+		verdict  string
+		refused  bool
+		fails    bool
+	}{
+		{reply: "stream: OK"},
+		{reply: "stream: Eicar-Test-Signature FOUND", infected: true, verdict: "Eicar-Test-Signature"},
+		{reply: "stream: Win.Test.EICAR_HDB-1 FOUND", infected: true, verdict: "Win.Test.EICAR_HDB-1"},
+		{reply: "INSTREAM size limit exceeded. ERROR", refused: true, fails: true},
+		{reply: "UNKNOWN COMMAND", fails: true},
+		{reply: "", fails: true},
+	}
+	for _, tt := range tests {
+		infected, verdict, err := parseClamdReply(tt.reply)
+		if infected != tt.infected || verdict != tt.verdict || (err != nil) != tt.fails {
+			t.Errorf("parseClamdReply(%q) = %v, %q, %v", tt.reply, infected, verdict, err)
+		}
+		if refused := errors.Is(err, errScanRefused); refused != tt.refused {
+			t.Errorf("parseClamdReply(%q): refused = %v, want %v", tt.reply, refused, tt.refused)
+		}
+	}
+}
+
+// fakeClamd answers INSTREAM commands like clamd with a StreamMaxLength of
+// maxLength: infected when the stream contains "EICAR".
+func fakeClamd(t *testing.T, maxLength int) (address string, received chan []byte) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	received = make(chan []byte, 10)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				command := make([]byte, len("zINSTREAM\x00"))
+				if _, err := io.ReadFull(conn, command); err != nil || string(command) != "zINSTREAM\x00" {
+					conn.Write([]byte("UNKNOWN COMMAND\x00"))
+					return
+				}
+				var stream bytes.Buffer
+				for {
+					var size uint32
+					if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					if stream.Len()+int(size) > maxLength {
+						// clamd answers and hangs up without reading the rest.
+						conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+						return
+					}
+					if _, err := io.CopyN(&stream, conn, int64(size)); err != nil {
+						return
+					}
+				}
+				received <- stream.Bytes()
+				if bytes.Contains(stream.Bytes(), []byte("EICAR")) {
+					conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+				} else {
+					conn.Write([]byte("stream: OK\x00"))
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), received
+}
+
+func TestClamdScan(t *testing.T) {
+	address, received := fakeClamd(t, 3*clamdChunkSize)
+	s := &clamdScanner{network: "tcp", address: address, timeout: 10 * time.Second}
+
+	// Over two chunks, so the framing is exercised.
+	clean := strings.Repeat("a clean page ", 2*clamdChunkSize/13)
+	infected, verdict, err := s.Scan(strings.NewReader(clean))
+	if err != nil || infected || verdict != "" {
+		t.Fatalf("Scan(clean) = %v, %q, %v", infected, verdict, err)
+	}
+	if got := <-received; string(got) != clean {
+		t.Errorf("clamd received %d bytes, want the %d sent", len(got), len(clean))
+	}
+
+	infected, verdict, err = s.Scan(strings.NewReader("X5O!P%@AP[4\\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*"))
+	if err != nil || !infected || verdict != "Eicar-Test-Signature" {
+		t.Errorf("Scan(eicar) = %v, %q, %v", infected, verdict, err)
+	}
+	<-received
+
+	_, _, err = s.Scan(strings.NewReader(strings.Repeat("x", 4*clamdChunkSize)))
+	if !errors.Is(err, errScanRefused) {
+		t.Errorf("Scan(too large) error = %v, want errScanRefused", err)
+	}
+}
+
+type failingScanner struct {
+	err   error
+	calls int
+}
+
+func (s *failingScanner) Scan(r io.Reader) (bool, string, error) {
+	s.calls++
+	return false, "", s.err
+}
+
+func useTestScanner(t *testing.T, s Scanner) {
+	t.Helper()
+	saved := scanner
+	scanner = s
+	t.Cleanup(func() { scanner = saved })
+}
+
+func scanStatusOf(t *testing.T, docID int64) (status, verdict string, attempts int) {
+	t.Helper()
+	err := db.QueryRow(`SELECT d.scan_status, d.scan_verdict, v.scan_attempts
+                        FROM documents d JOIN document_versions v ON v.document_id = d.id AND v.version = d.current_version
+                        WHERE d.id = ?`, docID).Scan(&status, &verdict, &attempts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status, verdict, attempts
+}
+
+func TestScanRetriesAreCapped(t *testing.T) {
+	openTestDB(t)
+	seedTestData(t)
+	useTestStorage(t)
+	now := time.Unix(1234567890, 0)
+	setClock(t, now)
+	failing := &failingScanner{err: errors.New("connection refused")}
+	useTestScanner(t, failing)
+	docID, _ := addTestDocument(t, "cours", "%PDF-1.4 cours")
+
+	scanPendingFiles()
+	if status, _, attempts := scanStatusOf(t, docID); status != scanPending || attempts != 1 {
+		t.Fatalf("after one failure: %s, %d attempts", status, attempts)
+	}
+	// The next attempt waits 2 minutes.
+	setClock(t, now.Add(2*time.Minute-time.Second))
+	scanPendingFiles()
+	if failing.calls != 1 {
+		t.Fatalf("scanner called %d times right after a failure, want 1", failing.calls)
+	}
+	setClock(t, now.Add(2*time.Minute))
+	scanPendingFiles()
+	if failing.calls != 2 {
+		t.Fatalf("scanner called %d times after the backoff, want 2", failing.calls)
+	}
+
+	for i := 2; i < maxScanAttempts; i++ {
+		now = now.Add(24 * time.Hour)
+		setClock(t, now)
+		scanPendingFiles()
+	}
+	status, verdict, _ := scanStatusOf(t, docID)
+	if status != scanFailed || verdict != "connection refused" {
+		t.Fatalf("after %d failures: %s %q, want failed", maxScanAttempts, status, verdict)
+	}
+
+	// Failed files are left alone until an admin retries them.
+	setClock(t, now.Add(24*time.Hour))
+	scanPendingFiles()
+	if failing.calls != maxScanAttempts {
+		t.Errorf("scanner called %d times, want %d", failing.calls, maxScanAttempts)
+	}
+}
+
+func TestRefusedScanFailsAtOnce(t *testing.T) {
+	openTestDB(t)
+	seedTestData(t)
+	useTestStorage(t)
+	useTestScanner(t, &failingScanner{err: errScanRefused})
+	docID, key := addTestDocument(t, "gros", "%PDF-1.4 gros")
+
+	scanPendingFiles()
+	if status, _, attempts := scanStatusOf(t, docID); status != scanFailed || attempts != 0 {
+		t.Fatalf("refused file: %s after %d attempts, want failed", status, attempts)
+	}
+
+	// The same content uploaded again is scanned afresh.
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	scan, err := initialScan(tx, storedFile{Path: key})
+	if err != nil || scan.status != scanPending {
+		t.Errorf("initialScan after a failed scan = %+v, %v, want pending", scan, err)
+	}
+}
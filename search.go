@@ -0,0 +1,352 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html"
+	"log"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========== SEARCH INDEX ==========
+//
+// search_index is an FTS5 table with one row per document, subject and
+// category. Documents are found by title, file name and the names of their
+// subject and category; subjects and categories by their names, in French and
+// Arabic. The ids of the level, year, subject and category of each row are
+// kept alongside for filtering.
+//
+// Indexed text is normalised by searchWords, see normalize.go. The index is
+// rebuilt at startup and kept in sync by every write to the
+// indexed rows. Trashed and unscanned rows stay in the index and are filtered
+// out when searching, so trashing, restoring and scanning need no update.
+
+// execer is what the index needs of *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+type searchEntry struct {
+	kind       string
+	refID      int
+	title      string
+	fileName   string
+	subject    string
+	category   string
+	levelID    sql.NullInt64
+	yearID     sql.NullInt64
+	subjectID  sql.NullInt64
+	categoryID sql.NullInt64
+}
+
+// searchSources loads the entries of each kind for the rows of its table
+// matching a filter.
+var searchSources = map[string]struct {
+	table string
+	query string
+}{
+	"document": {"documents", `SELECT d.id, d.title, d.file_name, s.name_ar || ' ' || s.name, c.name_ar || ' ' || c.name,
+                                      y.level_id, s.year_id, d.subject_id, d.category_id
+                               FROM documents d
+                               JOIN subjects s ON s.id = d.subject_id
+                               JOIN years y ON y.id = s.year_id
+                               JOIN categories c ON c.id = d.category_id
+                               WHERE d.id IN (SELECT id FROM documents WHERE %s)`},
+	"subject": {"subjects", `SELECT s.id, s.name_ar || ' ' || s.name, '', s.name_ar || ' ' || s.name, '',
+                                    y.level_id, s.year_id, s.id, NULL
+                             FROM subjects s
+                             JOIN years y ON y.id = s.year_id
+                             WHERE s.id IN (SELECT id FROM subjects WHERE %s)`},
+	"category": {"categories", `SELECT id, name_ar || ' ' || name, '', '', name_ar || ' ' || name,
+                                       NULL, NULL, NULL, id
+                                FROM categories
+                                WHERE id IN (SELECT id FROM categories WHERE %s)`},
+}
+
+// reindex replaces the index rows of kind for the rows matching filter, a
+// condition on the kind's table.
+func reindex(q execer, kind, filter string, args ...any) error {
+	source := searchSources[kind]
+	rows, err := q.Query(fmt.Sprintf(source.query, filter), args...)
+	if err != nil {
+		return err
+	}
+	var entries []searchEntry
+	for rows.Next() {
+		e := searchEntry{kind: kind}
+		if err := rows.Scan(&e.refID, &e.title, &e.fileName, &e.subject, &e.category,
+			&e.levelID, &e.yearID, &e.subjectID, &e.categoryID); err != nil {
+			rows.Close()
+			return err
+		}
+		entries = append(entries, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = q.Exec("DELETE FROM search_index WHERE kind = ? AND ref_id IN (SELECT id FROM "+source.table+" WHERE "+filter+")",
+		append([]any{kind}, args...)...)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		_, err := q.Exec(`INSERT INTO search_index (title, file_name, subject, category, kind, ref_id, level_id, year_id, subject_id, category_id)
+                          VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			normalizeSearchText(e.title), normalizeSearchText(e.fileName), normalizeSearchText(e.subject), normalizeSearchText(e.category),
+			e.kind, e.refID, e.levelID, e.yearID, e.subjectID, e.categoryID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func reindexDocument(q execer, id any) error {
+	return reindex(q, "document", "id = ?", id)
+}
+
+// reindexSubject also updates the documents of the subject, which are found
+// by its name.
+func reindexSubject(q execer, id any) error {
+	if err := reindex(q, "subject", "id = ?", id); err != nil {
+		return err
+	}
+	return reindex(q, "document", "subject_id = ?", id)
+}
+
+func reindexCategory(q execer, id any) error {
+	if err := reindex(q, "category", "id = ?", id); err != nil {
+		return err
+	}
+	return reindex(q, "document", "category_id = ?", id)
+}
+
+// reindexYear follows a year moved to another level.
+func reindexYear(q execer, id any) error {
+	if err := reindex(q, "subject", "year_id = ?", id); err != nil {
+		return err
+	}
+	return reindex(q, "document", documentsOfYear, id)
+}
+
+// pruneSearchIndex drops the rows of hard-deleted nodes.
+func pruneSearchIndex(q execer) error {
+	_, err := q.Exec(`DELETE FROM search_index WHERE
+                          kind = 'document' AND ref_id NOT IN (SELECT id FROM documents) OR
+                          kind = 'subject' AND ref_id NOT IN (SELECT id FROM subjects) OR
+                          kind = 'category' AND ref_id NOT IN (SELECT id FROM categories)`)
+	return err
+}
+
+func rebuildSearchIndex() error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM search_index"); err != nil {
+		return err
+	}
+	for _, kind := range []string{"category", "subject", "document"} {
+		if err := reindex(tx, kind, "1"); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// logIndexError reports a failed index update after a write that succeeded;
+// the next startup rebuilds the index anyway.
+func logIndexError(err error) {
+	if err != nil {
+		log.Printf("⚠️  Could not update the search index: %v", err)
+	}
+}
+
+// ========== SEARCH HANDLER ==========
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+	// Each mistyped word scans the whole vocabulary, so q is kept short.
+	maxSearchLength = 200
+	maxSearchWords  = 8
+)
+
+type SearchResult struct {
+	Type         string  `json:"type"`
+	ID           int     `json:"id"`
+	Title        string  `json:"title"`
+	Highlight    string  `json:"highlight"`
+	LevelID      *int    `json:"level_id"`
+	YearID       *int    `json:"year_id"`
+	SubjectID    *int    `json:"subject_id"`
+	SubjectName  *string `json:"subject_name"`
+	CategoryID   *int    `json:"category_id"`
+	CategoryName *string `json:"category_name"`
+	Rank         float64 `json:"rank"`
+}
+
+// ftsQuery turns user input into an FTS5 query matching every normalised word
+// as a prefix, or any of the indexed terms close to a mistyped word. Quoting
+// keeps operators in the input from being interpreted. It also returns the
+// terms to highlight.
+func ftsQuery(q execer, input string) (string, []string, error) {
+	var groups, terms []string
+	for _, word := range searchWords(input) {
+		fuzzy, err := fuzzyTerms(q, word)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(fuzzy) == 0 {
+			groups = append(groups, `"`+word+`"*`)
+			terms = append(terms, word)
+			continue
+		}
+		quoted := make([]string, len(fuzzy))
+		for i, term := range fuzzy {
+			quoted[i] = `"` + term + `"`
+		}
+		groups = append(groups, "("+strings.Join(quoted, " OR ")+")")
+		terms = append(terms, fuzzy...)
+	}
+	return strings.Join(groups, " "), terms, nil
+}
+
+// highlightHTML escapes text and marks with <mark> the words whose normalised
+// form starts with one of terms.
+func highlightHTML(text string, terms []string) string {
+	var b strings.Builder
+	start := -1
+	mark := func(end int) {
+		word := text[start:end]
+		for _, w := range searchWords(word) {
+			for _, term := range terms {
+				if strings.HasPrefix(w, term) {
+					b.WriteString("<mark>" + html.EscapeString(word) + "</mark>")
+					return
+				}
+			}
+		}
+		b.WriteString(html.EscapeString(word))
+	}
+	for i, r := range text {
+		inWord := unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r)
+		switch {
+		case inWord && start < 0:
+			start = i
+		case !inWord && start >= 0:
+			mark(i)
+			start = -1
+		}
+		if !inWord {
+			b.WriteString(html.EscapeString(string(r)))
+		}
+	}
+	if start >= 0 {
+		mark(len(text))
+	}
+	return b.String()
+}
+
+// SearchContent answers GET /api/search?q=... with published documents,
+// subjects and categories by relevance. level_id, year_id, subject_id,
+// category_id and type (document, subject or category) narrow the results.
+func SearchContent(c *gin.Context) {
+	input := c.Query("q")
+	if utf8.RuneCountInString(input) > maxSearchLength || len(searchWords(input)) > maxSearchWords {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("q must be at most %d characters and %d words", maxSearchLength, maxSearchWords)})
+		return
+	}
+	match, terms, err := ftsQuery(db, input)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if match == "" {
+		c.JSON(400, gin.H{"error": "q is required"})
+		return
+	}
+
+	// Title matters most, then the subject, the file name and the category.
+	// The index holds normalised text, so titles come from the indexed rows.
+	query := `SELECT si.kind, si.ref_id,
+                     CASE si.kind
+                         WHEN 'document' THEN d.title
+                         WHEN 'subject' THEN s.name_ar || ' ' || s.name
+                         ELSE cat.name_ar || ' ' || cat.name
+                     END,
+                     si.level_id, si.year_id, si.subject_id, s.name_ar, si.category_id, cat.name_ar,
+                     bm25(search_index, 10.0, 3.0, 4.0, 2.0) AS rank
+              FROM search_index si
+              LEFT JOIN documents d ON si.kind = 'document' AND d.id = si.ref_id
+              LEFT JOIN subjects s ON s.id = si.subject_id
+              LEFT JOIN categories cat ON cat.id = si.category_id
+              WHERE search_index MATCH ?
+                AND CASE si.kind
+                    WHEN 'document' THEN d.id IS NOT NULL AND d.deleted_at IS NULL AND d.scan_status = 'clean'
+                    WHEN 'subject' THEN s.id IS NOT NULL AND s.deleted_at IS NULL
+                    ELSE cat.id IS NOT NULL AND cat.deleted_at IS NULL
+                END`
+	args := []any{match}
+
+	for _, filter := range []string{"level_id", "year_id", "subject_id", "category_id"} {
+		if value := c.Query(filter); value != "" {
+			id, err := strconv.Atoi(value)
+			if err != nil {
+				c.JSON(400, gin.H{"error": "Invalid " + filter})
+				return
+			}
+			query += " AND si." + filter + " = ?"
+			args = append(args, id)
+		}
+	}
+	if kind := c.Query("type"); kind != "" {
+		if _, ok := searchSources[kind]; !ok {
+			c.JSON(400, gin.H{"error": "type must be document, subject or category"})
+			return
+		}
+		query += " AND si.kind = ?"
+		args = append(args, kind)
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultSearchLimit)))
+	if err != nil || limit < 1 || limit > maxSearchLimit {
+		limit = defaultSearchLimit
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	query += " ORDER BY rank LIMIT ? OFFSET ?"
+	args = append(args, limit, offset)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	results := []SearchResult{}
+	for rows.Next() {
+		var r SearchResult
+		if err := rows.Scan(&r.Type, &r.ID, &r.Title, &r.LevelID, &r.YearID,
+			&r.SubjectID, &r.SubjectName, &r.CategoryID, &r.CategoryName, &r.Rank); err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		r.Highlight = highlightHTML(r.Title, terms)
+		results = append(results, r)
+	}
+	c.JSON(200, gin.H{"query": c.Query("q"), "results": results})
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+type searchResponse struct {
+	Results []SearchResult `json:"results"`
+}
+
+// search runs /api/search with the query parameters and returns the status
+// and the results.
+func search(t *testing.T, params url.Values) (int, []SearchResult) {
+	t.Helper()
+	var resp searchResponse
+	code := call(t, "GET", "/api/search?"+params.Encode(), "", nil, &resp)
+	return code, resp.Results
+}
+
+func TestSearchEndToEnd(t *testing.T) {
+	openTestDB(t)
+	seedTestData(t)
+	useTestStorage(t)
+	// The seeded subjects and categories are indexed at startup.
+	if err := rebuildSearchIndex(); err != nil {
+		t.Fatal(err)
+	}
+	maths, _ := addTestDocument(t, "الرياضيات - الفصل الأول", "%PDF-1.4 maths")
+	lycee, _ := addTestDocument(t, "Cours Lycée œuvre", "%PDF-1.4 lycee")
+	trashed, _ := addTestDocument(t, "الرياضيات المحذوفة", "%PDF-1.4 trashed")
+	scanPendingFiles()
+	unscanned, _ := addTestDocument(t, "الرياضيات الجديدة", "%PDF-1.4 pending")
+	if err := trashNode("documents", trashed); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		q    string
+		want int64
+	}{
+		{"رياضيات", maths},
+		{"الرياضيّات", maths},
+		{"والرياضيات", maths},
+		{"الفصل الاول", maths},
+		{"lycee", lycee},
+		{"LYCÉE", lycee},
+		{"oeuvre", lycee},
+		{"cours lyce", lycee},
+		{"lyceee", lycee},
+	}
+	for _, tt := range tests {
+		code, results := search(t, url.Values{"q": {tt.q}, "type": {"document"}})
+		if code != 200 {
+			t.Errorf("%q: %d", tt.q, code)
+			continue
+		}
+		found := false
+		for _, r := range results {
+			found = found || int64(r.ID) == tt.want
+			if int64(r.ID) == trashed || int64(r.ID) == unscanned {
+				t.Errorf("%q found document %d, which is trashed or not scanned", tt.q, r.ID)
+			}
+		}
+		if !found {
+			t.Errorf("%q did not find document %d: %+v", tt.q, tt.want, results)
+		}
+	}
+
+	// A mistyped subject name, narrowed to one year.
+	_, results := search(t, url.Values{"q": {"mathematiqes"}, "type": {"subject"}, "year_id": {"1"}})
+	if len(results) != 1 || results[0].ID != 1 {
+		t.Fatalf("mistyped subject: %+v", results)
+	}
+	if !strings.Contains(results[0].Highlight, "<mark>Mathématiques</mark>") {
+		t.Errorf("highlight = %q", results[0].Highlight)
+	}
+
+	// Words too short for typos match as prefixes only.
+	if _, results := search(t, url.Values{"q": {"lyc"}, "type": {"document"}}); len(results) != 1 {
+		t.Errorf("prefix lyc: %d results, want 1", len(results))
+	}
+	if _, results := search(t, url.Values{"q": {"lxc"}, "type": {"document"}}); len(results) != 0 {
+		t.Errorf("lxc: %d results, want none", len(results))
+	}
+}
+
+func TestSearchRejectsBadQueries(t *testing.T) {
+	openTestDB(t)
+	seedTestData(t)
+
+	tests := []struct {
+		q      string
+		status int
+	}{
+		{"", 400},
+		{"  ؟!  ", 400},
+		{`maths" OR NEAR(a b) *`, 200},
+		{strings.Repeat("a", maxSearchLength), 200},
+		{strings.Repeat("a", maxSearchLength+1), 400},
+		{strings.TrimSpace(strings.Repeat("mathematiqes ", maxSearchWords)), 200},
+		{strings.TrimSpace(strings.Repeat("mathematiqes ", maxSearchWords+1)), 400},
+	}
+	for _, tt := range tests {
+		if code, _ := search(t, url.Values{"q": {tt.q}}); code != tt.status {
+			t.Errorf("%.40q: %d, want %d", tt.q, code, tt.status)
+		}
+	}
+	if code, _ := search(t, url.Values{"q": {"maths"}, "type": {"level"}}); code != 400 {
+		t.Errorf("unknown type: %d, want 400", code)
+	}
+	if code, _ := search(t, url.Values{"q": {"maths"}, "level_id": {"x"}}); code != 400 {
+		t.Errorf("invalid level_id: %d, want 400", code)
+	}
+}
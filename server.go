@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-contrib/cors"
@@ -43,88 +45,46 @@ type Subject struct {
 }
 
 type Category struct {
-	ID        int       `json:"id"`
-	Name      string    `json:"name"`
-	NameAr    string    `json:"name_ar"`
-	CreatedAt time.Time `json:"created_at"`
+	ID            int       `json:"id"`
+	Name          string    `json:"name"`
+	NameAr        string    `json:"name_ar"`
+	MaxUploadSize *int64    `json:"max_upload_size"`
+	CreatedAt     time.Time `json:"created_at"`
 }
 
 type Document struct {
-	ID           int       `json:"id"`
-	SubjectID    int       `json:"subject_id"`
-	CategoryID   int       `json:"category_id"`
-	Title        string    `json:"title"`
-	FileName     string    `json:"file_name"`
-	FilePath     string    `json:"file_path"`
-	FileSize     int64     `json:"file_size"`
-	Downloads    int       `json:"downloads"`
-	CreatedAt    time.Time `json:"created_at"`
-	SubjectName  string    `json:"subject_name,omitempty"`
-	CategoryName string    `json:"category_name,omitempty"`
+	ID           int        `json:"id"`
+	SubjectID    int        `json:"subject_id"`
+	CategoryID   int        `json:"category_id"`
+	Title        string     `json:"title"`
+	FileName     string     `json:"file_name"`
+	FilePath     string     `json:"file_path"`
+	FileSize     int64      `json:"file_size"`
+	MimeType     string     `json:"mime_type"`
+	ScanStatus   string     `json:"scan_status,omitempty"`
+	ScanVerdict  string     `json:"scan_verdict,omitempty"`
+	Downloads    int        `json:"downloads"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    *time.Time `json:"updated_at"`
+	SubjectName  string     `json:"subject_name,omitempty"`
+	CategoryName string     `json:"category_name,omitempty"`
 }
 
 var db *sql.DB
 
 // ========== DATABASE INIT ==========
 
-func initDB() error {
+func openDB() error {
 	var err error
-	db, err = sql.Open("sqlite", "./StudyDz.db")
-	if err != nil {
-		return err
-	}
+	// _pragma parameters apply to every pooled connection, so foreign keys
+	// are enforced no matter which connection runs a statement.
+	db, err = sql.Open("sqlite", "file:./StudyDz.db?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)")
+	return err
+}
 
-	// Create tables
-	queries := []string{
-		`CREATE TABLE IF NOT EXISTS levels (
-            id INTEGER PRIMARY KEY AUTOINCREMENT,
-            name TEXT NOT NULL,
-            name_ar TEXT NOT NULL,
-            color TEXT NOT NULL,
-            created_at DATETIME DEFAULT CURRENT_TIMESTAMP
-        )`,
-		`CREATE TABLE IF NOT EXISTS years (
-            id INTEGER PRIMARY KEY AUTOINCREMENT,
-            level_id INTEGER NOT NULL,
-            name TEXT NOT NULL,
-            name_ar TEXT NOT NULL,
-            created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-            FOREIGN KEY (level_id) REFERENCES levels(id)
-        )`,
-		`CREATE TABLE IF NOT EXISTS subjects (
-            id INTEGER PRIMARY KEY AUTOINCREMENT,
-            year_id INTEGER NOT NULL,
-            name TEXT NOT NULL,
-            name_ar TEXT NOT NULL,
-            icon TEXT,
-            created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-            FOREIGN KEY (year_id) REFERENCES years(id)
-        )`,
-		`CREATE TABLE IF NOT EXISTS categories (
-            id INTEGER PRIMARY KEY AUTOINCREMENT,
-            name TEXT NOT NULL,
-            name_ar TEXT NOT NULL,
-            created_at DATETIME DEFAULT CURRENT_TIMESTAMP
-        )`,
-		`CREATE TABLE IF NOT EXISTS documents (
-            id INTEGER PRIMARY KEY AUTOINCREMENT,
-            subject_id INTEGER NOT NULL,
-            category_id INTEGER NOT NULL,
-            title TEXT NOT NULL,
-            file_name TEXT NOT NULL,
-            file_path TEXT NOT NULL,
-            file_size INTEGER DEFAULT 0,
-            downloads INTEGER DEFAULT 0,
-            created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-            FOREIGN KEY (subject_id) REFERENCES subjects(id),
-            FOREIGN KEY (category_id) REFERENCES categories(id)
-        )`,
-	}
-
-	for _, query := range queries {
-		if _, err := db.Exec(query); err != nil {
-			return err
-		}
+func initDB() error {
+	if err := ensureSchema(); err != nil {
+		return err
 	}
 
 	log.Println("✅ Database initialized successfully")
@@ -421,80 +381,104 @@ func insertDefaultData() error {
 // ========== PUBLIC API HANDLERS ==========
 
 func GetLevels(c *gin.Context) {
-	rows, err := db.Query("SELECT id, name, name_ar, color, created_at FROM levels ORDER BY id")
+	levels, err := reads.getAt("levels", requestContentVersion(c), hierarchyTTL, func() (any, error) {
+		rows, err := db.Query("SELECT id, name, name_ar, color, created_at FROM levels WHERE deleted_at IS NULL ORDER BY id")
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		levels := []Level{}
+		for rows.Next() {
+			var l Level
+			if err := rows.Scan(&l.ID, &l.Name, &l.NameAr, &l.Color, &l.CreatedAt); err != nil {
+				continue
+			}
+			levels = append(levels, l)
+		}
+		return levels, nil
+	})
 	if err != nil {
 		c.JSON(500, gin.H{"error": err.Error()})
 		return
 	}
-	defer rows.Close()
-
-	var levels []Level
-	for rows.Next() {
-		var l Level
-		if err := rows.Scan(&l.ID, &l.Name, &l.NameAr, &l.Color, &l.CreatedAt); err != nil {
-			continue
-		}
-		levels = append(levels, l)
-	}
 	c.JSON(200, levels)
 }
 
 func GetYears(c *gin.Context) {
 	levelID := c.Query("level_id")
+	if !requireParents(c, "level_id") {
+		return
+	}
 
-	query := `SELECT y.id, y.level_id, y.name, y.name_ar, y.created_at, l.name_ar as level_name 
-              FROM years y 
-              JOIN levels l ON y.level_id = l.id 
-              WHERE y.level_id = ? 
-              ORDER BY y.id`
+	years, err := reads.getAt(parentKey("years", levelID), requestContentVersion(c), hierarchyTTL, func() (any, error) {
+		query := `SELECT y.id, y.level_id, y.name, y.name_ar, y.created_at, l.name_ar as level_name 
+                  FROM years y 
+                  JOIN levels l ON y.level_id = l.id 
+                  WHERE y.level_id = ? AND y.deleted_at IS NULL
+                  ORDER BY y.id`
+
+		rows, err := db.Query(query, levelID)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
 
-	rows, err := db.Query(query, levelID)
+		years := []Year{}
+		for rows.Next() {
+			var y Year
+			if err := rows.Scan(&y.ID, &y.LevelID, &y.Name, &y.NameAr, &y.CreatedAt, &y.LevelName); err != nil {
+				continue
+			}
+			years = append(years, y)
+		}
+		return years, nil
+	})
 	if err != nil {
 		c.JSON(500, gin.H{"error": err.Error()})
 		return
 	}
-	defer rows.Close()
-
-	var years []Year
-	for rows.Next() {
-		var y Year
-		if err := rows.Scan(&y.ID, &y.LevelID, &y.Name, &y.NameAr, &y.CreatedAt, &y.LevelName); err != nil {
-			continue
-		}
-		years = append(years, y)
-	}
 	c.JSON(200, years)
 }
 
 func GetSubjects(c *gin.Context) {
 	yearID := c.Query("year_id")
+	if !requireParents(c, "year_id") {
+		return
+	}
 
-	query := `SELECT s.id, s.year_id, s.name, s.name_ar, s.icon, s.created_at, y.name_ar as year_name 
-              FROM subjects s 
-              JOIN years y ON s.year_id = y.id 
-              WHERE s.year_id = ? 
-              ORDER BY s.id`
+	subjects, err := reads.getAt(parentKey("subjects", yearID), requestContentVersion(c), hierarchyTTL, func() (any, error) {
+		query := `SELECT s.id, s.year_id, s.name, s.name_ar, s.icon, s.created_at, y.name_ar as year_name 
+                  FROM subjects s 
+                  JOIN years y ON s.year_id = y.id 
+                  WHERE s.year_id = ? AND s.deleted_at IS NULL
+                  ORDER BY s.id`
 
-	rows, err := db.Query(query, yearID)
+		rows, err := db.Query(query, yearID)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		subjects := []Subject{}
+		for rows.Next() {
+			var s Subject
+			if err := rows.Scan(&s.ID, &s.YearID, &s.Name, &s.NameAr, &s.Icon, &s.CreatedAt, &s.YearName); err != nil {
+				continue
+			}
+			subjects = append(subjects, s)
+		}
+		return subjects, nil
+	})
 	if err != nil {
 		c.JSON(500, gin.H{"error": err.Error()})
 		return
 	}
-	defer rows.Close()
-
-	var subjects []Subject
-	for rows.Next() {
-		var s Subject
-		if err := rows.Scan(&s.ID, &s.YearID, &s.Name, &s.NameAr, &s.Icon, &s.CreatedAt, &s.YearName); err != nil {
-			continue
-		}
-		subjects = append(subjects, s)
-	}
 	c.JSON(200, subjects)
 }
 
 func GetCategories(c *gin.Context) {
-	rows, err := db.Query("SELECT id, name, name_ar, created_at FROM categories ORDER BY id")
+	rows, err := db.Query("SELECT id, name, name_ar, max_upload_size, created_at FROM categories WHERE deleted_at IS NULL ORDER BY id")
 	if err != nil {
 		c.JSON(500, gin.H{"error": err.Error()})
 		return
@@ -504,7 +488,7 @@ func GetCategories(c *gin.Context) {
 	var categories []Category
 	for rows.Next() {
 		var cat Category
-		if err := rows.Scan(&cat.ID, &cat.Name, &cat.NameAr, &cat.CreatedAt); err != nil {
+		if err := rows.Scan(&cat.ID, &cat.Name, &cat.NameAr, &cat.MaxUploadSize, &cat.CreatedAt); err != nil {
 			continue
 		}
 		categories = append(categories, cat)
@@ -512,51 +496,104 @@ func GetCategories(c *gin.Context) {
 	c.JSON(200, categories)
 }
 
-func GetDocuments(c *gin.Context) {
-	subjectID := c.Query("subject_id")
+// documentSorts are the sort fields of the document lists.
+var documentSorts = map[string]string{
+	"created_at": "d.created_at",
+	"downloads":  "d.downloads",
+	"title":      "d.title COLLATE NOCASE",
+	"file_size":  "d.file_size",
+}
 
-	query := `SELECT d.id, d.subject_id, d.category_id, d.title, d.file_name, d.file_path, 
-              d.file_size, d.downloads, d.created_at, s.name_ar as subject_name, cat.name_ar as category_name
-              FROM documents d
-              JOIN subjects s ON d.subject_id = s.id
-              JOIN categories cat ON d.category_id = cat.id
-              WHERE d.subject_id = ?
-              ORDER BY d.created_at DESC`
+const documentListFrom = `FROM documents d
+                          JOIN subjects s ON d.subject_id = s.id
+                          JOIN years y ON s.year_id = y.id
+                          JOIN categories cat ON d.category_id = cat.id`
+
+// filterDocuments adds the filters shared by the document lists.
+func filterDocuments(q *listQuery) {
+	q.intFilter("subject_id", "d.subject_id = ?")
+	q.intFilter("category_id", "d.category_id = ?")
+	q.intFilter("year_id", "s.year_id = ?")
+	q.intFilter("level_id", "y.level_id = ?")
+	q.dateFilter("d.created_at")
+}
 
-	rows, err := db.Query(query, subjectID)
-	if err != nil {
-		c.JSON(500, gin.H{"error": err.Error()})
+func GetDocuments(c *gin.Context) {
+	q := newListQuery(c, documentSorts, "created_at", "desc")
+	q.where("d.deleted_at IS NULL AND d.scan_status = 'clean'")
+	filterDocuments(q)
+	if q.err != nil {
+		c.JSON(400, gin.H{"error": q.err.Error()})
+		return
+	}
+	if !requireParents(c, "level_id", "year_id", "subject_id", "category_id") {
 		return
 	}
-	defer rows.Close()
 
-	var documents []Document
-	for rows.Next() {
-		var doc Document
-		if err := rows.Scan(&doc.ID, &doc.SubjectID, &doc.CategoryID, &doc.Title, &doc.FileName,
-			&doc.FilePath, &doc.FileSize, &doc.Downloads, &doc.CreatedAt, &doc.SubjectName, &doc.CategoryName); err != nil {
-			continue
+	key := parentKey("documents", c.DefaultQuery("subject_id", documentsWithoutSubject)) + q.cacheKey()
+	page, err := reads.get(key, documentsTTL, func() (any, error) {
+		total, err := q.count(documentListFrom)
+		if err != nil {
+			return nil, err
 		}
-		documents = append(documents, doc)
+		rows, err := q.rows(`d.id, d.subject_id, d.category_id, d.title, d.file_name, d.file_path,
+                             d.file_size, d.mime_type, d.downloads, d.created_at, d.updated_at, s.name_ar as subject_name, cat.name_ar as category_name`,
+			documentListFrom, "d.id")
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		documents := []Document{}
+		for rows.Next() {
+			var doc Document
+			if err := rows.Scan(&doc.ID, &doc.SubjectID, &doc.CategoryID, &doc.Title, &doc.FileName,
+				&doc.FilePath, &doc.FileSize, &doc.MimeType, &doc.Downloads, &doc.CreatedAt, &doc.UpdatedAt, &doc.SubjectName, &doc.CategoryName); err != nil {
+				continue
+			}
+			documents = append(documents, doc)
+		}
+		return q.page(documents, total), nil
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
 	}
-	c.JSON(200, documents)
+	c.JSON(200, page)
+}
+
+type Stats struct {
+	TotalLevels    int `json:"total_levels"`
+	TotalYears     int `json:"total_years"`
+	TotalSubjects  int `json:"total_subjects"`
+	TotalDocuments int `json:"total_documents"`
+	TotalDownloads int `json:"total_downloads"`
 }
 
 func GetStats(c *gin.Context) {
-	var stats struct {
-		TotalLevels    int `json:"total_levels"`
-		TotalYears     int `json:"total_years"`
-		TotalSubjects  int `json:"total_subjects"`
-		TotalDocuments int `json:"total_documents"`
-		TotalDownloads int `json:"total_downloads"`
+	stats, err := reads.get("stats", statsTTL, func() (any, error) {
+		var stats Stats
+		counts := []struct {
+			query string
+			dest  *int
+		}{
+			{"SELECT COUNT(*) FROM levels WHERE deleted_at IS NULL", &stats.TotalLevels},
+			{"SELECT COUNT(*) FROM years WHERE deleted_at IS NULL", &stats.TotalYears},
+			{"SELECT COUNT(*) FROM subjects WHERE deleted_at IS NULL", &stats.TotalSubjects},
+			{"SELECT COUNT(*) FROM documents WHERE deleted_at IS NULL AND scan_status = 'clean'", &stats.TotalDocuments},
+			{"SELECT COALESCE(SUM(downloads), 0) FROM documents WHERE deleted_at IS NULL AND scan_status = 'clean'", &stats.TotalDownloads},
+		}
+		for _, count := range counts {
+			if err := db.QueryRow(count.query).Scan(count.dest); err != nil {
+				return nil, err
+			}
+		}
+		return stats, nil
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
 	}
-
-	db.QueryRow("SELECT COUNT(*) FROM levels").Scan(&stats.TotalLevels)
-	db.QueryRow("SELECT COUNT(*) FROM years").Scan(&stats.TotalYears)
-	db.QueryRow("SELECT COUNT(*) FROM subjects").Scan(&stats.TotalSubjects)
-	db.QueryRow("SELECT COUNT(*) FROM documents").Scan(&stats.TotalDocuments)
-	db.QueryRow("SELECT COALESCE(SUM(downloads), 0) FROM documents").Scan(&stats.TotalDownloads)
-
 	c.JSON(200, stats)
 }
 
@@ -564,8 +601,8 @@ func DownloadDocument(c *gin.Context) {
 	docID := c.Param("id")
 
 	var doc Document
-	err := db.QueryRow("SELECT id, file_path, file_name FROM documents WHERE id = ?", docID).
-		Scan(&doc.ID, &doc.FilePath, &doc.FileName)
+	err := db.QueryRow("SELECT id, file_path, file_name, mime_type FROM documents WHERE id = ? AND deleted_at IS NULL AND scan_status = 'clean'", docID).
+		Scan(&doc.ID, &doc.FilePath, &doc.FileName, &doc.MimeType)
 
 	if err != nil {
 		c.JSON(404, gin.H{"error": "Document not found"})
@@ -573,25 +610,40 @@ func DownloadDocument(c *gin.Context) {
 	}
 
 	db.Exec("UPDATE documents SET downloads = downloads + 1 WHERE id = ?", docID)
-	c.FileAttachment(doc.FilePath, doc.FileName)
+	serveObject(c, doc.FilePath, doc.FileName, doc.MimeType)
 }
 
 // ========== ADMIN API HANDLERS ==========
 
+// The admin lists show what the caller can upload to.
+var (
+	yearListScope     = scopeColumns{"y.level_id = ?", "y.id = ?", "y.id = (SELECT year_id FROM subjects WHERE id = ?)"}
+	subjectListScope  = scopeColumns{"y.level_id = ?", "s.year_id = ?", "s.id = ?"}
+	documentListScope = scopeColumns{"y.level_id = ?", "s.year_id = ?", "d.subject_id = ?"}
+)
+
 func GetAllYears(c *gin.Context) {
+	cond, args, ok := scopeFilter(c, RoleUploader, yearListScope)
+	if !ok {
+		return
+	}
+	if cond != "" {
+		cond = " AND " + cond
+	}
 	query := `SELECT y.id, y.level_id, y.name, y.name_ar, y.created_at, l.name_ar as level_name 
               FROM years y 
               JOIN levels l ON y.level_id = l.id 
+              WHERE y.deleted_at IS NULL` + cond + `
               ORDER BY y.level_id, y.id`
 
-	rows, err := db.Query(query)
+	rows, err := db.Query(query, args...)
 	if err != nil {
 		c.JSON(500, gin.H{"error": err.Error()})
 		return
 	}
 	defer rows.Close()
 
-	var years []Year
+	years := []Year{}
 	for rows.Next() {
 		var y Year
 		if err := rows.Scan(&y.ID, &y.LevelID, &y.Name, &y.NameAr, &y.CreatedAt, &y.LevelName); err != nil {
@@ -602,20 +654,49 @@ func GetAllYears(c *gin.Context) {
 	c.JSON(200, years)
 }
 
+var subjectSorts = map[string]string{
+	"year_id":    "s.year_id",
+	"name":       "s.name COLLATE NOCASE",
+	"created_at": "s.created_at",
+}
+
+const subjectListFrom = `FROM subjects s
+                         JOIN years y ON s.year_id = y.id`
+
 func GetAllSubjects(c *gin.Context) {
-	query := `SELECT s.id, s.year_id, s.name, s.name_ar, s.icon, s.created_at, y.name_ar as year_name 
-              FROM subjects s 
-              JOIN years y ON s.year_id = y.id 
-              ORDER BY s.year_id, s.id`
+	q := newListQuery(c, subjectSorts, "year_id", "asc")
+	q.where("s.deleted_at IS NULL")
+	q.intFilter("year_id", "s.year_id = ?")
+	q.intFilter("level_id", "y.level_id = ?")
+	q.dateFilter("s.created_at")
+	if q.err != nil {
+		c.JSON(400, gin.H{"error": q.err.Error()})
+		return
+	}
+	if !requireParents(c, "level_id", "year_id") {
+		return
+	}
+	cond, args, ok := scopeFilter(c, RoleUploader, subjectListScope)
+	if !ok {
+		return
+	}
+	if cond != "" {
+		q.where(cond, args...)
+	}
 
-	rows, err := db.Query(query)
+	total, err := q.count(subjectListFrom)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	rows, err := q.rows("s.id, s.year_id, s.name, s.name_ar, s.icon, s.created_at, y.name_ar as year_name", subjectListFrom, "s.id")
 	if err != nil {
 		c.JSON(500, gin.H{"error": err.Error()})
 		return
 	}
 	defer rows.Close()
 
-	var subjects []Subject
+	subjects := []Subject{}
 	for rows.Next() {
 		var s Subject
 		if err := rows.Scan(&s.ID, &s.YearID, &s.Name, &s.NameAr, &s.Icon, &s.CreatedAt, &s.YearName); err != nil {
@@ -623,34 +704,59 @@ func GetAllSubjects(c *gin.Context) {
 		}
 		subjects = append(subjects, s)
 	}
-	c.JSON(200, subjects)
+	c.JSON(200, q.page(subjects, total))
 }
 
 func GetAllDocuments(c *gin.Context) {
-	query := `SELECT d.id, d.subject_id, d.category_id, d.title, d.file_name, d.file_path, 
-              d.file_size, d.downloads, d.created_at, s.name_ar as subject_name, cat.name_ar as category_name
-              FROM documents d
-              JOIN subjects s ON d.subject_id = s.id
-              JOIN categories cat ON d.category_id = cat.id
-              ORDER BY d.created_at DESC`
-
-	rows, err := db.Query(query)
+	q := newListQuery(c, documentSorts, "created_at", "desc")
+	q.where("d.deleted_at IS NULL")
+	filterDocuments(q)
+	if status := c.Query("scan_status"); status != "" {
+		if !slices.Contains(scanStatuses, status) {
+			q.fail("scan_status must be one of " + strings.Join(scanStatuses, ", "))
+		}
+		q.where("d.scan_status = ?", status)
+	}
+	if q.err != nil {
+		c.JSON(400, gin.H{"error": q.err.Error()})
+		return
+	}
+	if !requireParents(c, "level_id", "year_id", "subject_id", "category_id") {
+		return
+	}
+	cond, args, ok := scopeFilter(c, RoleUploader, documentListScope)
+	if !ok {
+		return
+	}
+	if cond != "" {
+		q.where(cond, args...)
+	}
+
+	total, err := q.count(documentListFrom)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	rows, err := q.rows(`d.id, d.subject_id, d.category_id, d.title, d.file_name, d.file_path,
+                         d.file_size, d.mime_type, d.scan_status, d.scan_verdict, d.downloads, d.created_at, d.updated_at,
+                         s.name_ar as subject_name, cat.name_ar as category_name`,
+		documentListFrom, "d.id")
 	if err != nil {
 		c.JSON(500, gin.H{"error": err.Error()})
 		return
 	}
 	defer rows.Close()
 
-	var documents []Document
+	documents := []Document{}
 	for rows.Next() {
 		var doc Document
 		if err := rows.Scan(&doc.ID, &doc.SubjectID, &doc.CategoryID, &doc.Title, &doc.FileName,
-			&doc.FilePath, &doc.FileSize, &doc.Downloads, &doc.CreatedAt, &doc.SubjectName, &doc.CategoryName); err != nil {
+			&doc.FilePath, &doc.FileSize, &doc.MimeType, &doc.ScanStatus, &doc.ScanVerdict, &doc.Downloads, &doc.CreatedAt, &doc.UpdatedAt, &doc.SubjectName, &doc.CategoryName); err != nil {
 			continue
 		}
 		documents = append(documents, doc)
 	}
-	c.JSON(200, documents)
+	c.JSON(200, q.page(documents, total))
 }
 
 func CreateLevel(c *gin.Context) {
@@ -670,9 +776,24 @@ func CreateLevel(c *gin.Context) {
 
 	id, _ := result.LastInsertId()
 	level.ID = int(id)
+	reads.invalidate("levels", "stats")
 	c.JSON(201, level)
 }
 
+// updated answers a failed update of a live row: 500 on error, 404 when the
+// row does not exist or is in the trash.
+func updated(c *gin.Context, result sql.Result, err error) bool {
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return false
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(404, gin.H{"error": "Not found"})
+		return false
+	}
+	return true
+}
+
 func UpdateLevel(c *gin.Context) {
 	id := c.Param("id")
 	var level Level
@@ -681,22 +802,24 @@ func UpdateLevel(c *gin.Context) {
 		return
 	}
 
-	_, err := db.Exec("UPDATE levels SET name = ?, name_ar = ?, color = ? WHERE id = ?",
+	result, err := db.Exec("UPDATE levels SET name = ?, name_ar = ?, color = ? WHERE id = ? AND deleted_at IS NULL",
 		level.Name, level.NameAr, level.Color, id)
-
-	if err != nil {
-		c.JSON(500, gin.H{"error": err.Error()})
+	if !updated(c, result, err) {
 		return
 	}
 
+	reads.invalidate("levels", "years/")
 	c.JSON(200, gin.H{"message": "Level updated successfully"})
 }
 
 func DeleteLevel(c *gin.Context) {
 	id := c.Param("id")
-	_, err := db.Exec("DELETE FROM levels WHERE id = ?", id)
-	if err != nil {
-		c.JSON(500, gin.H{"error": err.Error()})
+	if !confirmDelete(c, "level", id) {
+		return
+	}
+
+	if err := trashNode("levels", id); err != nil {
+		respondDeleteError(c, err)
 		return
 	}
 	c.JSON(200, gin.H{"message": "Level deleted successfully"})
@@ -709,6 +832,10 @@ func CreateYear(c *gin.Context) {
 		return
 	}
 
+	if !authorize(c, RoleLevelEditor, levelScope, year.LevelID) {
+		return
+	}
+
 	result, err := db.Exec("INSERT INTO years (level_id, name, name_ar) VALUES (?, ?, ?)",
 		year.LevelID, year.Name, year.NameAr)
 
@@ -719,6 +846,7 @@ func CreateYear(c *gin.Context) {
 
 	id, _ := result.LastInsertId()
 	year.ID = int(id)
+	reads.invalidate(parentKey("years", strconv.Itoa(year.LevelID)), "stats")
 	c.JSON(201, year)
 }
 
@@ -730,22 +858,30 @@ func UpdateYear(c *gin.Context) {
 		return
 	}
 
-	_, err := db.Exec("UPDATE years SET level_id = ?, name = ?, name_ar = ? WHERE id = ?",
-		year.LevelID, year.Name, year.NameAr, id)
+	if !authorize(c, RoleLevelEditor, yearScope, id) || !authorize(c, RoleLevelEditor, levelScope, year.LevelID) {
+		return
+	}
 
-	if err != nil {
-		c.JSON(500, gin.H{"error": err.Error()})
+	result, err := db.Exec("UPDATE years SET level_id = ?, name = ?, name_ar = ? WHERE id = ? AND deleted_at IS NULL",
+		year.LevelID, year.Name, year.NameAr, id)
+	if !updated(c, result, err) {
 		return
 	}
+	logIndexError(reindexYear(db, id))
+	// A moved year changes its level's list and the level filters.
+	reads.invalidate("years/", "subjects/", "documents/")
 
 	c.JSON(200, gin.H{"message": "Year updated successfully"})
 }
 
 func DeleteYear(c *gin.Context) {
 	id := c.Param("id")
-	_, err := db.Exec("DELETE FROM years WHERE id = ?", id)
-	if err != nil {
-		c.JSON(500, gin.H{"error": err.Error()})
+	if !authorize(c, RoleLevelEditor, yearScope, id) || !confirmDelete(c, "year", id) {
+		return
+	}
+
+	if err := trashNode("years", id); err != nil {
+		respondDeleteError(c, err)
 		return
 	}
 	c.JSON(200, gin.H{"message": "Year deleted successfully"})
@@ -758,6 +894,10 @@ func CreateSubject(c *gin.Context) {
 		return
 	}
 
+	if !authorize(c, RoleLevelEditor, yearScope, subject.YearID) {
+		return
+	}
+
 	result, err := db.Exec("INSERT INTO subjects (year_id, name, name_ar, icon) VALUES (?, ?, ?, ?)",
 		subject.YearID, subject.Name, subject.NameAr, subject.Icon)
 
@@ -768,6 +908,8 @@ func CreateSubject(c *gin.Context) {
 
 	id, _ := result.LastInsertId()
 	subject.ID = int(id)
+	logIndexError(reindexSubject(db, id))
+	reads.invalidate(parentKey("subjects", strconv.Itoa(subject.YearID)), "stats")
 	c.JSON(201, subject)
 }
 
@@ -779,22 +921,29 @@ func UpdateSubject(c *gin.Context) {
 		return
 	}
 
-	_, err := db.Exec("UPDATE subjects SET year_id = ?, name = ?, name_ar = ?, icon = ? WHERE id = ?",
-		subject.YearID, subject.Name, subject.NameAr, subject.Icon, id)
+	if !authorize(c, RoleLevelEditor, subjectScope, id) || !authorize(c, RoleLevelEditor, yearScope, subject.YearID) {
+		return
+	}
 
-	if err != nil {
-		c.JSON(500, gin.H{"error": err.Error()})
+	result, err := db.Exec("UPDATE subjects SET year_id = ?, name = ?, name_ar = ?, icon = ? WHERE id = ? AND deleted_at IS NULL",
+		subject.YearID, subject.Name, subject.NameAr, subject.Icon, id)
+	if !updated(c, result, err) {
 		return
 	}
+	logIndexError(reindexSubject(db, id))
+	reads.invalidate("subjects/", "documents/")
 
 	c.JSON(200, gin.H{"message": "Subject updated successfully"})
 }
 
 func DeleteSubject(c *gin.Context) {
 	id := c.Param("id")
-	_, err := db.Exec("DELETE FROM subjects WHERE id = ?", id)
-	if err != nil {
-		c.JSON(500, gin.H{"error": err.Error()})
+	if !authorize(c, RoleLevelEditor, subjectScope, id) || !confirmDelete(c, "subject", id) {
+		return
+	}
+
+	if err := trashNode("subjects", id); err != nil {
+		respondDeleteError(c, err)
 		return
 	}
 	c.JSON(200, gin.H{"message": "Subject deleted successfully"})
@@ -807,8 +956,8 @@ func CreateCategory(c *gin.Context) {
 		return
 	}
 
-	result, err := db.Exec("INSERT INTO categories (name, name_ar) VALUES (?, ?)",
-		category.Name, category.NameAr)
+	result, err := db.Exec("INSERT INTO categories (name, name_ar, max_upload_size) VALUES (?, ?, ?)",
+		category.Name, category.NameAr, category.MaxUploadSize)
 
 	if err != nil {
 		c.JSON(500, gin.H{"error": err.Error()})
@@ -817,6 +966,7 @@ func CreateCategory(c *gin.Context) {
 
 	id, _ := result.LastInsertId()
 	category.ID = int(id)
+	logIndexError(reindexCategory(db, id))
 	c.JSON(201, category)
 }
 
@@ -828,31 +978,33 @@ func UpdateCategory(c *gin.Context) {
 		return
 	}
 
-	_, err := db.Exec("UPDATE categories SET name = ?, name_ar = ? WHERE id = ?",
-		category.Name, category.NameAr, id)
-
-	if err != nil {
-		c.JSON(500, gin.H{"error": err.Error()})
+	result, err := db.Exec("UPDATE categories SET name = ?, name_ar = ?, max_upload_size = ? WHERE id = ? AND deleted_at IS NULL",
+		category.Name, category.NameAr, category.MaxUploadSize, id)
+	if !updated(c, result, err) {
 		return
 	}
+	logIndexError(reindexCategory(db, id))
+	reads.invalidate("documents/")
 
 	c.JSON(200, gin.H{"message": "Category updated successfully"})
 }
 
 func DeleteCategory(c *gin.Context) {
 	id := c.Param("id")
-	_, err := db.Exec("DELETE FROM categories WHERE id = ?", id)
-	if err != nil {
-		c.JSON(500, gin.H{"error": err.Error()})
+	if !confirmDelete(c, "category", id) {
+		return
+	}
+
+	if err := trashCategoryRestrict(id); err != nil {
+		respondDeleteError(c, err)
 		return
 	}
 	c.JSON(200, gin.H{"message": "Category deleted successfully"})
 }
 
 func UploadDocument(c *gin.Context) {
-	file, err := c.FormFile("file")
-	if err != nil {
-		c.JSON(400, gin.H{"error": "No file uploaded"})
+	file, ok := formFile(c)
+	if !ok {
 		return
 	}
 
@@ -860,42 +1012,32 @@ func UploadDocument(c *gin.Context) {
 	categoryID := c.PostForm("category_id")
 	title := c.PostForm("title")
 
-	os.MkdirAll("./uploads", 0755)
-
-	filename := fmt.Sprintf("%d_%s", time.Now().Unix(), filepath.Base(file.Filename))
-	filePath := filepath.Join("uploads", filename)
-
-	if err := c.SaveUploadedFile(file, filePath); err != nil {
-		c.JSON(500, gin.H{"error": "Failed to save file"})
+	if !authorize(c, RoleUploader, subjectScope, subjectID) {
 		return
 	}
 
-	_, err = db.Exec(`INSERT INTO documents (subject_id, category_id, title, file_name, file_path, file_size) 
-                      VALUES (?, ?, ?, ?, ?, ?)`,
-		subjectID, categoryID, title, file.Filename, filePath, file.Size)
-
+	published, err := publishDocument(subjectID, categoryID, title, multipartUpload(file), currentAdmin(c).ID)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to save to database"})
+		respondUploadError(c, err)
 		return
 	}
 
-	c.JSON(200, gin.H{"message": "File uploaded successfully", "filename": filename})
+	response := gin.H{"message": "File uploaded successfully", "document_id": published.ID, "checksum": published.Checksum}
+	if published.Duplicate != nil {
+		response["duplicate"] = published.Duplicate
+	}
+	c.JSON(200, response)
 }
 
 func DeleteDocument(c *gin.Context) {
 	docID := c.Param("id")
-
-	var filePath string
-	db.QueryRow("SELECT file_path FROM documents WHERE id = ?", docID).Scan(&filePath)
-
-	_, err := db.Exec("DELETE FROM documents WHERE id = ?", docID)
-	if err != nil {
-		c.JSON(500, gin.H{"error": err.Error()})
+	if !authorize(c, RoleUploader, documentScope, docID) {
 		return
 	}
 
-	if filePath != "" {
-		os.Remove(filePath)
+	if err := trashNode("documents", docID); err != nil {
+		respondDeleteError(c, err)
+		return
 	}
 
 	c.JSON(200, gin.H{"message": "Document deleted successfully"})
@@ -903,71 +1045,182 @@ func DeleteDocument(c *gin.Context) {
 
 // ========== MAIN ==========
 
-func main() {
-	if err := initDB(); err != nil {
-		log.Fatal("Failed to initialize database:", err)
-	}
-	defer db.Close()
-
+// newRouter registers the pages and the public and admin APIs.
+func newRouter() *gin.Engine {
 	r := gin.Default()
 
 	r.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"*"},
-		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE"},
-		AllowHeaders:     []string{"Origin", "Content-Type"},
+		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", "Upload-Offset"},
+		ExposeHeaders:    []string{"Location", "Upload-Offset", "Upload-Length", "ETag"},
 		AllowCredentials: true,
 	}))
 
-	r.Static("/uploads", "./uploads")
-	r.StaticFile("/image1.jpg", "./image1.jpg")
-	r.StaticFile("/", "./index.html")
-	r.StaticFile("/index.html", "./index.html")
-	r.StaticFile("/level.html", "./level.html")
-	r.StaticFile("/matiere.html", "./matiere.html")
-	r.StaticFile("/documents.html", "./documents.html")
+	r.GET("/uploads/*filepath", ServeUpload)
+	r.HEAD("/uploads/*filepath", ServeUpload)
+
+	pages := r.Group("", CacheFor(pageCacheControl))
+	{
+		pages.StaticFile("/image1.jpg", "./image1.jpg")
+		pages.StaticFile("/", "./index.html")
+		pages.StaticFile("/index.html", "./index.html")
+		pages.StaticFile("/level.html", "./level.html")
+		pages.StaticFile("/matiere.html", "./matiere.html")
+		pages.StaticFile("/documents.html", "./documents.html")
+	}
 	r.StaticFile("/admin.html", "./admin.html")
 
 	api := r.Group("/api")
 	{
 		// Public routes
-		api.GET("/levels", GetLevels)
-		api.GET("/years", GetYears)
-		api.GET("/subjects", GetSubjects)
-		api.GET("/categories", GetCategories)
-		api.GET("/documents", GetDocuments)
+		api.GET("/levels", Versioned(), GetLevels)
+		api.GET("/years", Versioned(), GetYears)
+		api.GET("/subjects", Versioned(), GetSubjects)
+		api.GET("/categories", Versioned(), GetCategories)
+		api.GET("/documents", CacheFor(apiCacheControl), GetDocuments)
 		api.GET("/download/:id", DownloadDocument)
-		api.GET("/stats", GetStats)
+		api.GET("/stats", CacheFor(apiCacheControl), GetStats)
+		api.GET("/search", CacheFor(apiCacheControl), SearchContent)
+		api.GET("/tree", CacheFor(apiCacheControl), GetTree)
+		api.GET("/years/:id/context", Versioned(), GetYearContext)
+		api.GET("/subjects/:id/context", Versioned(), GetSubjectContext)
+		api.GET("/documents/:id/context", CacheFor(apiCacheControl), GetDocumentContext)
 
+		// Admin routes - Auth
+		api.POST("/admin/login", Login)
+	}
+
+	session := api.Group("/admin", AuthRequired())
+	{
+		session.POST("/logout", Logout)
+		session.GET("/me", GetCurrentAdmin)
+
+		// Admin routes - Two-factor enrolment
+		session.POST("/2fa/enroll", EnrollTOTP)
+		session.POST("/2fa/confirm", ConfirmTOTP)
+		session.POST("/2fa/recovery-codes", RegenerateRecoveryCodes)
+		session.DELETE("/2fa", DisableTOTP)
+	}
+
+	admin := session.Group("", Require2FA())
+	{
 		// Admin routes - Get All
-		api.GET("/admin/years", GetAllYears)
-		api.GET("/admin/subjects", GetAllSubjects)
-		api.GET("/admin/documents", GetAllDocuments)
+		admin.GET("/years", GetAllYears)
+		admin.GET("/subjects", GetAllSubjects)
+		admin.GET("/documents", GetAllDocuments)
 
 		// Admin routes - Levels
-		api.POST("/admin/levels", CreateLevel)
-		api.PUT("/admin/levels/:id", UpdateLevel)
-		api.DELETE("/admin/levels/:id", DeleteLevel)
+		admin.POST("/levels", RequireRole(RoleSuperAdmin), CreateLevel)
+		admin.PUT("/levels/:id", RequireRole(RoleSuperAdmin), UpdateLevel)
+		admin.DELETE("/levels/:id", RequireRole(RoleSuperAdmin), DeleteLevel)
+		admin.GET("/levels/:id/impact", RequireRole(RoleSuperAdmin), GetLevelImpact)
 
 		// Admin routes - Years
-		api.POST("/admin/years", CreateYear)
-		api.PUT("/admin/years/:id", UpdateYear)
-		api.DELETE("/admin/years/:id", DeleteYear)
+		admin.POST("/years", CreateYear)
+		admin.PUT("/years/:id", UpdateYear)
+		admin.DELETE("/years/:id", DeleteYear)
+		admin.GET("/years/:id/impact", GetYearImpact)
 
 		// Admin routes - Subjects
-		api.POST("/admin/subjects", CreateSubject)
-		api.PUT("/admin/subjects/:id", UpdateSubject)
-		api.DELETE("/admin/subjects/:id", DeleteSubject)
+		admin.POST("/subjects", CreateSubject)
+		admin.PUT("/subjects/:id", UpdateSubject)
+		admin.DELETE("/subjects/:id", DeleteSubject)
+		admin.GET("/subjects/:id/impact", GetSubjectImpact)
 
 		// Admin routes - Categories
-		api.POST("/admin/categories", CreateCategory)
-		api.PUT("/admin/categories/:id", UpdateCategory)
-		api.DELETE("/admin/categories/:id", DeleteCategory)
+		admin.POST("/categories", RequireRole(RoleSuperAdmin), CreateCategory)
+		admin.PUT("/categories/:id", RequireRole(RoleSuperAdmin), UpdateCategory)
+		admin.DELETE("/categories/:id", RequireRole(RoleSuperAdmin), DeleteCategory)
+		admin.GET("/categories/:id/impact", RequireRole(RoleSuperAdmin), GetCategoryImpact)
 
 		// Admin routes - Documents
-		api.POST("/admin/upload", UploadDocument)
-		api.DELETE("/admin/documents/:id", DeleteDocument)
+		admin.POST("/upload", UploadDocument)
+		admin.POST("/upload/bulk", UploadDocuments)
+		admin.POST("/import", ImportArchive)
+		admin.POST("/uploads", CreateUpload)
+		admin.HEAD("/uploads/:id", HeadUpload)
+		admin.GET("/uploads/:id", GetUpload)
+		admin.PATCH("/uploads/:id", PatchUpload)
+		admin.DELETE("/uploads/:id", AbortUpload)
+		admin.PUT("/documents/:id", UpdateDocument)
+		admin.PUT("/documents/:id/file", ReplaceDocumentFile)
+		admin.DELETE("/documents/:id", DeleteDocument)
+		admin.GET("/documents/:id/versions", GetDocumentVersions)
+		admin.GET("/documents/:id/versions/:version/download", DownloadDocumentVersion)
+		admin.POST("/documents/:id/versions/:version/rollback", RollbackDocument)
+		admin.POST("/documents/:id/rescan", RescanDocument)
+
+		// Admin routes - Users & roles
+		users := admin.Group("/users", RequireRole(RoleSuperAdmin))
+		users.GET("", GetAdminUsers)
+		users.POST("", CreateAdminUser)
+		users.POST("/:id/grants", AssignRole)
+		users.DELETE("/:id/grants/:grant_id", RevokeRole)
+		users.DELETE("/:id/2fa", ResetUserTOTP)
+
+		// Admin routes - Read cache
+		admin.GET("/cache", RequireRole(RoleSuperAdmin), GetCacheStats)
+		admin.DELETE("/cache", RequireRole(RoleSuperAdmin), FlushCache)
+
+		// Admin routes - Trash
+		trash := admin.Group("/trash", RequireRole(RoleSuperAdmin))
+		trash.GET("", GetTrash)
+		trash.POST("/:entity/:id/restore", RestoreFromTrash)
+		trash.DELETE("/:entity/:id", PurgeFromTrash)
+
+		// Admin routes - Role policies
+		admin.GET("/policies", RequireRole(RoleSuperAdmin), GetRolePolicies)
+		admin.PUT("/policies/:role", RequireRole(RoleSuperAdmin), UpdateRolePolicy)
+
+		// Admin routes - Backups
+		admin.GET("/backup", RequireRole(RoleSuperAdmin), DownloadBackup)
+
+		// Admin routes - Integrity check
+		admin.GET("/fsck", RequireRole(RoleSuperAdmin), GetIntegrityReport)
+		admin.POST("/fsck/repair", RequireRole(RoleSuperAdmin), RepairIntegrity)
+	}
+	return r
+}
+
+func main() {
+	if err := openDB(); err != nil {
+		log.Fatal("Failed to open database:", err)
+	}
+	defer db.Close()
+
+	if err := openStorage(); err != nil {
+		log.Fatal("Failed to open file storage:", err)
+	}
+	if err := openScanner(); err != nil {
+		log.Fatal("Failed to configure malware scanner:", err)
 	}
 
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if err := initDB(); err != nil {
+		log.Fatal("Failed to initialize database:", err)
+	}
+
+	if err := rebuildSearchIndex(); err != nil {
+		log.Fatal("Failed to build the search index:", err)
+	}
+
+	if err := bootstrapAdmin(); err != nil {
+		log.Fatal("Failed to create admin account:", err)
+	}
+	startTrashPurger()
+	startScanWorker()
+	startUploadJanitor()
+	startBackupScheduler()
+
+	r := newRouter()
+
 	log.Println("✅ Database initialized successfully")
 	log.Println("🚀 StudyDz Server running on http://localhost:8080")
 	log.Println("📊 Stats: http://localhost:8080/api/stats")
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========== FILE STORAGE ==========
+//
+// Document files are addressed by keys such as "blobs/<aa>/<sha256>" or the
+// legacy "uploads/<name>" and "trash/<name>", which are also what
+// documents.file_path and document_versions.file_path record. The backend is
+// chosen with STORAGE_BACKEND:
+//
+//	local  files under STORAGE_DIR (default: the working directory)
+//	s3     objects in an S3-compatible bucket, see s3.go
+//
+// Missing files are reported with errors matching fs.ErrNotExist.
+
+type Storage interface {
+	Put(key string, r io.Reader, size int64) error
+	Get(key string) (io.ReadCloser, ObjectInfo, error)
+	Stat(key string) (ObjectInfo, error)
+	Delete(key string) error
+	Move(src, dst string) error
+	// List calls fn for every file whose key starts with prefix.
+	List(prefix string, fn func(key string, info ObjectInfo) error) error
+}
+
+type ObjectInfo struct {
+	Size    int64
+	ModTime time.Time
+}
+
+var store Storage
+
+func openStorage() error {
+	switch backend := os.Getenv("STORAGE_BACKEND"); backend {
+	case "", "local":
+		dir := os.Getenv("STORAGE_DIR")
+		if dir == "" {
+			dir = "."
+		}
+		store = &localStorage{root: dir}
+	case "s3":
+		s3, err := newS3StorageFromEnv()
+		if err != nil {
+			return err
+		}
+		store = s3
+	default:
+		return fmt.Errorf("unknown STORAGE_BACKEND %q", backend)
+	}
+	return nil
+}
+
+// cleanKey turns a key into a slash-separated path that cannot climb out of
+// the storage root.
+func cleanKey(key string) string {
+	return path.Clean("/" + key)[1:]
+}
+
+// ========== LOCAL STORAGE ==========
+
+type localStorage struct {
+	root string
+}
+
+func (s *localStorage) path(key string) string {
+	return filepath.Join(s.root, filepath.FromSlash(cleanKey(key)))
+}
+
+// Put writes the file under a temporary name in the same directory and
+// renames it onto the key once it is complete and synced, so that a key never
+// holds a partial file and concurrent writers of the same key cannot clobber
+// each other's data.
+func (s *localStorage) Put(key string, r io.Reader, size int64) error {
+	p := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(p), filepath.Base(p)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, r)
+	if err == nil && n != size {
+		err = fmt.Errorf("writing %s: got %d bytes, want %d", key, n, size)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func (s *localStorage) Get(key string) (io.ReadCloser, ObjectInfo, error) {
+	f, err := os.Open(s.path(key))
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, ObjectInfo{}, err
+	}
+	if fi.IsDir() {
+		f.Close()
+		return nil, ObjectInfo{}, fs.ErrNotExist
+	}
+	return f, ObjectInfo{Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+func (s *localStorage) Stat(key string) (ObjectInfo, error) {
+	fi, err := os.Stat(s.path(key))
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if fi.IsDir() {
+		return ObjectInfo{}, fs.ErrNotExist
+	}
+	return ObjectInfo{Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+func (s *localStorage) Delete(key string) error {
+	return os.Remove(s.path(key))
+}
+
+func (s *localStorage) Move(src, dst string) error {
+	p := s.path(dst)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	return os.Rename(s.path(src), p)
+}
+
+func (s *localStorage) List(prefix string, fn func(key string, info ObjectInfo) error) error {
+	err := filepath.WalkDir(s.path(prefix), func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return fn(filepath.ToSlash(rel), ObjectInfo{Size: fi.Size(), ModTime: fi.ModTime()})
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// ========== SERVING STORED FILES ==========
+
+// serveObject streams a stored file. A non-empty downloadName makes it an
+// attachment under that name; without a contentType it is guessed from the
+// extension. Local files are served with range support.
+func serveObject(c *gin.Context, key, downloadName, contentType string) {
+	body, info, err := store.Get(key)
+	if errors.Is(err, fs.ErrNotExist) {
+		c.JSON(404, gin.H{"error": "File not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	defer body.Close()
+
+	name := path.Base(key)
+	if downloadName != "" {
+		name = downloadName
+		c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": downloadName}))
+	}
+
+	if contentType == "" {
+		contentType = mime.TypeByExtension(path.Ext(name))
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	c.Header("X-Content-Type-Options", "nosniff")
+
+	if seeker, ok := body.(io.ReadSeeker); ok {
+		c.Header("Content-Type", contentType)
+		http.ServeContent(c.Writer, c.Request, name, info.ModTime, seeker)
+		return
+	}
+
+	if !info.ModTime.IsZero() {
+		c.Header("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+	}
+	c.DataFromReader(200, info.Size, contentType, body, nil)
+}
+
+// ServeUpload replaces the static /uploads route so that it works with any
+// storage backend. Only keys under uploads/ are reachable. Their content was
+// never sniffed, so only allowed extensions are served, typed from
+// allowedUploadTypes and always as attachments.
+func ServeUpload(c *gin.Context) {
+	key := "uploads" + path.Clean("/"+c.Param("filepath"))
+	contentType, ok := extensionType(strings.ToLower(path.Ext(key)))
+	if !ok {
+		c.JSON(404, gin.H{"error": "File not found"})
+		return
+	}
+	serveObject(c, key, path.Base(key), contentType)
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========== TOTP (RFC 6238) ==========
+
+const (
+	totpIssuer        = "StudyDz"
+	totpPeriod        = 30
+	totpDigits        = 6
+	totpSkew          = 1
+	recoveryCodeCount = 10
+	// After maxTOTPFailures wrong codes in a row, login refuses the admin's
+	// codes for totpLockout.
+	maxTOTPFailures = 5
+	totpLockout     = 15 * time.Minute
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func newTOTPSecret() (string, error) {
+	buf := make([]byte, 20)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(buf), nil
+}
+
+func totpURI(secret, username string) string {
+	label := url.PathEscape(totpIssuer + ":" + username)
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", totpIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// hotp computes the RFC 4226 one-time password for a counter value.
+func hotp(key []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, code%mod)
+}
+
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+func totpCode(secret string, t time.Time) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	return hotp(key, uint64(totpStep(t))), nil
+}
+
+// verifyTOTP accepts codes from the adjacent time steps to tolerate clock
+// drift, but never a step at or before lastStep so a code cannot be replayed.
+// It returns the matched step.
+func verifyTOTP(secret, code string, t time.Time, lastStep int64) (int64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return 0, false
+	}
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+
+	current := totpStep(t)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(hotp(key, uint64(step))), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// ========== 2FA STORAGE ==========
+
+type totpState struct {
+	Secret      string
+	Enabled     bool
+	LastStep    int64
+	LockedUntil int64
+}
+
+func loadTOTP(adminID int) (totpState, error) {
+	var st totpState
+	err := db.QueryRow("SELECT secret, enabled, last_step, locked_until FROM admin_totp WHERE admin_id = ?", adminID).
+		Scan(&st.Secret, &st.Enabled, &st.LastStep, &st.LockedUntil)
+	if err == sql.ErrNoRows {
+		return totpState{}, nil
+	}
+	return st, err
+}
+
+// lockedFor returns how long login still refuses the admin's codes.
+func (st totpState) lockedFor(now time.Time) time.Duration {
+	return time.Unix(st.LockedUntil, 0).Sub(now)
+}
+
+// recordTOTPAttempt counts a wrong login code, locking the admin's codes once
+// maxTOTPFailures are reached, or clears the count after a right one.
+func recordTOTPAttempt(adminID int, ok bool) error {
+	if ok {
+		_, err := db.Exec("UPDATE admin_totp SET failed_attempts = 0 WHERE admin_id = ?", adminID)
+		return err
+	}
+	_, err := db.Exec(`UPDATE admin_totp
+                       SET failed_attempts = CASE WHEN failed_attempts + 1 >= ? THEN 0 ELSE failed_attempts + 1 END,
+                           locked_until = CASE WHEN failed_attempts + 1 >= ? THEN ? ELSE locked_until END
+                       WHERE admin_id = ?`,
+		maxTOTPFailures, maxTOTPFailures, timeNow().Add(totpLockout).Unix(), adminID)
+	return err
+}
+
+// attemptTOTP runs check against the admin's two-factor lock: while it is
+// active it answers 429 with Retry-After without checking, otherwise the
+// result is counted by recordTOTPAttempt. answered reports that a response
+// has already been written; callers answer a rejected code themselves.
+func attemptTOTP(c *gin.Context, adminID int, st totpState, check func() bool) (ok, answered bool) {
+	if retryAfter := st.lockedFor(timeNow()); retryAfter > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+		c.JSON(429, gin.H{"error": "Too many invalid two-factor codes, try again later", "otp_required": true})
+		return false, true
+	}
+	ok = check()
+	if err := recordTOTPAttempt(adminID, ok); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return false, true
+	}
+	return ok, false
+}
+
+// checkTOTP verifies a code for an admin and records the used step.
+func checkTOTP(adminID int, st totpState, code string) bool {
+	step, ok := verifyTOTP(st.Secret, code, timeNow(), st.LastStep)
+	if !ok {
+		return false
+	}
+	res, err := db.Exec("UPDATE admin_totp SET last_step = ? WHERE admin_id = ? AND last_step < ?", step, adminID, step)
+	if err != nil {
+		return false
+	}
+	n, _ := res.RowsAffected()
+	return n == 1
+}
+
+func newRecoveryCodes(adminID int) ([]string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM admin_recovery_codes WHERE admin_id = ?", adminID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		buf := make([]byte, 5)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		raw := strings.ToLower(totpEncoding.EncodeToString(buf))
+		code := raw[:4] + "-" + raw[4:]
+		if _, err := tx.Exec("INSERT INTO admin_recovery_codes (admin_id, code_hash) VALUES (?, ?)",
+			adminID, hashToken(code)); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, tx.Commit()
+}
+
+func useRecoveryCode(adminID int, code string) bool {
+	code = strings.ToLower(strings.TrimSpace(code))
+	res, err := db.Exec(`UPDATE admin_recovery_codes SET used_at = CURRENT_TIMESTAMP
+                         WHERE admin_id = ? AND code_hash = ? AND used_at IS NULL`, adminID, hashToken(code))
+	if err != nil {
+		return false
+	}
+	n, _ := res.RowsAffected()
+	return n == 1
+}
+
+// requires2FA reports whether any role held by the admin has the
+// "2FA required" policy switched on.
+func requires2FA(grants []Grant) (bool, error) {
+	for _, g := range grants {
+		var required bool
+		err := db.QueryRow("SELECT require_2fa FROM role_policies WHERE role = ?", g.Role).Scan(&required)
+		if err != nil && err != sql.ErrNoRows {
+			return false, err
+		}
+		if required {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Require2FA blocks admins whose role demands two-factor authentication until
+// they have enrolled. Enrolment routes are registered outside this middleware.
+func Require2FA() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		grants, err := currentGrants(c)
+		if err != nil {
+			c.AbortWithStatusJSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		required, err := requires2FA(grants)
+		if err != nil {
+			c.AbortWithStatusJSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		if required {
+			st, err := loadTOTP(currentAdmin(c).ID)
+			if err != nil {
+				c.AbortWithStatusJSON(500, gin.H{"error": err.Error()})
+				return
+			}
+			if !st.Enabled {
+				c.AbortWithStatusJSON(403, gin.H{"error": "Two-factor authentication is required for your role", "enrollment_required": true})
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+// ========== 2FA HANDLERS ==========
+
+func EnrollTOTP(c *gin.Context) {
+	admin := currentAdmin(c)
+	st, err := loadTOTP(admin.ID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if st.Enabled {
+		c.JSON(409, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	_, err = db.Exec(`INSERT INTO admin_totp (admin_id, secret, enabled, last_step) VALUES (?, ?, 0, 0)
+                      ON CONFLICT(admin_id) DO UPDATE SET secret = excluded.secret, enabled = 0, last_step = 0,
+                                                          failed_attempts = 0, locked_until = 0`,
+		admin.ID, secret)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"secret": secret, "otpauth_uri": totpURI(secret, admin.Username)})
+}
+
+func ConfirmTOTP(c *gin.Context) {
+	var input struct {
+		Code string `json:"code"`
+	}
+	if err := c.BindJSON(&input); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	admin := currentAdmin(c)
+	st, err := loadTOTP(admin.ID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if st.Secret == "" {
+		c.JSON(400, gin.H{"error": "Start enrolment first"})
+		return
+	}
+	if st.Enabled {
+		c.JSON(409, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+	if !checkTOTP(admin.ID, st, input.Code) {
+		c.JSON(400, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	if _, err := db.Exec("UPDATE admin_totp SET enabled = 1 WHERE admin_id = ?", admin.ID); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	// Sessions opened with the password alone must not outlive the switch.
+	if _, err := db.Exec("DELETE FROM admin_sessions WHERE admin_id = ? AND token_hash <> ?",
+		admin.ID, hashToken(c.GetString("session_token"))); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	codes, err := newRecoveryCodes(admin.ID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "Two-factor authentication enabled", "recovery_codes": codes})
+}
+
+func RegenerateRecoveryCodes(c *gin.Context) {
+	var input struct {
+		Code string `json:"code"`
+	}
+	if err := c.BindJSON(&input); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	admin := currentAdmin(c)
+	st, err := loadTOTP(admin.ID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if !st.Enabled {
+		c.JSON(400, gin.H{"error": "Invalid code"})
+		return
+	}
+	ok, answered := attemptTOTP(c, admin.ID, st, func() bool { return checkTOTP(admin.ID, st, input.Code) })
+	if answered {
+		return
+	}
+	if !ok {
+		c.JSON(400, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	codes, err := newRecoveryCodes(admin.ID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"recovery_codes": codes})
+}
+
+func DisableTOTP(c *gin.Context) {
+	var input struct {
+		Code string `json:"code"`
+	}
+	if err := c.BindJSON(&input); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	admin := currentAdmin(c)
+	st, err := loadTOTP(admin.ID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if !st.Enabled {
+		c.JSON(400, gin.H{"error": "Invalid code"})
+		return
+	}
+	ok, answered := attemptTOTP(c, admin.ID, st, func() bool {
+		return checkTOTP(admin.ID, st, input.Code) || useRecoveryCode(admin.ID, input.Code)
+	})
+	if answered {
+		return
+	}
+	if !ok {
+		c.JSON(400, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	if err := resetTOTP(admin.ID); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"message": "Two-factor authentication disabled"})
+}
+
+// ResetUserTOTP lets a super admin clear the 2FA of a user who lost their device.
+func ResetUserTOTP(c *gin.Context) {
+	var adminID int
+	if err := db.QueryRow("SELECT id FROM admins WHERE id = ?", c.Param("id")).Scan(&adminID); err != nil {
+		c.JSON(404, gin.H{"error": "User not found"})
+		return
+	}
+	if err := resetTOTP(adminID); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"message": "Two-factor authentication reset"})
+}
+
+func resetTOTP(adminID int) error {
+	if _, err := db.Exec("DELETE FROM admin_totp WHERE admin_id = ?", adminID); err != nil {
+		return err
+	}
+	_, err := db.Exec("DELETE FROM admin_recovery_codes WHERE admin_id = ?", adminID)
+	return err
+}
+
+// ========== 2FA POLICY HANDLERS ==========
+
+func GetRolePolicies(c *gin.Context) {
+	policies := []gin.H{}
+	for _, role := range []string{RoleSuperAdmin, RoleLevelEditor, RoleUploader} {
+		var required bool
+		db.QueryRow("SELECT require_2fa FROM role_policies WHERE role = ?", role).Scan(&required)
+		policies = append(policies, gin.H{"role": role, "require_2fa": required})
+	}
+	c.JSON(200, policies)
+}
+
+func UpdateRolePolicy(c *gin.Context) {
+	role := c.Param("role")
+	if _, ok := roleRank[role]; !ok {
+		c.JSON(404, gin.H{"error": "Unknown role"})
+		return
+	}
+
+	var input struct {
+		Require2FA bool `json:"require_2fa"`
+	}
+	if err := c.BindJSON(&input); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	_, err := db.Exec(`INSERT INTO role_policies (role, require_2fa) VALUES (?, ?)
+                       ON CONFLICT(role) DO UPDATE SET require_2fa = excluded.require_2fa`, role, input.Require2FA)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"message": "Policy updated successfully"})
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 key of RFC 6238 appendix B, "12345678901234567890".
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPVectors(t *testing.T) {
+	// The RFC lists 8-digit codes; ours are their last 6 digits.
+	vectors := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, v := range vectors {
+		code, err := totpCode(rfc6238Secret, time.Unix(v.unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != v.code {
+			t.Errorf("totpCode at %d = %s, want %s", v.unix, code, v.code)
+		}
+	}
+}
+
+func TestVerifyTOTPSkew(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	for _, tc := range []struct {
+		steps int
+		ok    bool
+	}{
+		{-2, false},
+		{-1, true},
+		{0, true},
+		{1, true},
+		{2, false},
+	} {
+		code, _ := totpCode(rfc6238Secret, now.Add(time.Duration(tc.steps*totpPeriod)*time.Second))
+		step, ok := verifyTOTP(rfc6238Secret, code, now, 0)
+		if ok != tc.ok {
+			t.Errorf("code %+d steps away: ok = %v, want %v", tc.steps, ok, tc.ok)
+		}
+		if ok && step != totpStep(now)+int64(tc.steps) {
+			t.Errorf("code %+d steps away matched step %d", tc.steps, step)
+		}
+	}
+}
+
+func TestVerifyTOTPRejectsUsedSteps(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	code, _ := totpCode(rfc6238Secret, now)
+	if _, ok := verifyTOTP(rfc6238Secret, code, now, totpStep(now)); ok {
+		t.Error("code of the last used step accepted")
+	}
+	previous, _ := totpCode(rfc6238Secret, now.Add(-totpPeriod*time.Second))
+	if _, ok := verifyTOTP(rfc6238Secret, previous, now, totpStep(now)); ok {
+		t.Error("code older than the last used step accepted")
+	}
+}
+
+func TestCheckTOTPReplay(t *testing.T) {
+	openTestDB(t)
+	now := time.Unix(1234567890, 0)
+	setClock(t, now)
+
+	adminID, err := createAdmin("totp", "secretpass1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO admin_totp (admin_id, secret, enabled) VALUES (?, ?, 1)", adminID, rfc6238Secret); err != nil {
+		t.Fatal(err)
+	}
+	code, _ := totpCode(rfc6238Secret, now)
+
+	for i, want := range []bool{true, false} {
+		st, err := loadTOTP(adminID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := checkTOTP(adminID, st, code); got != want {
+			t.Errorf("attempt %d: checkTOTP = %v, want %v", i+1, got, want)
+		}
+	}
+
+	// A concurrent request holding the state loaded before the first use
+	// loses the race on last_step.
+	if checkTOTP(adminID, totpState{Secret: rfc6238Secret, Enabled: true}, code) {
+		t.Error("replay with a stale last_step accepted")
+	}
+}
+
+func TestRecoveryCodesSingleUse(t *testing.T) {
+	openTestDB(t)
+	adminID, err := createAdmin("recovery", "secretpass1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, err := newRecoveryCodes(adminID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("got %d recovery codes, want %d", len(codes), recoveryCodeCount)
+	}
+
+	if !useRecoveryCode(adminID, " "+codes[0]+" ") {
+		t.Error("fresh recovery code rejected")
+	}
+	if useRecoveryCode(adminID, codes[0]) {
+		t.Error("used recovery code accepted again")
+	}
+	if useRecoveryCode(adminID, "nope-nope") {
+		t.Error("unknown recovery code accepted")
+	}
+
+	// Regenerating replaces the old codes.
+	fresh, err := newRecoveryCodes(adminID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if useRecoveryCode(adminID, codes[1]) {
+		t.Error("code from a replaced set accepted")
+	}
+	if !useRecoveryCode(adminID, fresh[1]) {
+		t.Error("code from the new set rejected")
+	}
+}
+
+// enableTestTOTP turns 2FA on for the admin with the RFC 6238 secret.
+func enableTestTOTP(t *testing.T, adminID int) {
+	t.Helper()
+	if _, err := db.Exec("INSERT INTO admin_totp (admin_id, secret, enabled) VALUES (?, ?, 1)",
+		adminID, rfc6238Secret); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoginLocksTwoFactorAfterFailures(t *testing.T) {
+	openTestDB(t)
+	now := time.Unix(1234567890, 0)
+	setClock(t, now)
+	id, _ := addTestAdmin(t, "alice", RoleSuperAdmin, nil, nil, nil)
+	enableTestTOTP(t, id)
+	codes, err := newRecoveryCodes(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	login := func(otp, recovery string) int {
+		return call(t, "POST", "/api/admin/login", "", map[string]string{
+			"username": "alice", "password": "password-alice", "otp": otp, "recovery_code": recovery,
+		}, nil)
+	}
+	if code := login("", ""); code != 401 {
+		t.Fatalf("login without a code: %d, want 401", code)
+	}
+	// A missing code is not a guess; wrong codes and recovery codes are.
+	for i := 0; i < maxTOTPFailures; i++ {
+		otp, recovery := "000000", ""
+		if i%2 == 1 {
+			otp, recovery = "", "zzzz-zzzz"
+		}
+		if code := login(otp, recovery); code != 401 {
+			t.Fatalf("wrong code %d: %d, want 401", i+1, code)
+		}
+	}
+
+	right, _ := totpCode(rfc6238Secret, now)
+	w := serve(testRequest("POST", "/api/admin/login", "", map[string]string{
+		"username": "alice", "password": "password-alice", "otp": right,
+	}))
+	if w.Code != 429 || w.Header().Get("Retry-After") != "900" {
+		t.Fatalf("right code while locked: %d, Retry-After %q; want 429, 900", w.Code, w.Header().Get("Retry-After"))
+	}
+	if code := login("", codes[0]); code != 429 {
+		t.Fatalf("recovery code while locked: %d, want 429", code)
+	}
+
+	setClock(t, now.Add(totpLockout))
+	right, _ = totpCode(rfc6238Secret, timeNow())
+	if code := login(right, ""); code != 200 {
+		t.Fatalf("right code after the lockout: %d, want 200", code)
+	}
+	var failed int
+	db.QueryRow("SELECT failed_attempts FROM admin_totp WHERE admin_id = ?", id).Scan(&failed)
+	if failed != 0 {
+		t.Errorf("failed attempts after a login = %d, want 0", failed)
+	}
+}
+
+func TestTwoFactorSettingsShareTheLock(t *testing.T) {
+	for _, tc := range []struct {
+		method, target string
+	}{
+		{"POST", "/api/admin/2fa/recovery-codes"},
+		{"DELETE", "/api/admin/2fa"},
+	} {
+		t.Run(tc.target, func(t *testing.T) {
+			openTestDB(t)
+			now := time.Unix(1234567890, 0)
+			setClock(t, now)
+			id, token := addTestAdmin(t, "alice", RoleSuperAdmin, nil, nil, nil)
+			enableTestTOTP(t, id)
+
+			for i := 0; i < maxTOTPFailures; i++ {
+				if code := call(t, tc.method, tc.target, token, map[string]string{"code": "000000"}, nil); code != 400 {
+					t.Fatalf("wrong code %d: %d, want 400", i+1, code)
+				}
+			}
+			right, _ := totpCode(rfc6238Secret, now)
+			w := serve(testRequest(tc.method, tc.target, token, map[string]string{"code": right}))
+			if w.Code != 429 || w.Header().Get("Retry-After") != "900" {
+				t.Fatalf("right code while locked: %d, Retry-After %q; want 429, 900", w.Code, w.Header().Get("Retry-After"))
+			}
+			// The lock is the one login uses.
+			if code := call(t, "POST", "/api/admin/login", "", map[string]string{
+				"username": "alice", "password": "password-alice", "otp": right,
+			}, nil); code != 429 {
+				t.Fatalf("login while locked: %d, want 429", code)
+			}
+
+			setClock(t, now.Add(totpLockout))
+			right, _ = totpCode(rfc6238Secret, timeNow())
+			if code := call(t, tc.method, tc.target, token, map[string]string{"code": right}, nil); code != 200 {
+				t.Fatalf("right code after the lockout: %d, want 200", code)
+			}
+		})
+	}
+}
+
+func TestEnablingTwoFactorEndsOtherSessions(t *testing.T) {
+	openTestDB(t)
+	setClock(t, time.Unix(1234567890, 0))
+	id, current := addTestAdmin(t, "alice", RoleSuperAdmin, nil, nil, nil)
+	other := addTestSession(t, id)
+
+	var enrolment struct {
+		Secret string `json:"secret"`
+	}
+	if code := call(t, "POST", "/api/admin/2fa/enroll", current, nil, &enrolment); code != 200 {
+		t.Fatalf("enroll: %d", code)
+	}
+	otp, _ := totpCode(enrolment.Secret, timeNow())
+	if code := call(t, "POST", "/api/admin/2fa/confirm", current, map[string]string{"code": otp}, nil); code != 200 {
+		t.Fatalf("confirm: %d", code)
+	}
+
+	if code := call(t, "GET", "/api/admin/me", current, nil, nil); code != 200 {
+		t.Errorf("the enrolling session: %d, want 200", code)
+	}
+	if code := call(t, "GET", "/api/admin/me", other, nil, nil); code != 401 {
+		t.Errorf("another session after enabling 2FA: %d, want 401", code)
+	}
+}
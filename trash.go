@@ -0,0 +1,406 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========== SOFT DELETE & TRASH ==========
+//
+// Deleting from the admin API only stamps deleted_at on the node and on its
+// live descendants, with a delete_batch naming that delete so that a restore
+// brings back exactly what it removed. Legacy files under uploads/ move to
+// trashDir and back; content-addressed blobs may be shared and stay where
+// they are, as do quarantined files. Purging a trashed node hard-deletes it
+// with the policies of integrity.go.
+
+const trashDir = "trash"
+
+var errParentTrashed = errors.New("parent is in the trash")
+
+type descendant struct {
+	table  string
+	filter string
+}
+
+type softDeletable struct {
+	table      string
+	nameColumn string
+	// documents selects the documents removed together with the node.
+	documents string
+	// descendants lists the other tables whose rows go to the trash with the node.
+	descendants []descendant
+	// trashedParents counts trashed parents; a node cannot be restored under them.
+	trashedParents string
+	purge          func(any) error
+}
+
+var softDeletables = map[string]softDeletable{
+	"levels": {
+		table:       "levels",
+		nameColumn:  "name_ar",
+		documents:   documentsOfLevel,
+		descendants: []descendant{{"subjects", subjectsOfLevel}, {"years", "level_id = ?"}},
+		purge:       deleteLevelCascade,
+	},
+	"years": {
+		table:          "years",
+		nameColumn:     "name_ar",
+		documents:      documentsOfYear,
+		descendants:    []descendant{{"subjects", "year_id = ?"}},
+		trashedParents: "SELECT COUNT(*) FROM years y JOIN levels l ON y.level_id = l.id WHERE y.id = ? AND l.deleted_at IS NOT NULL",
+		purge:          deleteYearCascade,
+	},
+	"subjects": {
+		table:          "subjects",
+		nameColumn:     "name_ar",
+		documents:      "subject_id = ?",
+		trashedParents: "SELECT COUNT(*) FROM subjects s JOIN years y ON s.year_id = y.id WHERE s.id = ? AND y.deleted_at IS NOT NULL",
+		purge:          deleteSubjectCascade,
+	},
+	"categories": {
+		table:      "categories",
+		nameColumn: "name_ar",
+		purge:      deleteCategoryRestrict,
+	},
+	"documents": {
+		table:      "documents",
+		nameColumn: "title",
+		documents:  "id = ?",
+		trashedParents: `SELECT COUNT(*) FROM documents d
+                         JOIN subjects s ON d.subject_id = s.id
+                         JOIN categories cat ON d.category_id = cat.id
+                         WHERE d.id = ? AND (s.deleted_at IS NOT NULL OR cat.deleted_at IS NOT NULL)`,
+		purge: deleteDocument,
+	},
+}
+
+// purgeOrder purges children before parents so each purge finds its rows.
+var purgeOrder = []string{"documents", "subjects", "years", "levels", "categories"}
+
+func queryFilePaths(tx *sql.Tx, query string, args ...any) ([]string, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, rows.Err()
+}
+
+// relocateFiles moves each legacy file under dir and records the new path on
+// the version and document rows that point at it. Other files and those
+// already missing from storage keep their recorded path. It returns the original
+// paths of moved files.
+func relocateFiles(tx *sql.Tx, paths []string, dir string) ([]string, error) {
+	var moved []string
+	for _, key := range paths {
+		if !strings.HasPrefix(key, "uploads/") && !strings.HasPrefix(key, trashDir+"/") {
+			continue
+		}
+		dst := path.Join(dir, path.Base(key))
+		if err := store.Move(key, dst); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return moved, err
+		}
+		moved = append(moved, key)
+		if _, err := tx.Exec("UPDATE document_versions SET file_path = ? WHERE file_path = ?", dst, key); err != nil {
+			return moved, err
+		}
+		if _, err := tx.Exec("UPDATE documents SET file_path = ? WHERE file_path = ?", dst, key); err != nil {
+			return moved, err
+		}
+	}
+	return moved, nil
+}
+
+// undoRelocation puts files back after the surrounding transaction failed.
+func undoRelocation(moved []string, dir string) {
+	for _, key := range moved {
+		if err := store.Move(path.Join(dir, path.Base(key)), key); err != nil {
+			log.Printf("⚠️  Could not move %s back: %v", key, err)
+		}
+	}
+}
+
+// newDeleteBatch names one delete; rows trashed by it carry the name.
+func newDeleteBatch() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func trashNode(entity string, id any) error {
+	node := softDeletables[entity]
+	deletedAt := currentTimestamp()
+	batch, err := newDeleteBatch()
+	if err != nil {
+		return err
+	}
+	trash := "SET deleted_at = ?, delete_batch = ? WHERE "
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE "+node.table+" "+trash+"id = ? AND deleted_at IS NULL", deletedAt, batch, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errNotFound
+	}
+	for _, d := range node.descendants {
+		if _, err := tx.Exec("UPDATE "+d.table+" "+trash+d.filter+" AND deleted_at IS NULL", deletedAt, batch, id); err != nil {
+			return err
+		}
+	}
+
+	var moved []string
+	if node.documents != "" {
+		if _, err := tx.Exec("UPDATE documents "+trash+node.documents+" AND deleted_at IS NULL", deletedAt, batch, id); err != nil {
+			return err
+		}
+		files, err := queryFilePaths(tx, versionFilesOf(node.documents+" AND delete_batch = ?"), id, batch)
+		if err != nil {
+			return err
+		}
+		if moved, err = relocateFiles(tx, files, trashDir); err != nil {
+			undoRelocation(moved, trashDir)
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		undoRelocation(moved, trashDir)
+		return err
+	}
+	invalidateTrashed(entity, id)
+	return nil
+}
+
+func restoreNode(entity string, id any) error {
+	node := softDeletables[entity]
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var trashed int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM "+node.table+" WHERE id = ? AND deleted_at IS NOT NULL", id).Scan(&trashed); err != nil {
+		return err
+	}
+	if trashed == 0 {
+		return errNotFound
+	}
+	if node.trashedParents != "" {
+		var parents int
+		if err := tx.QueryRow(node.trashedParents, id).Scan(&parents); err != nil {
+			return err
+		}
+		if parents > 0 {
+			return errParentTrashed
+		}
+	}
+
+	// Only rows trashed by the same delete come back; the node keeps its
+	// batch until last so the subqueries below can still read it.
+	sameDelete := " AND delete_batch = (SELECT delete_batch FROM " + node.table + " WHERE id = ?)"
+	restore := "SET deleted_at = NULL, delete_batch = NULL WHERE "
+
+	var moved []string
+	if node.documents != "" {
+		files, err := queryFilePaths(tx, versionFilesOf(node.documents+sameDelete), id, id)
+		if err != nil {
+			return err
+		}
+		if moved, err = relocateFiles(tx, files, "uploads"); err != nil {
+			undoRelocation(moved, "uploads")
+			return err
+		}
+		if node.table != "documents" {
+			if _, err := tx.Exec("UPDATE documents "+restore+node.documents+sameDelete, id, id); err != nil {
+				return err
+			}
+		}
+	}
+	for _, d := range node.descendants {
+		if _, err := tx.Exec("UPDATE "+d.table+" "+restore+d.filter+sameDelete, id, id); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("UPDATE "+node.table+" "+restore+"id = ?", id); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		undoRelocation(moved, "uploads")
+		return err
+	}
+	invalidateTrashed(entity, id)
+	return nil
+}
+
+func purgeNode(entity string, id any) error {
+	node := softDeletables[entity]
+	var trashed int
+	if err := db.QueryRow("SELECT COUNT(*) FROM "+node.table+" WHERE id = ? AND deleted_at IS NOT NULL", id).Scan(&trashed); err != nil {
+		return err
+	}
+	if trashed == 0 {
+		return errNotFound
+	}
+	return node.purge(id)
+}
+
+// ========== AUTOMATIC PURGE ==========
+
+// trashRetention is how long trashed items are kept, from TRASH_RETENTION_DAYS
+// (default 30). Zero disables the automatic purge.
+func trashRetention() time.Duration {
+	days, err := strconv.Atoi(os.Getenv("TRASH_RETENTION_DAYS"))
+	if err != nil || days < 0 {
+		days = 30
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+func purgeExpiredTrash(retention time.Duration) {
+	cutoff := timeNow().UTC().Add(-retention).Format("2006-01-02 15:04:05")
+	for _, entity := range purgeOrder {
+		node := softDeletables[entity]
+		rows, err := db.Query("SELECT id FROM "+node.table+" WHERE deleted_at IS NOT NULL AND deleted_at < ?", cutoff)
+		if err != nil {
+			log.Printf("⚠️  Trash purge of %s failed: %v", entity, err)
+			continue
+		}
+		var ids []int
+		for rows.Next() {
+			var id int
+			if rows.Scan(&id) == nil {
+				ids = append(ids, id)
+			}
+		}
+		rows.Close()
+
+		for _, id := range ids {
+			if err := node.purge(id); err != nil && !errors.Is(err, errNotFound) {
+				log.Printf("⚠️  Could not purge %s %d: %v", entity, id, err)
+			}
+		}
+		if len(ids) > 0 {
+			log.Printf("🗑️  Purged %d expired %s from the trash", len(ids), entity)
+		}
+	}
+}
+
+func startTrashPurger() {
+	retention := trashRetention()
+	if retention == 0 {
+		return
+	}
+	go func() {
+		for {
+			purgeExpiredTrash(retention)
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+// ========== TRASH HANDLERS ==========
+
+type TrashItem struct {
+	Entity    string    `json:"entity"`
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+func GetTrash(c *gin.Context) {
+	items := []TrashItem{}
+	for _, entity := range purgeOrder {
+		node := softDeletables[entity]
+		rows, err := db.Query("SELECT id, " + node.nameColumn + ", deleted_at FROM " + node.table +
+			" WHERE deleted_at IS NOT NULL ORDER BY deleted_at DESC")
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		for rows.Next() {
+			item := TrashItem{Entity: entity}
+			if err := rows.Scan(&item.ID, &item.Name, &item.DeletedAt); err != nil {
+				continue
+			}
+			items = append(items, item)
+		}
+		rows.Close()
+	}
+	c.JSON(200, gin.H{"items": items, "retention_days": int(trashRetention().Hours() / 24)})
+}
+
+func trashEntity(c *gin.Context) (string, bool) {
+	entity := c.Param("entity")
+	if _, ok := softDeletables[entity]; !ok {
+		c.JSON(404, gin.H{"error": "Unknown entity"})
+		return "", false
+	}
+	return entity, true
+}
+
+func RestoreFromTrash(c *gin.Context) {
+	entity, ok := trashEntity(c)
+	if !ok {
+		return
+	}
+
+	err := restoreNode(entity, c.Param("id"))
+	if errors.Is(err, errParentTrashed) {
+		c.JSON(409, gin.H{"error": "Restore the parent first: it is in the trash"})
+		return
+	}
+	if err != nil {
+		respondDeleteError(c, err)
+		return
+	}
+	c.JSON(200, gin.H{"message": "Restored successfully"})
+}
+
+func PurgeFromTrash(c *gin.Context) {
+	entity, ok := trashEntity(c)
+	if !ok {
+		return
+	}
+
+	if err := purgeNode(entity, c.Param("id")); err != nil {
+		respondDeleteError(c, err)
+		return
+	}
+	c.JSON(200, gin.H{"message": "Permanently deleted"})
+}
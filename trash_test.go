@@ -0,0 +1,170 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// isTrashed reports whether the row is in the trash, failing when it is gone.
+func isTrashed(t *testing.T, table string, id any) bool {
+	t.Helper()
+	var trashed bool
+	if err := db.QueryRow("SELECT deleted_at IS NOT NULL FROM "+table+" WHERE id = ?", id).Scan(&trashed); err != nil {
+		t.Fatalf("%s %v: %v", table, id, err)
+	}
+	return trashed
+}
+
+func TestTrashRestorePurge(t *testing.T) {
+	openTestDB(t)
+	seedTestData(t)
+	useTestStorage(t)
+	_, token := addTestAdmin(t, "root", RoleSuperAdmin, nil, nil, nil)
+	docID, key := addTestDocument(t, "cours", "%PDF-1.4 cours")
+
+	// The subject has a document: the delete needs the preview's token.
+	if code := call(t, "DELETE", "/api/admin/subjects/1", token, nil, nil); code != 409 {
+		t.Fatalf("unconfirmed delete: %d, want 409", code)
+	}
+	var impact DeleteImpact
+	call(t, "GET", "/api/admin/subjects/1/impact", token, nil, &impact)
+	if code := call(t, "DELETE", "/api/admin/subjects/1?confirm="+impact.ConfirmToken, token, nil, nil); code != 200 {
+		t.Fatalf("confirmed delete: %d, want 200", code)
+	}
+	if !isTrashed(t, "subjects", 1) || !isTrashed(t, "documents", docID) {
+		t.Fatal("subject and document not in the trash")
+	}
+
+	var trash struct {
+		Items []TrashItem `json:"items"`
+	}
+	call(t, "GET", "/api/admin/trash", token, nil, &trash)
+	listed := map[string]bool{}
+	for _, item := range trash.Items {
+		listed[fmt.Sprintf("%s/%d", item.Entity, item.ID)] = true
+	}
+	if !listed["subjects/1"] || !listed[fmt.Sprintf("documents/%d", docID)] {
+		t.Errorf("trash lists %v", listed)
+	}
+
+	if code := call(t, "POST", "/api/admin/trash/subjects/1/restore", token, nil, nil); code != 200 {
+		t.Fatalf("restore: %d, want 200", code)
+	}
+	if isTrashed(t, "subjects", 1) || isTrashed(t, "documents", docID) {
+		t.Fatal("restore left the subject or its document in the trash")
+	}
+
+	// A document cannot come back under a trashed subject.
+	call(t, "DELETE", fmt.Sprintf("/api/admin/documents/%d", docID), token, nil, nil)
+	call(t, "DELETE", "/api/admin/subjects/1", token, nil, nil)
+	if code := call(t, "POST", fmt.Sprintf("/api/admin/trash/documents/%d/restore", docID), token, nil, nil); code != 409 {
+		t.Errorf("restore under a trashed subject: %d, want 409", code)
+	}
+
+	if code := call(t, "DELETE", fmt.Sprintf("/api/admin/trash/documents/%d", docID), token, nil, nil); code != 200 {
+		t.Fatalf("purge: %d, want 200", code)
+	}
+	var rows int
+	db.QueryRow("SELECT COUNT(*) FROM documents WHERE id = ?", docID).Scan(&rows)
+	if rows != 0 {
+		t.Error("purged document still in the database")
+	}
+	if _, err := store.Stat(key); err == nil {
+		t.Error("purged document's file still stored")
+	}
+	if code := call(t, "DELETE", fmt.Sprintf("/api/admin/trash/documents/%d", docID), token, nil, nil); code != 404 {
+		t.Errorf("second purge: %d, want 404", code)
+	}
+}
+
+func TestRestoreOnlyBringsBackItsOwnDelete(t *testing.T) {
+	openTestDB(t)
+	seedTestData(t)
+	useTestStorage(t)
+	// Both deletes happen within the same second.
+	setClock(t, time.Date(2024, 9, 30, 10, 0, 0, 0, time.UTC))
+	alone, _ := addTestDocument(t, "seul", "%PDF-1.4 seul")
+	withSubject, _ := addTestDocument(t, "cours", "%PDF-1.4 cours")
+
+	if err := trashNode("documents", alone); err != nil {
+		t.Fatal(err)
+	}
+	if err := trashNode("subjects", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := restoreNode("subjects", 1); err != nil {
+		t.Fatal(err)
+	}
+	if isTrashed(t, "documents", withSubject) {
+		t.Error("the subject's document stayed in the trash")
+	}
+	if !isTrashed(t, "documents", alone) {
+		t.Error("a document deleted on its own came back with the subject")
+	}
+}
+
+func TestPurgeExpiredTrash(t *testing.T) {
+	openTestDB(t)
+	seedTestData(t)
+	useTestStorage(t)
+	start := time.Date(2024, 9, 1, 10, 0, 0, 0, time.UTC)
+	old, _ := addTestDocument(t, "ancien", "%PDF-1.4 ancien")
+	recent, _ := addTestDocument(t, "recent", "%PDF-1.4 recent")
+
+	setClock(t, start)
+	if err := trashNode("documents", old); err != nil {
+		t.Fatal(err)
+	}
+	setClock(t, start.Add(10*24*time.Hour))
+	if err := trashNode("documents", recent); err != nil {
+		t.Fatal(err)
+	}
+
+	setClock(t, start.Add(30*24*time.Hour+time.Minute))
+	purgeExpiredTrash(30 * 24 * time.Hour)
+	var rows int
+	db.QueryRow("SELECT COUNT(*) FROM documents WHERE id = ?", old).Scan(&rows)
+	if rows != 0 {
+		t.Error("a document trashed 30 days ago was not purged")
+	}
+	if !isTrashed(t, "documents", recent) {
+		t.Error("a document trashed 20 days ago left the trash")
+	}
+}
+
+func TestTrashBatchMigrationGroupsByDeletedAt(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "old.db")
+	oldDB, err := sql.Open("sqlite", "file:"+file+"?_pragma=foreign_keys(1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := db
+	db = oldDB
+	t.Cleanup(func() {
+		oldDB.Close()
+		db = saved
+	})
+	if err := migrateUp(16); err != nil {
+		t.Fatal(err)
+	}
+	seedTestData(t)
+	db.Exec("UPDATE subjects SET deleted_at = '2024-09-01 10:00:00' WHERE year_id = 1")
+
+	if err := migrateUp(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := restoreNode("subjects", 1); err != nil {
+		t.Fatal(err)
+	}
+	var batch sql.NullString
+	db.QueryRow("SELECT delete_batch FROM subjects WHERE id = 2").Scan(&batch)
+	if batch.String != "2024-09-01 10:00:00" {
+		t.Errorf("trashed subject 2 batch = %q, want its deleted_at", batch.String)
+	}
+	if isTrashed(t, "subjects", 1) || !isTrashed(t, "subjects", 2) {
+		t.Error("restoring subject 1 did not restore it alone")
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========== HIERARCHY TREE ==========
+//
+// GET /api/tree returns levels → years → subjects in one response, each node
+// with the number of published documents below it and their downloads. It
+// runs one query per depth:
+//
+//	level_id or year_id   only the subtree of that level or year
+//	depth                 1 for levels, 2 down to years, 3 (default) down to subjects
+//
+// Children below the requested depth are null, not empty. The counts move with
+// every download, so the tree is cached for a short time only.
+
+const maxTreeDepth = 3
+
+type TreeCounts struct {
+	Documents int   `json:"documents"`
+	Downloads int64 `json:"downloads"`
+}
+
+type TreeSubject struct {
+	Subject
+	TreeCounts
+}
+
+type TreeYear struct {
+	Year
+	TreeCounts
+	Subjects []*TreeSubject `json:"subjects"`
+}
+
+type TreeLevel struct {
+	Level
+	TreeCounts
+	Years []*TreeYear `json:"years"`
+}
+
+// treeDocuments joins the published documents of a subject s.
+const treeDocuments = `LEFT JOIN documents d ON d.subject_id = s.id AND d.deleted_at IS NULL AND d.scan_status = 'clean'`
+
+// treeQueries list the nodes of each depth with their counts. Each ends in a
+// WHERE clause completed by the subtree condition and treeGroupBy.
+var treeQueries = [maxTreeDepth]string{
+	`SELECT l.id, l.name, l.name_ar, l.color, l.created_at, COUNT(d.id), COALESCE(SUM(d.downloads), 0)
+     FROM levels l
+     LEFT JOIN years y ON y.level_id = l.id AND y.deleted_at IS NULL
+     LEFT JOIN subjects s ON s.year_id = y.id AND s.deleted_at IS NULL
+     ` + treeDocuments + `
+     WHERE l.deleted_at IS NULL AND `,
+	`SELECT y.id, y.level_id, y.name, y.name_ar, y.created_at, COUNT(d.id), COALESCE(SUM(d.downloads), 0)
+     FROM years y
+     JOIN levels l ON l.id = y.level_id AND l.deleted_at IS NULL
+     LEFT JOIN subjects s ON s.year_id = y.id AND s.deleted_at IS NULL
+     ` + treeDocuments + `
+     WHERE y.deleted_at IS NULL AND `,
+	`SELECT s.id, s.year_id, s.name, s.name_ar, s.icon, s.created_at, COUNT(d.id), COALESCE(SUM(d.downloads), 0)
+     FROM subjects s
+     JOIN years y ON y.id = s.year_id AND y.deleted_at IS NULL
+     JOIN levels l ON l.id = y.level_id AND l.deleted_at IS NULL
+     ` + treeDocuments + `
+     WHERE s.deleted_at IS NULL AND `,
+}
+
+// treeGroupBy closes the query of each depth.
+var treeGroupBy = [maxTreeDepth]string{
+	" GROUP BY l.id ORDER BY l.id",
+	" GROUP BY y.id ORDER BY y.id",
+	" GROUP BY s.id ORDER BY s.id",
+}
+
+func GetTree(c *gin.Context) {
+	depth := maxTreeDepth
+	if value := c.Query("depth"); value != "" {
+		var err error
+		depth, err = strconv.Atoi(value)
+		if err != nil || depth < 1 || depth > maxTreeDepth {
+			c.JSON(400, gin.H{"error": "depth must be 1, 2 or 3"})
+			return
+		}
+	}
+
+	// Every query joins l and y, so the subtree condition applies to all.
+	subtree, arg, notFound := "1", "", ""
+	if value := c.Query("year_id"); value != "" {
+		subtree, arg, notFound = "l.id = (SELECT level_id FROM years WHERE id = ? AND deleted_at IS NULL)", value, "Year not found"
+	} else if value := c.Query("level_id"); value != "" {
+		subtree, arg, notFound = "l.id = ?", value, "Level not found"
+	}
+	args := []any{}
+	if arg != "" {
+		if _, err := strconv.Atoi(arg); err != nil {
+			c.JSON(400, gin.H{"error": "Invalid id"})
+			return
+		}
+		args = append(args, arg)
+	}
+	// Below the level, a year subtree keeps only that year.
+	yearSubtree := subtree
+	if c.Query("year_id") != "" {
+		yearSubtree = "y.id = ?"
+	}
+
+	levels := []*TreeLevel{}
+	levelsByID := map[int]*TreeLevel{}
+	rows, err := db.Query(treeQueries[0]+subtree+treeGroupBy[0], args...)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	for rows.Next() {
+		l := &TreeLevel{}
+		if err := rows.Scan(&l.ID, &l.Name, &l.NameAr, &l.Color, &l.CreatedAt, &l.Documents, &l.Downloads); err != nil {
+			rows.Close()
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		if depth > 1 {
+			l.Years = []*TreeYear{}
+		}
+		levels = append(levels, l)
+		levelsByID[l.ID] = l
+	}
+	rows.Close()
+	if notFound != "" && len(levels) == 0 {
+		c.JSON(404, gin.H{"error": notFound})
+		return
+	}
+
+	yearsByID := map[int]*TreeYear{}
+	if depth > 1 {
+		rows, err := db.Query(treeQueries[1]+yearSubtree+treeGroupBy[1], args...)
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		for rows.Next() {
+			y := &TreeYear{}
+			if err := rows.Scan(&y.ID, &y.LevelID, &y.Name, &y.NameAr, &y.CreatedAt, &y.Documents, &y.Downloads); err != nil {
+				rows.Close()
+				c.JSON(500, gin.H{"error": err.Error()})
+				return
+			}
+			if depth > 2 {
+				y.Subjects = []*TreeSubject{}
+			}
+			if l, ok := levelsByID[y.LevelID]; ok {
+				y.LevelName = l.NameAr
+				l.Years = append(l.Years, y)
+			}
+			yearsByID[y.ID] = y
+		}
+		rows.Close()
+	}
+
+	if depth > 2 {
+		rows, err := db.Query(treeQueries[2]+yearSubtree+treeGroupBy[2], args...)
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		for rows.Next() {
+			s := &TreeSubject{}
+			if err := rows.Scan(&s.ID, &s.YearID, &s.Name, &s.NameAr, &s.Icon, &s.CreatedAt, &s.Documents, &s.Downloads); err != nil {
+				rows.Close()
+				c.JSON(500, gin.H{"error": err.Error()})
+				return
+			}
+			if y, ok := yearsByID[s.YearID]; ok {
+				s.YearName = y.NameAr
+				y.Subjects = append(y.Subjects, s)
+			}
+		}
+		rows.Close()
+	}
+
+	c.JSON(200, gin.H{"levels": levels})
+}
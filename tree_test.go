@@ -0,0 +1,105 @@
+package main
+
+import "testing"
+
+type treeResponse struct {
+	Levels []*TreeLevel `json:"levels"`
+}
+
+func TestTree(t *testing.T) {
+	openTestDB(t)
+	seedTestData(t)
+	useTestStorage(t)
+	first, _ := addTestDocument(t, "cours", "%PDF-1.4 cours")
+	second, _ := addTestDocument(t, "examen", "%PDF-1.4 examen")
+	otherYear, _ := addTestDocument(t, "annee 2", "%PDF-1.4 annee 2")
+	trashed, _ := addTestDocument(t, "corbeille", "%PDF-1.4 corbeille")
+	inTrashedSubject, _ := addTestDocument(t, "arabe", "%PDF-1.4 arabe")
+	scanPendingFiles()
+	addTestDocument(t, "en attente", "%PDF-1.4 en attente")
+	db.Exec("UPDATE documents SET downloads = 3 WHERE id = ?", first)
+	db.Exec("UPDATE documents SET downloads = 4 WHERE id = ?", second)
+	db.Exec("UPDATE documents SET subject_id = 17, downloads = 5 WHERE id = ?", otherYear)
+	db.Exec("UPDATE documents SET subject_id = 2 WHERE id = ?", inTrashedSubject)
+	for _, node := range []struct {
+		entity string
+		id     any
+	}{{"documents", trashed}, {"subjects", 2}, {"years", 3}} {
+		if err := trashNode(node.entity, node.id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var tree treeResponse
+	if code := call(t, "GET", "/api/tree", "", nil, &tree); code != 200 {
+		t.Fatalf("tree: %d", code)
+	}
+	if len(tree.Levels) != 4 {
+		t.Fatalf("%d levels, want 4", len(tree.Levels))
+	}
+	primaire := tree.Levels[0]
+	if primaire.Documents != 3 || primaire.Downloads != 12 {
+		t.Errorf("level 1 counts %+v, want 3 documents and 12 downloads", primaire.TreeCounts)
+	}
+	if len(primaire.Years) != 4 {
+		t.Fatalf("level 1 has %d years, want 4 without the trashed one", len(primaire.Years))
+	}
+	year1, year2 := primaire.Years[0], primaire.Years[1]
+	if year1.Documents != 2 || year1.Downloads != 7 || year2.Documents != 1 || year2.Downloads != 5 {
+		t.Errorf("year counts %+v and %+v, want 2/7 and 1/5", year1.TreeCounts, year2.TreeCounts)
+	}
+	if len(year1.Subjects) != 15 || year1.Subjects[0].ID != 1 || year1.Subjects[1].ID != 3 {
+		t.Fatalf("year 1 has %d subjects, want 15 without the trashed subject 2", len(year1.Subjects))
+	}
+	if year1.Subjects[0].Documents != 2 || year1.Subjects[1].Documents != 0 {
+		t.Errorf("subject counts %d and %d, want 2 and 0", year1.Subjects[0].Documents, year1.Subjects[1].Documents)
+	}
+	for _, l := range tree.Levels[1:] {
+		if l.Documents != 0 {
+			t.Errorf("level %d has %d documents, want 0", l.ID, l.Documents)
+		}
+	}
+
+	// Depth leaves the children below it null.
+	tree = treeResponse{}
+	call(t, "GET", "/api/tree?depth=1", "", nil, &tree)
+	if tree.Levels[0].Years != nil || tree.Levels[0].Documents != 3 {
+		t.Errorf("depth 1: years %v, %d documents", tree.Levels[0].Years, tree.Levels[0].Documents)
+	}
+	tree = treeResponse{}
+	call(t, "GET", "/api/tree?depth=2", "", nil, &tree)
+	if len(tree.Levels[0].Years) != 4 || tree.Levels[0].Years[0].Subjects != nil {
+		t.Errorf("depth 2: %d years, subjects %v", len(tree.Levels[0].Years), tree.Levels[0].Years[0].Subjects)
+	}
+
+	// Subtrees.
+	tree = treeResponse{}
+	call(t, "GET", "/api/tree?year_id=2", "", nil, &tree)
+	if len(tree.Levels) != 1 || len(tree.Levels[0].Years) != 1 || tree.Levels[0].Years[0].ID != 2 {
+		t.Errorf("year 2 subtree: %+v", tree.Levels)
+	} else if len(tree.Levels[0].Years[0].Subjects) != 16 || tree.Levels[0].Years[0].Documents != 1 {
+		t.Errorf("year 2 subtree: %d subjects, %d documents", len(tree.Levels[0].Years[0].Subjects), tree.Levels[0].Years[0].Documents)
+	}
+	tree = treeResponse{}
+	call(t, "GET", "/api/tree?level_id=2", "", nil, &tree)
+	if len(tree.Levels) != 1 || tree.Levels[0].ID != 2 || len(tree.Levels[0].Years) != 4 {
+		t.Errorf("level 2 subtree: %+v", tree.Levels)
+	}
+
+	tests := []struct {
+		query  string
+		status int
+	}{
+		{"depth=0", 400},
+		{"depth=4", 400},
+		{"level_id=x", 400},
+		{"level_id=99", 404},
+		{"year_id=3", 404},
+		{"year_id=99", 404},
+	}
+	for _, tt := range tests {
+		if code := call(t, "GET", "/api/tree?"+tt.query, "", nil, nil); code != tt.status {
+			t.Errorf("%s: %d, want %d", tt.query, code, tt.status)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/gin-gonic/gin"
+)
+
+// ========== UPLOAD VALIDATION ==========
+//
+// Every uploaded file is checked before it reaches storage:
+//
+//   - its size against the limit of its category, or UPLOAD_MAX_BYTES
+//     (default 50 MiB) when the category has none; 413 when it is larger
+//   - its extension and sniffed content against allowedUploadTypes; 415 when
+//     either is not allowed or they disagree
+//
+// The client filename is only kept, sanitised, as the download name.
+
+const (
+	defaultUploadMaxBytes = 50 << 20
+	// multipartOverhead leaves room for the form fields around the file.
+	multipartOverhead = 1 << 20
+	sniffLength       = 3072
+)
+
+type uploadType struct {
+	mimeType   string
+	extensions []string
+}
+
+var allowedUploadTypes = []uploadType{
+	{"application/pdf", []string{".pdf"}},
+	{"application/msword", []string{".doc"}},
+	{"application/vnd.openxmlformats-officedocument.wordprocessingml.document", []string{".docx"}},
+	{"application/vnd.ms-powerpoint", []string{".ppt"}},
+	{"application/vnd.openxmlformats-officedocument.presentationml.presentation", []string{".pptx"}},
+	{"application/vnd.oasis.opendocument.text", []string{".odt"}},
+	{"image/jpeg", []string{".jpg", ".jpeg"}},
+	{"image/png", []string{".png"}},
+	{"image/webp", []string{".webp"}},
+}
+
+// incomingFile is an upload waiting to be validated and stored, whichever way
+// it arrived.
+type incomingFile struct {
+	Name string
+	Size int64
+	Open func() (io.ReadCloser, error)
+}
+
+func multipartUpload(file *multipart.FileHeader) incomingFile {
+	return incomingFile{
+		Name: file.Filename,
+		Size: file.Size,
+		Open: func() (io.ReadCloser, error) { return file.Open() },
+	}
+}
+
+// uploadRejection is an upload refused before it is stored, answered with
+// status.
+type uploadRejection struct {
+	status  int
+	message string
+	details gin.H
+}
+
+func (e *uploadRejection) Error() string {
+	return e.message
+}
+
+func defaultUploadLimit() int64 {
+	limit, err := strconv.ParseInt(os.Getenv("UPLOAD_MAX_BYTES"), 10, 64)
+	if err != nil || limit <= 0 {
+		return defaultUploadMaxBytes
+	}
+	return limit
+}
+
+// uploadLimit is the largest file accepted in a category. Unknown categories
+// get the default and are rejected later by the foreign key.
+func uploadLimit(categoryID any) (int64, error) {
+	var limit sql.NullInt64
+	err := db.QueryRow("SELECT max_upload_size FROM categories WHERE id = ?", categoryID).Scan(&limit)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	if !limit.Valid || limit.Int64 <= 0 {
+		return defaultUploadLimit(), nil
+	}
+	return limit.Int64, nil
+}
+
+// maxUploadRequest bounds the whole request body before it is parsed, using
+// the largest limit of any category since the category is not known yet.
+func maxUploadRequest() int64 {
+	limit := defaultUploadLimit()
+	var largest int64
+	if db.QueryRow("SELECT COALESCE(MAX(max_upload_size), 0) FROM categories WHERE deleted_at IS NULL").Scan(&largest) == nil && largest > limit {
+		limit = largest
+	}
+	return limit + multipartOverhead
+}
+
+// formFile reads the "file" field of a multipart upload, answering 413 when
+// the body is over every limit and 400 when the field is missing.
+func formFile(c *gin.Context) (*multipart.FileHeader, bool) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxUploadRequest())
+	file, err := c.FormFile("file")
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		c.JSON(413, gin.H{"error": "File is too large", "max_bytes": tooLarge.Limit - multipartOverhead})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(400, gin.H{"error": "No file uploaded"})
+		return nil, false
+	}
+	return file, true
+}
+
+// sanitizeFileName keeps the base name of a client filename without control
+// or reserved characters, so it is safe in paths and Content-Disposition.
+func sanitizeFileName(name string) string {
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimLeft(strings.Join(strings.Fields(name), " "), ". ")
+
+	ext := strings.ToLower(path.Ext(name))
+	base := strings.TrimSpace(strings.TrimSuffix(name, path.Ext(name)))
+	if runes := []rune(base); len(runes) > 150 {
+		base = string(runes[:150])
+	}
+	if base == "" {
+		base = "document"
+	}
+	return base + ext
+}
+
+// titleFromFileName turns a name such as "bac_2019-math.pdf" into the title
+// "bac 2019 math".
+func titleFromFileName(name string) string {
+	name = sanitizeFileName(name)
+	name = strings.TrimSuffix(name, path.Ext(name))
+	name = strings.NewReplacer("_", " ", "-", " ").Replace(name)
+	return strings.Join(strings.Fields(name), " ")
+}
+
+func allowedExtension(ext string) bool {
+	_, ok := extensionType(ext)
+	return ok
+}
+
+// extensionType returns the allowed type of files with the extension.
+func extensionType(ext string) (string, bool) {
+	for _, t := range allowedUploadTypes {
+		for _, e := range t.extensions {
+			if e == ext {
+				return t.mimeType, true
+			}
+		}
+	}
+	return "", false
+}
+
+// matchUploadType returns the allowed type of the sniffed content when it
+// agrees with the file extension.
+func matchUploadType(detected *mimetype.MIME, ext string) (string, bool) {
+	for _, t := range allowedUploadTypes {
+		if !detected.Is(t.mimeType) {
+			continue
+		}
+		for _, e := range t.extensions {
+			if e == ext {
+				return t.mimeType, true
+			}
+		}
+	}
+	return "", false
+}
+
+// inspectUpload validates an upload against limit and computes its checksum,
+// detected type and blob key, without storing anything yet.
+func inspectUpload(file incomingFile, limit int64) (storedFile, error) {
+	stored := storedFile{Name: sanitizeFileName(file.Name), Size: file.Size}
+	if file.Size > limit {
+		return stored, &uploadRejection{413, "File is too large", gin.H{"max_bytes": limit}}
+	}
+	ext := path.Ext(stored.Name)
+	if !allowedExtension(ext) {
+		return stored, &uploadRejection{415, fmt.Sprintf("Files of type %q are not allowed", ext), nil}
+	}
+
+	src, err := file.Open()
+	if err != nil {
+		return stored, err
+	}
+	defer src.Close()
+
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(src, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return stored, err
+	}
+	head = head[:n]
+
+	detected := mimetype.Detect(head)
+	mimeType, ok := matchUploadType(detected, ext)
+	if !ok {
+		return stored, &uploadRejection{415, "File content does not match an allowed type", gin.H{"detected": detected.String()}}
+	}
+	stored.MimeType = mimeType
+
+	hash := sha256.New()
+	hash.Write(head)
+	if _, err := io.Copy(hash, src); err != nil {
+		return stored, err
+	}
+	stored.Checksum = hex.EncodeToString(hash.Sum(nil))
+	stored.Path = blobKey(stored.Checksum)
+	return stored, nil
+}
+
+// uploadErrorBody is the status and body answering a failed upload: those of
+// a validation rejection, or a 500.
+func uploadErrorBody(err error) (int, gin.H) {
+	var rejected *uploadRejection
+	if errors.As(err, &rejected) {
+		body := gin.H{"error": rejected.message}
+		for k, v := range rejected.details {
+			body[k] = v
+		}
+		return rejected.status, body
+	}
+	return 500, gin.H{"error": "Failed to save file"}
+}
+
+func respondUploadError(c *gin.Context, err error) {
+	c.JSON(uploadErrorBody(err))
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const testPDF = "%PDF-1.4\n1 0 obj << /Type /Catalog >> endobj\n%%EOF\n"
+
+type testFile struct {
+	field, name, content string
+}
+
+// multipartRequest builds a multipart/form-data request carrying the fields
+// and files.
+func multipartRequest(t *testing.T, target, token string, fields map[string]string, files ...testFile) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for name, value := range fields {
+		form.WriteField(name, value)
+	}
+	for _, f := range files {
+		w, err := form.CreateFormFile(f.field, f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(f.content))
+	}
+	form.Close()
+	req := testRequest("POST", target, token, &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return req
+}
+
+func TestUploadValidation(t *testing.T) {
+	openTestDB(t)
+	seedTestData(t)
+	useTestStorage(t)
+	_, token := addTestAdmin(t, "root", RoleSuperAdmin, nil, nil, nil)
+	db.Exec("UPDATE categories SET max_upload_size = 1024 WHERE id = 2")
+
+	tests := []struct {
+		name, category, content string
+		status                  int
+	}{
+		{"cours.pdf", "1", testPDF, 200},
+		{"COURS.PDF", "1", testPDF, 200},
+		{"page.pdf", "1", "<html><script>alert(1)</script></html>", 415},
+		{"image.pdf", "1", "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR", 415},
+		{"cours.png", "1", testPDF, 415},
+		{"setup.exe", "1", "MZ\x90\x00", 415},
+		{"page.html", "1", "<html></html>", 415},
+		{"examen.pdf", "2", testPDF + strings.Repeat("x", 1024), 413},
+		{"examen.pdf", "2", testPDF, 200},
+	}
+	for _, tt := range tests {
+		w := serve(multipartRequest(t, "/api/admin/upload", token,
+			map[string]string{"subject_id": "1", "category_id": tt.category, "title": tt.name + tt.category},
+			testFile{"file", tt.name, tt.content}))
+		if w.Code != tt.status {
+			t.Errorf("%s in category %s: %d %s, want %d", tt.name, tt.category, w.Code, w.Body, tt.status)
+		}
+		if w.Code == 413 && !strings.Contains(w.Body.String(), `"max_bytes":1024`) {
+			t.Errorf("%s: 413 without the category limit: %s", tt.name, w.Body)
+		}
+	}
+}
+
+func TestUploadRequestLimit(t *testing.T) {
+	openTestDB(t)
+	seedTestData(t)
+	useTestStorage(t)
+	_, token := addTestAdmin(t, "root", RoleSuperAdmin, nil, nil, nil)
+	t.Setenv("UPLOAD_MAX_BYTES", "1024")
+
+	// The body is cut off past the largest limit, before the form is parsed.
+	w := serve(multipartRequest(t, "/api/admin/upload", token,
+		map[string]string{"subject_id": "1", "category_id": "1", "title": "gros"},
+		testFile{"file", "gros.pdf", testPDF + strings.Repeat("x", 2*multipartOverhead)}))
+	if w.Code != 413 {
+		t.Errorf("oversized request: %d %s, want 413", w.Code, w.Body)
+	}
+}
+
+func TestServeUploadLegacyFiles(t *testing.T) {
+	useTestStorage(t)
+	for key, content := range map[string]string{
+		"uploads/cours.pdf": testPDF,
+		"uploads/page.html": "<html><script>alert(1)</script></html>",
+		"uploads/page.svg":  "<svg onload=alert(1)>",
+	} {
+		if err := store.Put(key, strings.NewReader(content), int64(len(content))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := serve(testRequest("GET", "/uploads/cours.pdf", "", nil))
+	if w.Code != 200 || w.Body.String() != testPDF {
+		t.Fatalf("cours.pdf: %d", w.Code)
+	}
+	for header, want := range map[string]string{
+		"Content-Type":           "application/pdf",
+		"Content-Disposition":    "attachment; filename=cours.pdf",
+		"X-Content-Type-Options": "nosniff",
+	} {
+		if got := w.Header().Get(header); got != want {
+			t.Errorf("%s = %q, want %q", header, got, want)
+		}
+	}
+
+	for _, target := range []string{"/uploads/page.html", "/uploads/page.svg", "/uploads/missing.pdf", "/uploads/../uploads/page.html"} {
+		if w := serve(testRequest("GET", target, "", nil)); w.Code != 404 {
+			t.Errorf("%s: %d, want 404", target, w.Code)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========== DOCUMENT VERSIONS ==========
+//
+// Every uploaded file is kept as a numbered version of its document. The
+// documents row mirrors the file fields of its current version, so downloads
+// and listings keep reading documents.file_path.
+
+type DocumentVersion struct {
+	ID          int       `json:"id"`
+	DocumentID  int       `json:"document_id"`
+	Version     int       `json:"version"`
+	FileName    string    `json:"file_name"`
+	FilePath    string    `json:"file_path"`
+	FileSize    int64     `json:"file_size"`
+	MimeType    string    `json:"mime_type"`
+	Checksum    string    `json:"checksum"`
+	Note        string    `json:"note"`
+	UploadedBy  *string   `json:"uploaded_by"`
+	CreatedAt   time.Time `json:"created_at"`
+	ScanStatus  string    `json:"scan_status"`
+	ScanVerdict string    `json:"scan_verdict"`
+	Current     bool      `json:"current"`
+}
+
+// errTrashedParent is returned by createDocument when the subject or category
+// went to the trash while the file was being uploaded.
+var errTrashedParent = errors.New("subject or category is in the trash")
+
+// createDocument inserts a document together with its first version.
+func createDocument(subjectID, categoryID any, title string, file storedFile, adminID int) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Foreign keys accept trashed rows, whose documents nobody could find.
+	var live bool
+	err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM subjects WHERE id = ? AND deleted_at IS NULL)
+                          AND EXISTS (SELECT 1 FROM categories WHERE id = ? AND deleted_at IS NULL)`,
+		subjectID, categoryID).Scan(&live)
+	if err != nil {
+		return 0, err
+	}
+	if !live {
+		return 0, errTrashedParent
+	}
+
+	scan, err := initialScan(tx, file)
+	if err != nil {
+		return 0, err
+	}
+	result, err := tx.Exec(`INSERT INTO documents (subject_id, category_id, title, file_name, file_path, file_size, mime_type, content_hash,
+                                                   scan_status, scan_verdict)
+                            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		subjectID, categoryID, title, file.Name, file.Path, file.Size, file.MimeType, file.Checksum, scan.status, scan.verdict)
+	if err != nil {
+		return 0, err
+	}
+	docID, _ := result.LastInsertId()
+	if err := insertVersion(tx, docID, 1, file, "", adminID, scan); err != nil {
+		return 0, err
+	}
+	if err := reindexDocument(tx, docID); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	invalidateSubjectDocuments(subjectID)
+	return docID, nil
+}
+
+// insertVersion records a version uploaded by adminID, 0 when it comes from a
+// command-line import.
+func insertVersion(tx *sql.Tx, docID int64, version int, file storedFile, note string, adminID int, scan scanResult) error {
+	uploadedBy := sql.NullInt64{Int64: int64(adminID), Valid: adminID != 0}
+	_, err := tx.Exec(`INSERT INTO document_versions (document_id, version, file_name, file_path, file_size, mime_type, checksum, note,
+                                                      uploaded_by, scan_status, scan_verdict)
+                       VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		docID, version, file.Name, file.Path, file.Size, file.MimeType, file.Checksum, note, uploadedBy, scan.status, scan.verdict)
+	return err
+}
+
+// addVersion stores file as the next version of a document and makes it
+// current. It returns errNotFound when the document is gone or in the trash.
+func addVersion(docID int64, file storedFile, note string, adminID int) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var version int
+	if err := tx.QueryRow("SELECT COALESCE(MAX(version), 0) + 1 FROM document_versions WHERE document_id = ?", docID).Scan(&version); err != nil {
+		return 0, err
+	}
+	scan, err := initialScan(tx, file)
+	if err != nil {
+		return 0, err
+	}
+	if err := insertVersion(tx, docID, version, file, note, adminID, scan); err != nil {
+		return 0, err
+	}
+	result, err := tx.Exec(`UPDATE documents SET file_name = ?, file_path = ?, file_size = ?, mime_type = ?, content_hash = ?,
+                                   scan_status = ?, scan_verdict = ?, current_version = ?, updated_at = ?
+                            WHERE id = ? AND deleted_at IS NULL`,
+		file.Name, file.Path, file.Size, file.MimeType, file.Checksum, scan.status, scan.verdict, version, currentTimestamp(), docID)
+	if err != nil {
+		return 0, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return 0, errNotFound
+	}
+	if err := reindexDocument(tx, docID); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	invalidateDocument(docID)
+	return version, nil
+}
+
+func loadVersion(docID, version any) (DocumentVersion, error) {
+	var v DocumentVersion
+	err := db.QueryRow(`SELECT id, document_id, version, file_name, file_path, file_size, mime_type, checksum, note,
+                               scan_status, scan_verdict, created_at
+                        FROM document_versions WHERE document_id = ? AND version = ?`, docID, version).
+		Scan(&v.ID, &v.DocumentID, &v.Version, &v.FileName, &v.FilePath, &v.FileSize, &v.MimeType, &v.Checksum, &v.Note,
+			&v.ScanStatus, &v.ScanVerdict, &v.CreatedAt)
+	return v, err
+}
+
+// ========== VERSION HANDLERS ==========
+
+func GetDocumentVersions(c *gin.Context) {
+	docID := c.Param("id")
+	if !authorize(c, RoleUploader, documentScope, docID) {
+		return
+	}
+
+	query := `SELECT v.id, v.document_id, v.version, v.file_name, v.file_path, v.file_size, v.mime_type, v.checksum, v.note,
+                     a.username, v.scan_status, v.scan_verdict, v.created_at, v.version = d.current_version
+              FROM document_versions v
+              JOIN documents d ON v.document_id = d.id
+              LEFT JOIN admins a ON v.uploaded_by = a.id
+              WHERE v.document_id = ?
+              ORDER BY v.version DESC`
+
+	rows, err := db.Query(query, docID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	versions := []DocumentVersion{}
+	for rows.Next() {
+		var v DocumentVersion
+		if err := rows.Scan(&v.ID, &v.DocumentID, &v.Version, &v.FileName, &v.FilePath, &v.FileSize, &v.MimeType, &v.Checksum,
+			&v.Note, &v.UploadedBy, &v.ScanStatus, &v.ScanVerdict, &v.CreatedAt, &v.Current); err != nil {
+			continue
+		}
+		versions = append(versions, v)
+	}
+	c.JSON(200, versions)
+}
+
+func DownloadDocumentVersion(c *gin.Context) {
+	docID := c.Param("id")
+	if !authorize(c, RoleUploader, documentScope, docID) {
+		return
+	}
+
+	v, err := loadVersion(docID, c.Param("version"))
+	if err != nil {
+		c.JSON(404, gin.H{"error": "Version not found"})
+		return
+	}
+	if v.ScanStatus == scanRejected {
+		c.JSON(403, gin.H{"error": "This version was rejected by the malware scanner", "verdict": v.ScanVerdict})
+		return
+	}
+	serveObject(c, v.FilePath, v.FileName, v.MimeType)
+}
+
+// RollbackDocument makes an earlier version current again. Later versions are
+// kept, so a rollback can itself be undone.
+func RollbackDocument(c *gin.Context) {
+	docID := c.Param("id")
+	if !authorize(c, RoleUploader, documentScope, docID) {
+		return
+	}
+
+	v, err := loadVersion(docID, c.Param("version"))
+	if err != nil {
+		c.JSON(404, gin.H{"error": "Version not found"})
+		return
+	}
+
+	result, err := db.Exec(`UPDATE documents SET file_name = ?, file_path = ?, file_size = ?, mime_type = ?, content_hash = NULLIF(?, ''),
+                                   scan_status = ?, scan_verdict = ?, current_version = ?, updated_at = ?
+                            WHERE id = ? AND deleted_at IS NULL`,
+		v.FileName, v.FilePath, v.FileSize, v.MimeType, v.Checksum, v.ScanStatus, v.ScanVerdict, v.Version, currentTimestamp(), docID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(404, gin.H{"error": "Document not found"})
+		return
+	}
+	logIndexError(reindexDocument(db, docID))
+	invalidateDocument(docID)
+	c.JSON(200, gin.H{"message": "Document rolled back", "current_version": v.Version})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVersionHistoryAndRollback(t *testing.T) {
+	openTestDB(t)
+	seedTestData(t)
+	useTestStorage(t)
+	adminID, token := addTestAdmin(t, "uploader", RoleUploader, nil, nil, intPtr(1))
+	docID, firstKey := addTestDocument(t, "cours", testPDF)
+	second := storedFile{Name: "cours-v2.pdf", Path: "blobs/aa/v2", Size: 3, Checksum: "v2", MimeType: "application/pdf"}
+	if err := store.Put(second.Path, strings.NewReader("v2!"), 3); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2024, 9, 30, 10, 0, 0, 0, time.UTC)
+	setClock(t, start)
+	if _, err := addVersion(docID, second, "corrigé", adminID); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(t, "SELECT COUNT(*) FROM documents WHERE id = ? AND updated_at = '2024-09-30 10:00:00'", docID); n != 1 {
+		t.Error("updated_at is not the time of the new version")
+	}
+	scanPendingFiles()
+	base := fmt.Sprintf("/api/admin/documents/%d", docID)
+
+	var versions []DocumentVersion
+	if code := call(t, "GET", base+"/versions", token, nil, &versions); code != 200 {
+		t.Fatalf("versions: %d", code)
+	}
+	if len(versions) != 2 || versions[0].Version != 2 || !versions[0].Current || versions[1].Current {
+		t.Fatalf("versions = %+v, want 2 then 1 with 2 current", versions)
+	}
+	if versions[0].Note != "corrigé" || versions[0].UploadedBy == nil || *versions[0].UploadedBy != "uploader" {
+		t.Errorf("version 2 note %q, uploaded by %v", versions[0].Note, versions[0].UploadedBy)
+	}
+
+	if w := serve(testRequest("GET", base+"/versions/1/download", token, nil)); w.Code != 200 || w.Body.String() != testPDF {
+		t.Errorf("download of version 1: %d", w.Code)
+	}
+	if code := call(t, "POST", base+"/versions/9/rollback", token, nil, nil); code != 404 {
+		t.Errorf("rollback to a missing version: %d, want 404", code)
+	}
+	setClock(t, start.Add(time.Hour))
+	if code := call(t, "POST", base+"/versions/1/rollback", token, nil, nil); code != 200 {
+		t.Fatalf("rollback: %d", code)
+	}
+	if n := count(t, "SELECT COUNT(*) FROM documents WHERE id = ? AND updated_at = '2024-09-30 11:00:00'", docID); n != 1 {
+		t.Error("updated_at is not the time of the rollback")
+	}
+	var path string
+	var current int
+	db.QueryRow("SELECT file_path, current_version FROM documents WHERE id = ?", docID).Scan(&path, &current)
+	if path != firstKey || current != 1 {
+		t.Errorf("after rollback: %s version %d, want %s version 1", path, current, firstKey)
+	}
+	if w := serve(testRequest("GET", fmt.Sprintf("/api/download/%d", docID), "", nil)); w.Body.String() != testPDF {
+		t.Errorf("public download after rollback: %d %q", w.Code, w.Body)
+	}
+	// Later versions stay, so the rollback can be undone.
+	if count(t, "SELECT COUNT(*) FROM document_versions WHERE document_id = ?", docID) != 2 {
+		t.Error("rollback dropped a version")
+	}
+
+	db.Exec("UPDATE document_versions SET scan_status = ?, scan_verdict = 'Eicar-Test' WHERE document_id = ? AND version = 2", scanRejected, docID)
+	if code := call(t, "GET", base+"/versions/2/download", token, nil, nil); code != 403 {
+		t.Errorf("download of a rejected version: %d, want 403", code)
+	}
+}
+
+func TestVersionsNeedUploadRights(t *testing.T) {
+	openTestDB(t)
+	seedTestData(t)
+	useTestStorage(t)
+	_, token := addTestAdmin(t, "uploader", RoleUploader, nil, nil, intPtr(17))
+	docID, _ := addTestDocument(t, "cours", testPDF)
+
+	for _, req := range []struct{ method, path string }{
+		{"GET", "/versions"},
+		{"GET", "/versions/1/download"},
+		{"POST", "/versions/1/rollback"},
+	} {
+		if code := call(t, req.method, fmt.Sprintf("/api/admin/documents/%d%s", docID, req.path), token, nil, nil); code != 403 {
+			t.Errorf("%s %s of another subject's document: %d, want 403", req.method, req.path, code)
+		}
+	}
+}
+
+func TestVersionsOfTrashedDocument(t *testing.T) {
+	openTestDB(t)
+	seedTestData(t)
+	useTestStorage(t)
+	_, token := addTestAdmin(t, "uploader", RoleUploader, nil, nil, intPtr(1))
+	docID, _ := addTestDocument(t, "cours", testPDF)
+	if err := trashNode("documents", docID); err != nil {
+		t.Fatal(err)
+	}
+
+	second := storedFile{Name: "cours-v2.pdf", Path: "blobs/aa/v2", Size: 3, Checksum: "v2", MimeType: "application/pdf"}
+	if _, err := addVersion(docID, second, "", 0); err != errNotFound {
+		t.Errorf("addVersion to a trashed document: %v, want errNotFound", err)
+	}
+	if count(t, "SELECT COUNT(*) FROM document_versions WHERE document_id = ?", docID) != 1 {
+		t.Error("a version was added to a trashed document")
+	}
+	if code := call(t, "POST", fmt.Sprintf("/api/admin/documents/%d/versions/1/rollback", docID), token, nil, nil); code != 404 {
+		t.Errorf("rollback of a trashed document: %d, want 404", code)
+	}
+}